@@ -27,6 +27,10 @@ type SchemeManager struct {
 	Status SchemeManagerStatus `xml:"-"`
 	Valid  bool                `xml:"-"` // true iff Status == SchemeManagerStatusValid
 
+	// Files present in the scheme manager folder that are not signed, nor excluded from signing
+	// by its .schemeignore file; set by VerifySchemeManager
+	UnsignedFiles []string `xml:"-"`
+
 	index SchemeManagerIndex
 }
 
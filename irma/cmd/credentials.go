@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List credentials",
+	Long:  `The list command prints all credentials in the wallet along with their attributes.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		printCredentials(client)
+		return nil
+	},
+}
+
+var removeCmd = &cobra.Command{
+	Use:   "remove [credential_type [index]]",
+	Short: "Remove credentials",
+	Long:  `The remove command removes the specified credential (index defaults to 0), the credential with the hash specified by --hash, or all credentials if --all is specified.`,
+	Args:  cobra.MaximumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			return err
+		}
+		hash, err := cmd.Flags().GetString("hash")
+		if err != nil {
+			return err
+		}
+
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case all:
+			err = client.RemoveAllCredentials()
+		case hash != "":
+			err = client.RemoveCredentialByHash(hash)
+		case len(args) > 0:
+			index := 0
+			if len(args) == 2 {
+				if index, err = strconv.Atoi(args[1]); err != nil {
+					return errors.Errorf("Invalid index %s", args[1])
+				}
+			}
+			err = client.RemoveCredential(irma.NewCredentialTypeIdentifier(args[0]), index)
+		default:
+			return errors.New("Specify a credential type, --hash or --all")
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Removed")
+		return nil
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(listCmd)
+	walletCmd.AddCommand(removeCmd)
+	removeCmd.Flags().Bool("all", false, "remove all credentials")
+	removeCmd.Flags().String("hash", "", "remove the credential with this hash")
+}
+
+func printCredentials(client *irmaclient.Client) {
+	list := client.CredentialInfoList()
+	if len(list) == 0 {
+		fmt.Println("No credentials")
+		return
+	}
+
+	for _, info := range list {
+		fmt.Printf("%s (index %d)\n", info.CredentialTypeID, info.Index)
+		fmt.Println("  Hash    :", info.Hash)
+		fmt.Println("  Signed  :", time.Time(info.SignedOn).String())
+		fmt.Println("  Expires :", time.Time(info.Expires).String())
+		credtype := client.Configuration.CredentialTypes[irma.NewCredentialTypeIdentifier(info.CredentialTypeID)]
+		for i, attr := range info.Attributes {
+			fmt.Printf("  %s: %s\n", attributeName(credtype, i), attr["en"])
+		}
+	}
+}
+
+// attributeName returns the English name of the attribute at the specified index of the
+// credential type, or just the index if we do not know the credential type or attribute.
+func attributeName(credtype *irma.CredentialType, index int) string {
+	if credtype == nil || index >= len(credtype.Attributes) {
+		return strconv.Itoa(index)
+	}
+	if translated, ok := credtype.Attributes[index].Name["en"]; ok {
+		return translated
+	}
+	return credtype.Attributes[index].ID
+}
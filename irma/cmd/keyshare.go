@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var enrollCmd = &cobra.Command{
+	Use:   "enroll scheme_manager",
+	Short: "Enroll at a keyshare server",
+	Long:  `The enroll command enrolls the wallet at the keyshare server of the specified scheme manager, using the specified email address and PIN.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		email, err := cmd.Flags().GetString("email")
+		if err != nil {
+			return err
+		}
+		pin, err := cmd.Flags().GetString("pin")
+		if err != nil {
+			return err
+		}
+
+		handler := newClientHandler()
+		client, err := openClient(cmd, handler)
+		if err != nil {
+			return err
+		}
+		if pin == "" {
+			if pin, err = promptPin(newStdinReader(), "PIN: "); err != nil {
+				return err
+			}
+		}
+
+		manager := irma.NewSchemeManagerIdentifier(args[0])
+		client.KeyshareEnroll(manager, email, pin)
+		if err = <-handler.enrollment; err != nil {
+			return err
+		}
+		fmt.Println("Enrolled at keyshare server of", manager)
+		return nil
+	},
+}
+
+var unenrollCmd = &cobra.Command{
+	Use:   "unenroll scheme_manager",
+	Short: "Remove a keyshare server enrollment",
+	Long:  `The unenroll command removes the enrollment at the keyshare server of the specified scheme manager from the wallet.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		return client.KeyshareRemove(irma.NewSchemeManagerIdentifier(args[0]))
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(enrollCmd)
+	walletCmd.AddCommand(unenrollCmd)
+	enrollCmd.Flags().String("email", "", "email address to enroll with")
+	enrollCmd.Flags().String("pin", "", "PIN to enroll with (asked interactively if not specified)")
+}
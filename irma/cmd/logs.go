@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Show logs",
+	Long:  `The logs command prints the log entries of earlier IRMA sessions, credential removals and log deletions.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		logs, err := client.Logs()
+		if err != nil {
+			return err
+		}
+		if len(logs) == 0 {
+			fmt.Println("No log entries")
+		}
+		for _, entry := range logs {
+			printLogEntry(entry, client.Configuration)
+		}
+		return nil
+	},
+}
+
+var deleteLogsCmd = &cobra.Command{
+	Use:   "delete [id]",
+	Short: "Delete log entries",
+	Long:  `The delete command deletes the log entry with the specified ID, or all log entries before the date specified by --before (as YYYY-MM-DD). The deletion itself is logged.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		before, err := cmd.Flags().GetString("before")
+		if err != nil {
+			return err
+		}
+		if (len(args) == 0) == (before == "") {
+			return errors.New("Specify either a log entry ID or --before")
+		}
+
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		if before != "" {
+			t, err := time.ParseInLocation("2006-01-02", before, time.Local)
+			if err != nil {
+				return errors.Errorf("Invalid date %s", before)
+			}
+			if err = client.DeleteLogsBefore(t); err != nil {
+				return err
+			}
+		} else {
+			id, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return errors.Errorf("Invalid log entry ID %s", args[0])
+			}
+			if err = client.DeleteLogEntry(id); err != nil {
+				return err
+			}
+		}
+		fmt.Println("Deleted")
+		return nil
+	},
+}
+
+var retentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Set log retention",
+	Long:  `The retention command sets how many days and how many log entries are kept (0 means no limit), deleting older entries immediately. Without flags it prints the current setting.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		days, entries := client.Preferences.LogRetentionDays, client.Preferences.LogRetentionEntries
+		if !cmd.Flags().Changed("days") && !cmd.Flags().Changed("entries") {
+			fmt.Printf("Days   : %d\nEntries: %d\n", days, entries)
+			return nil
+		}
+		if cmd.Flags().Changed("days") {
+			if days, err = cmd.Flags().GetInt("days"); err != nil {
+				return err
+			}
+		}
+		if cmd.Flags().Changed("entries") {
+			if entries, err = cmd.Flags().GetInt("entries"); err != nil {
+				return err
+			}
+		}
+		return client.SetLogRetentionPreference(days, entries)
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(logsCmd)
+	logsCmd.AddCommand(deleteLogsCmd)
+	logsCmd.AddCommand(retentionCmd)
+	deleteLogsCmd.Flags().String("before", "", "delete all log entries before this date (YYYY-MM-DD)")
+	retentionCmd.Flags().Int("days", 0, "delete log entries older than this many days")
+	retentionCmd.Flags().Int("entries", 0, "keep only this many most recent log entries")
+}
+
+func printLogEntry(entry *irmaclient.LogEntry, conf *irma.Configuration) {
+	fmt.Printf("%d. %s: %s\n", entry.ID, time.Time(entry.Time).String(), entry.Type)
+	if entry.SessionInfo != nil && entry.SessionInfo.Jwt != "" {
+		if jwt, err := entry.Jwt(); err == nil {
+			fmt.Println("  Requestor:", jwt.Requestor())
+		}
+	}
+	if entry.Group != "" {
+		fmt.Println("  Group    :", entry.Group)
+	}
+	if entry.Policy != nil {
+		fmt.Printf("  Policy   : %s (%s)\n", entry.Policy.ID, entry.Policy.Kind)
+	}
+	if entry.Outcome != irmaclient.LogOutcomeSuccess {
+		fmt.Println("  Outcome  :", entry.Outcome, entry.ErrorType)
+		for _, disjunction := range entry.Requested {
+			fmt.Printf("  Requested: %s: %v\n", disjunction.Label, disjunction.Attributes)
+		}
+	}
+	for _, cred := range entry.Disclosed {
+		for id, attr := range cred.Attributes {
+			fmt.Printf("  Disclosed: %s (%s): %s\n", conf.AttributeName(id)["en"], id, attr.Value)
+			if attr.Label != "" {
+				fmt.Println("    requested as", attr.Label)
+			}
+		}
+	}
+	printAttributes("Received", entry.Received)
+	printAttributes("Removed", entry.Removed)
+	if len(entry.SignedMessage) > 0 {
+		fmt.Printf("  Signed   : %s (%s)\n", string(entry.SignedMessage), entry.SignedMessageType)
+	}
+	if entry.DeletedLogs > 0 {
+		fmt.Println("  Deleted  :", entry.DeletedLogs, "log entries")
+	}
+}
+
+func printAttributes(title string, attrs map[irma.CredentialTypeIdentifier][]irma.TranslatedString) {
+	for credtype, list := range attrs {
+		fmt.Printf("  %s: %s\n", title, credtype)
+		for _, attr := range list {
+			fmt.Println("    ", attr["en"])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "List disclosure policies",
+	Long:  `The policy command lists the disclosure policies of the wallet, which are applied to disclosure requests before asking for permission.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		for _, policy := range client.DisclosurePolicies() {
+			fmt.Printf("%s. %s\n", policy.ID, policy.Kind)
+			if policy.Origin != "" {
+				fmt.Println("  Origin    :", policy.Origin)
+			}
+			if policy.Requestor != "" {
+				fmt.Println("  Requestor :", policy.Requestor)
+			}
+			if policy.Label != "" {
+				fmt.Println("  Label     :", policy.Label)
+			}
+			for _, attr := range policy.Attributes {
+				fmt.Println("  Attribute :", attr)
+			}
+			if policy.Credential.String() != "" {
+				fmt.Println("  Credential:", policy.Credential)
+			}
+		}
+		return nil
+	},
+}
+
+var addPolicyCmd = &cobra.Command{
+	Use:   "add approve|prefer|deny",
+	Short: "Add a disclosure policy",
+	Long: `The add command adds a disclosure policy of the specified kind:
+  approve: disclose the --attr attributes without asking for permission in sessions
+           with the IRMA server at --origin, optionally only those of a --requestor
+  prefer:  choose attributes from the --credential credential type by default
+  deny:    never disclose the --attr attributes
+The prefer and deny policies can be restricted to a --requestor and to requested attributes with a --label.
+An --attr may also be a credential type, meaning all of its attributes.
+
+As anyone can start a session claiming to be any requestor, an approve policy applies only
+to sessions with the IRMA server at its --origin: the host (and port, if not 443) of the
+session URL in the QR code, which must use https. That server is trusted to have
+authenticated the requestor.`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{string(irmaclient.PolicyApprove), string(irmaclient.PolicyPrefer), string(irmaclient.PolicyDeny)},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		policy := &irmaclient.DisclosurePolicy{Kind: irmaclient.PolicyKind(args[0])}
+		var err error
+		if policy.Requestor, err = flags.GetString("requestor"); err != nil {
+			return err
+		}
+		if policy.Origin, err = flags.GetString("origin"); err != nil {
+			return err
+		}
+		if policy.Label, err = flags.GetString("label"); err != nil {
+			return err
+		}
+		attrs, err := flags.GetStringArray("attr")
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			policy.Attributes = append(policy.Attributes, irma.NewAttributeTypeIdentifier(attr))
+		}
+		credential, err := flags.GetString("credential")
+		if err != nil {
+			return err
+		}
+		policy.Credential = irma.NewCredentialTypeIdentifier(credential)
+
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		if err = client.AddDisclosurePolicy(policy); err != nil {
+			return err
+		}
+		fmt.Println("Added disclosure policy", policy.ID)
+		return nil
+	},
+}
+
+var removePolicyCmd = &cobra.Command{
+	Use:   "remove id",
+	Short: "Remove a disclosure policy",
+	Long:  `The remove command removes the disclosure policy with the specified ID.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+		return client.RemoveDisclosurePolicy(args[0])
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(addPolicyCmd)
+	policyCmd.AddCommand(removePolicyCmd)
+	addPolicyCmd.Flags().String("requestor", "", "name of the requestor to which the policy applies")
+	addPolicyCmd.Flags().String("origin", "", "host of the IRMA server to which an approve policy applies")
+	addPolicyCmd.Flags().StringArray("attr", nil, "attribute or credential type identifier (repeatable)")
+	addPolicyCmd.Flags().String("label", "", "label of the requested attributes to which the policy applies")
+	addPolicyCmd.Flags().String("credential", "", "credential type to prefer")
+}
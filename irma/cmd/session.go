@@ -0,0 +1,337 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var sessionCmd = &cobra.Command{
+	Use:   "session qr",
+	Short: "Perform an IRMA session",
+	Long: `The session command performs the IRMA session specified by its argument, which may be the JSON contents of a session QR, an irma:// deep link, or an https universal link embedding the QR.
+
+The user is asked which attributes to disclose, for permission, and for the keyshare PIN if needed. With --yes, the first candidate of each disjunction is chosen and permission is granted automatically.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return err
+		}
+		pin, err := cmd.Flags().GetString("pin")
+		if err != nil {
+			return err
+		}
+
+		qr, err := irma.ParseQr(args[0])
+		if err != nil {
+			return err
+		}
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+
+		handler := &terminalHandler{
+			client: client,
+			in:     newStdinReader(),
+			yes:    yes,
+			pin:    pin,
+			done:   make(chan error, 1),
+		}
+		client.NewSession(qr, handler)
+		return <-handler.done
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume [id]",
+	Short: "List or resume interrupted IRMA sessions",
+	Long:  `Without arguments, the resume command lists the sessions that were interrupted after the user was asked for permission, e.g. because the process was killed. With an ID, it resumes that session, asking for permission again if it was not yet given. With --discard, the session is discarded instead.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return err
+		}
+		pin, err := cmd.Flags().GetString("pin")
+		if err != nil {
+			return err
+		}
+		discard, err := cmd.Flags().GetBool("discard")
+		if err != nil {
+			return err
+		}
+		client, err := openClient(cmd, newClientHandler())
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 0 {
+			sessions, err := client.ResumableSessions()
+			if err != nil {
+				return err
+			}
+			for _, s := range sessions {
+				fmt.Printf("%s  %s  %s session", s.ID, s.Created.Format("2006-01-02 15:04:05"), s.Action)
+				if s.Requestor != "" {
+					fmt.Printf(" with %s", s.Requestor)
+				}
+				if s.Permitted {
+					fmt.Print(", permission given")
+				}
+				if s.Expired {
+					fmt.Print(" (expired)")
+				}
+				fmt.Println()
+			}
+			return nil
+		}
+		if discard {
+			return client.DiscardSession(args[0])
+		}
+
+		handler := &terminalHandler{
+			client: client,
+			in:     newStdinReader(),
+			yes:    yes,
+			pin:    pin,
+			done:   make(chan error, 1),
+		}
+		client.ResumeSession(args[0], handler)
+		return <-handler.done
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(sessionCmd)
+	sessionCmd.Flags().BoolP("yes", "y", false, "choose attributes and grant permission automatically")
+	sessionCmd.Flags().String("pin", "", "keyshare PIN (asked interactively if not specified)")
+
+	walletCmd.AddCommand(resumeCmd)
+	resumeCmd.Flags().BoolP("yes", "y", false, "choose attributes and grant permission automatically")
+	resumeCmd.Flags().String("pin", "", "keyshare PIN (asked interactively if not specified)")
+	resumeCmd.Flags().Bool("discard", false, "discard the session instead of resuming it")
+}
+
+// terminalHandler implements irmaclient.Handler, asking the user for input on the terminal.
+type terminalHandler struct {
+	client *irmaclient.Client
+	in     *bufio.Reader
+	yes    bool
+	pin    string
+	done   chan error
+}
+
+func (h *terminalHandler) finish(err error) {
+	select {
+	case h.done <- err:
+	default: // Session already finished
+	}
+}
+
+func (h *terminalHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	fmt.Printf("%s session: %s\n", action, status)
+}
+
+// Success is called once all sessions of a chain have finished, so we only finish then.
+func (h *terminalHandler) Success(action irma.Action, result string) {
+	fmt.Printf("%s session succeeded\n", action)
+	if result != "" {
+		fmt.Println(result)
+	}
+	h.finish(nil)
+}
+
+func (h *terminalHandler) Cancelled(action irma.Action) {
+	h.finish(errors.Errorf("%s session cancelled", action))
+}
+
+func (h *terminalHandler) Failure(action irma.Action, err *irma.SessionError) {
+	h.finish(err)
+}
+
+func (h *terminalHandler) UnsatisfiableRequest(action irma.Action, ServerName string, missing irma.AttributeDisjunctionList) {
+	fmt.Printf("%s requests attributes that are not present in the wallet:\n", ServerName)
+	for _, disjunction := range missing {
+		fmt.Printf("  %s: %v\n", disjunction.Label, disjunction.Attributes)
+	}
+	h.finish(errors.Errorf("%s session unsatisfiable", action))
+}
+
+func (h *terminalHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.finish(errors.Errorf("Blocked at keyshare server of %s for %d seconds", manager, duration))
+}
+
+func (h *terminalHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("Enrollment at keyshare server of %s is incomplete", manager))
+}
+
+func (h *terminalHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("Not enrolled at keyshare server of %s", manager))
+}
+
+func (h *terminalHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName string, callback irmaclient.PermissionHandler) {
+	fmt.Printf("%s wants to issue:\n", ServerName)
+	for _, info := range request.CredentialInfoList {
+		fmt.Println(" ", info.CredentialTypeID)
+		credtype := h.client.Configuration.CredentialTypes[irma.NewCredentialTypeIdentifier(info.CredentialTypeID)]
+		for i, attr := range info.Attributes {
+			fmt.Printf("    %s: %s\n", attributeName(credtype, i), attr["en"])
+		}
+	}
+	h.askPermission(request.Candidates, request.Disclose, callback)
+}
+
+func (h *terminalHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName string, callback irmaclient.PermissionHandler) {
+	fmt.Printf("%s wants you to disclose attributes\n", ServerName)
+	printFollowUp(request.Next)
+	h.askPermission(request.Candidates, request.Content, callback)
+}
+
+func (h *terminalHandler) RequestSignaturePermission(request irma.SignatureRequest, ServerName string, callback irmaclient.PermissionHandler) {
+	fmt.Printf("%s wants you to sign the following message (%s):\n", ServerName, request.MessageType)
+	fmt.Println(request.Message)
+	printFollowUp(request.Next)
+	h.askPermission(request.Candidates, request.Content, callback)
+}
+
+func (h *terminalHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	fmt.Printf("Install scheme manager %s (%s) from %s?\n", manager.Name["en"], manager.ID, manager.URL)
+	callback(h.confirm("Install"))
+}
+
+func (h *terminalHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	// Only use the PIN from the command line on the first attempt, so that we don't
+	// get ourselves blocked by trying an incorrect PIN repeatedly
+	if h.pin != "" {
+		if remainingAttempts != -1 {
+			fmt.Printf("Incorrect PIN, %d attempts remaining\n", remainingAttempts)
+			callback(false, "")
+			return
+		}
+		callback(true, h.pin)
+		return
+	}
+
+	if remainingAttempts != -1 {
+		fmt.Printf("Incorrect PIN, %d attempts remaining\n", remainingAttempts)
+	}
+	pin, err := promptPin(h.in, "PIN (empty to cancel): ")
+	if err != nil || pin == "" {
+		callback(false, "")
+		return
+	}
+	callback(true, pin)
+}
+
+// printFollowUp prints the issuance session announced by the server as a follow-up to the
+// current session, which is approved along with it.
+func printFollowUp(next *irma.IssuanceRequest) {
+	if next == nil {
+		return
+	}
+	fmt.Println("Afterwards, it will issue:")
+	for _, cred := range next.Credentials {
+		fmt.Println(" ", cred.CredentialTypeID)
+		names := make([]string, 0, len(cred.Attributes))
+		for name := range cred.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("    %s: %s\n", name, cred.Attributes[name])
+		}
+	}
+}
+
+// askPermission lets the user choose an attribute for each disjunction, and asks for
+// permission to disclose them.
+func (h *terminalHandler) askPermission(
+	candidates [][]*irma.AttributeIdentifier,
+	disjunctions irma.AttributeDisjunctionList,
+	callback irmaclient.PermissionHandler,
+) {
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+	for i, disjunction := range disjunctions {
+		if i >= len(candidates) || len(candidates[i]) == 0 {
+			callback(false, nil)
+			return
+		}
+		attr, ok := h.choose(disjunction, candidates[i])
+		if !ok {
+			callback(false, nil)
+			return
+		}
+		choice.Attributes = append(choice.Attributes, attr)
+	}
+
+	if len(choice.Attributes) > 0 {
+		fmt.Println("Disclosing:")
+		for _, attr := range choice.Attributes {
+			fmt.Printf("  %s: %s\n", attr.Type, h.attributeValue(attr))
+		}
+	}
+	if !h.confirm("Proceed") {
+		callback(false, nil)
+		return
+	}
+	callback(true, choice)
+}
+
+func (h *terminalHandler) choose(disjunction *irma.AttributeDisjunction, candidates []*irma.AttributeIdentifier) (*irma.AttributeIdentifier, bool) {
+	if h.yes || len(candidates) == 1 {
+		return candidates[0], true
+	}
+
+	fmt.Printf("Choose an attribute for '%s':\n", disjunction.Label)
+	for i, candidate := range candidates {
+		fmt.Printf("  %d) %s: %s\n", i+1, candidate.Type, h.attributeValue(candidate))
+	}
+	for {
+		answer, err := prompt(h.in, "Choice (empty to cancel): ")
+		if err != nil || answer == "" {
+			return nil, false
+		}
+		i, err := strconv.Atoi(answer)
+		if err == nil && i >= 1 && i <= len(candidates) {
+			return candidates[i-1], true
+		}
+		fmt.Println("Invalid choice")
+	}
+}
+
+func (h *terminalHandler) confirm(question string) bool {
+	if h.yes {
+		return true
+	}
+	answer, err := prompt(h.in, question+"? [y/N] ")
+	return err == nil && (answer == "y" || answer == "Y" || answer == "yes")
+}
+
+// attributeValue returns the (English) value of the specified attribute instance.
+func (h *terminalHandler) attributeValue(id *irma.AttributeIdentifier) string {
+	if id.Type.IsCredential() {
+		return "(presence of credential)"
+	}
+	credtype := h.client.Configuration.CredentialTypes[id.Type.CredentialTypeIdentifier()]
+	if credtype == nil {
+		return ""
+	}
+	index, err := credtype.IndexOf(id.Type)
+	if err != nil {
+		return ""
+	}
+	for _, info := range h.client.CredentialInfoList() {
+		if info.Hash == id.CredentialHash && index < len(info.Attributes) {
+			return info.Attributes[index]["en"]
+		}
+	}
+	return ""
+}
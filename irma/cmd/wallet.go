@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+// walletCmd represents the wallet command
+var walletCmd = &cobra.Command{
+	Use:   "wallet",
+	Short: "Headless IRMA wallet",
+	Long: `The wallet command and its subcommands use an IRMA client storage directory from the terminal: listing credentials and logs, performing IRMA sessions, and managing keyshare enrollments.
+
+The storage directory is created if it does not exist. The irma_configuration folder specified with --irmaconf is copied into it on first use.`,
+}
+
+func init() {
+	RootCmd.AddCommand(walletCmd)
+	walletCmd.PersistentFlags().StringP("storage", "s", "", "path to client storage directory (required)")
+	walletCmd.PersistentFlags().StringP("irmaconf", "i", "irma_configuration", "path to irma_configuration folder")
+}
+
+// clientHandler implements irmaclient.ClientHandler, printing updates and passing
+// the result of keyshare enrollments on to whoever is waiting for them.
+type clientHandler struct {
+	enrollment chan error
+}
+
+func newClientHandler() *clientHandler {
+	return &clientHandler{enrollment: make(chan error, 1)}
+}
+
+func (h *clientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {
+	for id := range new.SchemeManagers {
+		fmt.Println("Installed or updated scheme manager", id)
+	}
+	for id := range new.Issuers {
+		fmt.Println("Downloaded issuer", id)
+	}
+	for id := range new.CredentialTypes {
+		fmt.Println("Downloaded credential type", id)
+	}
+}
+
+func (h *clientHandler) UpdateAttributes() {}
+
+func (h *clientHandler) EnrollmentError(manager irma.SchemeManagerIdentifier, err error) {
+	h.enrollment <- errors.Errorf("Enrollment at keyshare server of %s failed: %s", manager, err.Error())
+}
+
+func (h *clientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
+	h.enrollment <- nil
+}
+
+// openClient opens the client storage specified by the command's flags.
+func openClient(cmd *cobra.Command, handler *clientHandler) (*irmaclient.Client, error) {
+	storage, err := cmd.Flags().GetString("storage")
+	if err != nil {
+		return nil, err
+	}
+	irmaconf, err := cmd.Flags().GetString("irmaconf")
+	if err != nil {
+		return nil, err
+	}
+	if storage == "" {
+		return nil, errors.New("No storage directory specified (use --storage)")
+	}
+	if err = fs.EnsureDirectoryExists(storage); err != nil {
+		return nil, err
+	}
+
+	client, err := irmaclient.New(storage, irmaconf, "", handler)
+	if err != nil {
+		// Scheme managers that failed to parse are disabled, but the client is still usable
+		if _, ok := err.(*irma.SchemeManagerError); !ok {
+			return nil, err
+		}
+		fmt.Println("Warning:", err.Error())
+	}
+	return client, nil
+}
+
+// prompt prints the question and returns the trimmed line entered by the user.
+func prompt(in *bufio.Reader, question string) (string, error) {
+	fmt.Print(question)
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// promptPin is like prompt, but does not echo the PIN entered by the user if stdin is a terminal.
+func promptPin(in *bufio.Reader, question string) (string, error) {
+	if stty("-echo") == nil {
+		defer func() {
+			_ = stty("echo")
+			fmt.Println() // The newline entered by the user was not echoed either
+		}()
+	}
+	return prompt(in, question)
+}
+
+// stty sets terminal options of stdin. It fails if stdin is not a terminal, or if there is no
+// stty command, e.g. on Windows.
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+func newStdinReader() *bufio.Reader {
+	return bufio.NewReader(os.Stdin)
+}
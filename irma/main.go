@@ -0,0 +1,7 @@
+package main
+
+import "github.com/privacybydesign/irmago/irma/cmd"
+
+func main() {
+	cmd.Execute()
+}
@@ -0,0 +1,320 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the export and import of encrypted backups of the wallet.
+//
+// A backup contains everything needed to restore the wallet on another device: the secret key,
+// the attributes and signatures of all credentials, the keyshare server enrollments, the logs
+// and the preferences. It is serialized to JSON and encrypted and authenticated in the same
+// format as the files of an encrypted storage (see encryption.go), under a key that the app
+// supplies.
+
+// backupVersion is the version of the backup format written by ExportBackup.
+const backupVersion = 1
+
+// backupFile is the name under which backups are encrypted, authenticated as associated data
+// so that storage files and backups encrypted under the same key cannot be confused.
+const backupFile = "backup"
+
+type backup struct {
+	Version         int
+	Created         irma.Timestamp
+	SecretKey       *SecretKey
+	Attributes      []*irma.AttributeList
+	Signatures      map[string]*gabi.CLSignature // Keyed by the hash of the attributes
+	KeyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer
+	Logs            []*LogEntry
+	Preferences     Preferences
+}
+
+// BackupConflictError is returned by ImportBackup if the backup cannot be imported into
+// the wallet without overwriting its contents.
+type BackupConflictError struct {
+	Conflicts []string
+}
+
+func (e *BackupConflictError) Error() string {
+	return "Backup conflicts with wallet contents: " + strings.Join(e.Conflicts, "; ")
+}
+
+// ExportBackup writes an encrypted backup of the wallet to w, under the specified key
+// of StorageKeyLength bytes. The backup can be restored with ImportBackup using the same key.
+func (client *Client) ExportBackup(w io.Writer, key []byte) error {
+	if len(key) != StorageKeyLength {
+		return errors.Errorf("Backup key must be %d bytes", StorageKeyLength)
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	logs, err := client.logs()
+	if err != nil {
+		return err
+	}
+	b := &backup{
+		Version:         backupVersion,
+		Created:         irma.Timestamp(time.Now()),
+		SecretKey:       client.secretkey,
+		Attributes:      []*irma.AttributeList{},
+		Signatures:      map[string]*gabi.CLSignature{},
+		KeyshareServers: client.keyshareServers,
+		Logs:            logs,
+		Preferences:     client.Preferences,
+	}
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			sig, err := client.storage.LoadSignature(attrs)
+			if err != nil {
+				return err
+			}
+			if sig == nil {
+				return errors.Errorf("Signature of credential %s not found", attrs.Hash())
+			}
+			b.Attributes = append(b.Attributes, attrs)
+			b.Signatures[attrs.Hash()] = sig
+		}
+	}
+
+	bts, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if bts, err = encryptStorageFile(key, backupFile, bts); err != nil {
+		return err
+	}
+	_, err = w.Write(bts)
+	return err
+}
+
+// ImportBackup restores the wallet from an encrypted backup written by ExportBackup, after
+// checking its integrity. If the wallet is not empty, the backup is merged into it, provided
+// that it uses the same secret key and keyshare enrollments as the wallet; otherwise a
+// *BackupConflictError listing the conflicts is returned and nothing is changed.
+// If overwrite is true, the contents of the wallet are instead replaced by those of the backup.
+// Backups containing credentials whose signature cannot be verified, because their type or
+// issuer public key is unknown, are refused. The backup is saved all at once (see journal.go),
+// so if we are interrupted, the import is finished by New().
+func (client *Client) ImportBackup(r io.Reader, key []byte, overwrite bool) error {
+	if len(key) != StorageKeyLength {
+		return errors.Errorf("Backup key must be %d bytes", StorageKeyLength)
+	}
+	bts, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !isEncrypted(bts) {
+		return errors.New("Not an IRMA backup")
+	}
+	if bts, err = decryptStorageFile([][]byte{key}, backupFile, bts); err != nil {
+		return err
+	}
+	b := &backup{}
+	if err = json.Unmarshal(bts, b); err != nil {
+		return err
+	}
+	if err = client.importBackup(b, overwrite); err != nil {
+		return err
+	}
+	if client.handler != nil {
+		client.handler.UpdateAttributes()
+	}
+	return nil
+}
+
+func (client *Client) importBackup(b *backup, overwrite bool) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if err := client.verifyBackup(b); err != nil {
+		return err
+	}
+	for _, entry := range b.Logs {
+		entry.migrateDisclosed(client.Configuration)
+	}
+
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
+
+	var journal *IssuanceJournal
+	if overwrite || client.empty() {
+		journal = client.restoreJournal(b)
+	} else {
+		if conflicts := client.backupConflicts(b); len(conflicts) > 0 {
+			return &BackupConflictError{Conflicts: conflicts}
+		}
+		journal = client.mergeJournal(b)
+	}
+
+	// As with new credentials, save all changes at once (see journal.go)
+	if err := client.storage.StoreIssuanceJournal(journal); err != nil {
+		return err
+	}
+	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	client.credentials = map[irma.CredentialTypeIdentifier]map[int]*credential{}
+	for _, attrs := range journal.Attributes {
+		var id irma.CredentialTypeIdentifier
+		if attrs.CredentialType() != nil {
+			id = attrs.CredentialType().Identifier()
+		}
+		client.attributes[id] = append(client.attributes[id], attrs)
+	}
+	if journal.SecretKey != nil {
+		client.secretkey = journal.SecretKey
+	}
+	client.keyshareServers = journal.KeyshareServers
+	client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
+	if journal.Preferences != nil {
+		client.Preferences = *journal.Preferences
+		client.applyPreferences()
+	}
+	client.journal = journal
+	return client.finishJournal()
+}
+
+// verifyBackup checks that the backup is complete and that the signatures of its credentials are valid.
+func (client *Client) verifyBackup(b *backup) error {
+	if b.Version < 1 || b.Version > backupVersion {
+		return errors.Errorf("Unsupported backup version %d", b.Version)
+	}
+	if b.SecretKey == nil || b.SecretKey.Key == nil {
+		return errors.New("Backup contains no secret key")
+	}
+	for _, attrs := range b.Attributes {
+		if len(attrs.Ints) == 0 {
+			return errors.New("Backup contains a credential without attributes")
+		}
+		sig, ok := b.Signatures[attrs.Hash()]
+		if !ok || sig == nil {
+			return errors.Errorf("Backup contains no signature for credential %s", attrs.Hash())
+		}
+		attrs.MetadataAttribute = irma.MetadataFromInt(attrs.Ints[0], client.Configuration)
+		if attrs.CredentialType() == nil {
+			return errors.Errorf("Backup contains credential %s of unknown type, whose signature cannot be verified", attrs.Hash())
+		}
+		pk, err := attrs.PublicKey()
+		if err != nil {
+			return err
+		}
+		if pk == nil {
+			return errors.Errorf("Backup contains credential %s whose issuer public key is unknown, so that its signature cannot be verified", attrs.Hash())
+		}
+		if !sig.Verify(pk, append([]*big.Int{b.SecretKey.Key}, attrs.Ints...)) {
+			return errors.Errorf("Backup contains an invalid signature for credential %s", attrs.Hash())
+		}
+	}
+	return nil
+}
+
+// empty returns whether the wallet contains no credentials and no keyshare enrollments.
+func (client *Client) empty() bool {
+	for _, attrlistlist := range client.attributes {
+		if len(attrlistlist) > 0 {
+			return false
+		}
+	}
+	return len(client.keyshareServers) == 0
+}
+
+// backupConflicts returns the reasons why the backup cannot be merged into the wallet, if any.
+func (client *Client) backupConflicts(b *backup) []string {
+	var conflicts []string
+	if client.secretkey.Key.Cmp(b.SecretKey.Key) != 0 {
+		conflicts = append(conflicts, "the wallet and the backup have different secret keys")
+	}
+	for id, kss := range b.KeyshareServers {
+		if current, ok := client.keyshareServers[id]; ok && current.Username != kss.Username {
+			conflicts = append(conflicts, fmt.Sprintf(
+				"the wallet is enrolled at the keyshare server of %s as %s, the backup as %s",
+				id, current.Username, kss.Username,
+			))
+		}
+	}
+	// As in addCredential, we keep at most one credential of singleton credential types
+	present := map[string]bool{}
+	for _, attrs := range client.attributeLists() {
+		present[attrs.Hash()] = true
+	}
+	for _, attrs := range b.Attributes {
+		credtype := attrs.CredentialType()
+		if present[attrs.Hash()] || credtype == nil || !credtype.IsSingleton {
+			continue
+		}
+		if len(client.attrs(credtype.Identifier())) > 0 {
+			conflicts = append(conflicts, fmt.Sprintf(
+				"the wallet and the backup contain different credentials of singleton credential type %s",
+				credtype.Identifier(),
+			))
+		}
+	}
+	return conflicts
+}
+
+// restoreJournal returns the journal that replaces the contents of the wallet with those of the backup.
+func (client *Client) restoreJournal(b *backup) *IssuanceJournal {
+	journal := &IssuanceJournal{
+		Attributes:      b.Attributes,
+		Signatures:      b.Signatures,
+		SecretKey:       b.SecretKey,
+		KeyshareServers: b.KeyshareServers,
+		Preferences:     &b.Preferences,
+		Logs:            b.Logs,
+		ReplaceLogs:     true,
+	}
+	if journal.KeyshareServers == nil {
+		journal.KeyshareServers = map[irma.SchemeManagerIdentifier]*KeyshareServer{}
+	}
+	restored := map[string]bool{}
+	for _, attrs := range b.Attributes {
+		restored[attrs.Hash()] = true
+	}
+	for _, attrs := range client.attributeLists() {
+		if !restored[attrs.Hash()] {
+			journal.Removed = append(journal.Removed, attrs)
+		}
+	}
+	return journal
+}
+
+// mergeJournal returns the journal that adds the credentials, keyshare enrollments and logs
+// of the backup that the wallet does not yet have.
+func (client *Client) mergeJournal(b *backup) *IssuanceJournal {
+	journal := &IssuanceJournal{
+		Attributes:      client.attributeLists(),
+		Signatures:      map[string]*gabi.CLSignature{},
+		KeyshareServers: map[irma.SchemeManagerIdentifier]*KeyshareServer{},
+		Logs:            b.Logs,
+	}
+	for id, kss := range client.keyshareServers {
+		journal.KeyshareServers[id] = kss
+	}
+	present := map[string]bool{}
+	for _, attrs := range journal.Attributes {
+		present[attrs.Hash()] = true
+	}
+	for _, attrs := range b.Attributes {
+		if present[attrs.Hash()] {
+			continue
+		}
+		journal.Attributes = append(journal.Attributes, attrs)
+		journal.Signatures[attrs.Hash()] = b.Signatures[attrs.Hash()]
+	}
+	for id, kss := range b.KeyshareServers {
+		if _, ok := journal.KeyshareServers[id]; !ok {
+			journal.KeyshareServers[id] = kss
+		}
+	}
+	return journal
+}
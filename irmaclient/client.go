@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"math/big"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/credentials/go-go-gadget-paillier"
@@ -37,19 +38,24 @@ import (
 // - The secret key (the zeroth attribute of every credential), being the same
 // across all credentials, is stored only once in a separate file (storing this
 // in multiple places would be bad).
+//
+// A Client is safe for concurrent use, e.g. by several sessions at once: its methods
+// acquire the lock of the client before accessing its credentials, keyshare servers,
+// Paillier key, Configuration and storage. Unexported methods expect the caller to hold the lock
+// unless stated otherwise. Callbacks to the ClientHandler and session Handlers are made
+// without holding the lock, so that they may call methods of the Client.
 
 type Client struct {
 	// Stuff we manage on disk
-	secretkey        *secretKey
+	secretkey        *SecretKey
 	attributes       map[irma.CredentialTypeIdentifier][]*irma.AttributeList
 	credentials      map[irma.CredentialTypeIdentifier]map[int]*credential
-	keyshareServers  map[irma.SchemeManagerIdentifier]*keyshareServer
-	paillierKeyCache *paillierPrivateKey
-	logs             []*LogEntry
-	updates          []update
+	keyshareServers  map[irma.SchemeManagerIdentifier]*KeyshareServer
+	paillierKeyCache *PaillierPrivateKey
+	updates          []Update
 
 	// Where we store/load it to/from
-	storage storage
+	storage Storage
 
 	// Other state
 	Preferences              Preferences
@@ -58,7 +64,11 @@ type Client struct {
 	irmaConfigurationPath    string
 	androidStoragePath       string
 	handler                  ClientHandler
-	state                    *issuanceState
+	logStats                 *logStats        // Statistics of the log entries, nil if not (yet) known
+	journal                  *IssuanceJournal // Stored journal that we did not manage to perform, see finishJournal()
+	liveCheckpoints          map[string]bool  // IDs of the checkpoints of sessions running in this process
+
+	lock sync.Mutex // Guards the stuff we manage on disk, the storage, and the exported fields when modifying them
 }
 
 // SentryDSN should be set in the init() function
@@ -67,6 +77,14 @@ var SentryDSN = ""
 
 type Preferences struct {
 	EnableCrashReporting bool
+
+	// Log entries older than this many days are deleted; 0 means they are kept indefinitely
+	LogRetentionDays int
+	// Only this many of the most recent log entries are kept; 0 means no limit
+	LogRetentionEntries int
+
+	// Rules applied to disclosure requests, see policies.go
+	DisclosurePolicies []*DisclosurePolicy `json:",omitempty"`
 }
 
 var defaultPreferences = Preferences{
@@ -89,7 +107,8 @@ type ClientHandler interface {
 	UpdateAttributes()
 }
 
-type secretKey struct {
+// SecretKey is the secret key of the user, which is the first attribute of all credentials.
+type SecretKey struct {
 	Key *big.Int
 }
 
@@ -110,6 +129,19 @@ func New(
 	irmaConfigurationPath string,
 	androidStoragePath string,
 	handler ClientHandler,
+) (*Client, error) {
+	return NewWithStorage(storagePath, irmaConfigurationPath, androidStoragePath, handler, NewFileStorage(storagePath))
+}
+
+// NewWithStorage is like New, but (de)serializes the client to and from the specified Storage
+// instead of to and from files in storagePath. The directory at storagePath is then used only
+// for the client's copy of irma_configuration.
+func NewWithStorage(
+	storagePath string,
+	irmaConfigurationPath string,
+	androidStoragePath string,
+	handler ClientHandler,
+	storage Storage,
 ) (*Client, error) {
 	var err error
 	if err = fs.AssertPathExists(storagePath); err != nil {
@@ -121,11 +153,12 @@ func New(
 
 	cm := &Client{
 		credentials:           make(map[irma.CredentialTypeIdentifier]map[int]*credential),
-		keyshareServers:       make(map[irma.SchemeManagerIdentifier]*keyshareServer),
+		keyshareServers:       make(map[irma.SchemeManagerIdentifier]*KeyshareServer),
 		attributes:            make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
 		irmaConfigurationPath: irmaConfigurationPath,
 		androidStoragePath:    androidStoragePath,
 		handler:               handler,
+		liveCheckpoints:       make(map[string]bool),
 	}
 
 	cm.Configuration, err = irma.NewConfiguration(storagePath+"/irma_configuration", irmaConfigurationPath)
@@ -141,12 +174,17 @@ func New(
 		return nil, schemeMgrErr
 	}
 
-	// Ensure storage path exists, and populate it with necessary files
-	cm.storage = storage{storagePath: storagePath, Configuration: cm.Configuration}
+	// Ensure storage exists, and populate it with necessary files
+	cm.storage = storage
 	if err = cm.storage.EnsureStorageExists(); err != nil {
 		return nil, err
 	}
 
+	// Finish saving the credentials of an issuance session or backup that we were interrupted in
+	if err = cm.recoverIssuance(); err != nil {
+		return nil, err
+	}
+
 	if cm.Preferences, err = cm.storage.LoadPreferences(); err != nil {
 		return nil, err
 	}
@@ -157,11 +195,25 @@ func New(
 		return nil, err
 	}
 
+	// Finish an interrupted RotateStorageKey(), or encrypt a plaintext storage whose updates
+	// had already been performed when the app first supplied a storage key
+	if err = cm.finishStorageRotation(); err != nil {
+		return nil, err
+	}
+
 	// Load our stuff
 	if cm.secretkey, err = cm.storage.LoadSecretKey(); err != nil {
 		return nil, err
 	}
-	if cm.attributes, err = cm.storage.LoadAttributes(); err != nil {
+	if cm.secretkey == nil {
+		if cm.secretkey, err = generateSecretKey(); err != nil {
+			return nil, err
+		}
+		if err = cm.storage.StoreSecretKey(cm.secretkey); err != nil {
+			return nil, err
+		}
+	}
+	if err = cm.loadAttributes(); err != nil {
 		return nil, err
 	}
 	if cm.keyshareServers, err = cm.storage.LoadKeyshareServers(); err != nil {
@@ -170,8 +222,12 @@ func New(
 	if cm.paillierKeyCache, err = cm.storage.LoadPaillierKeys(); err != nil {
 		return nil, err
 	}
-	if cm.paillierKeyCache == nil {
-		cm.paillierKey(false)
+
+	if err = cm.applyLogRetention(); err != nil {
+		return nil, err
+	}
+	if err = cm.removeExpiredCheckpoints(); err != nil {
+		return nil, err
 	}
 
 	cm.UnenrolledSchemeManagers = cm.unenrolledSchemeManagers()
@@ -179,11 +235,20 @@ func New(
 		return nil, errors.New("Too many keyshare servers")
 	}
 
+	// Generate a Paillier key in the background, if necessary. From here on the client
+	// may be accessed concurrently.
+	if cm.paillierKeyCache == nil {
+		cm.paillierKey(false)
+	}
+
 	return cm, schemeMgrErr
 }
 
 // CredentialInfoList returns a list of information of all contained credentials.
 func (client *Client) CredentialInfoList() irma.CredentialInfoList {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
 
 	for _, attrlistlist := range client.attributes {
@@ -201,9 +266,11 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	return list
 }
 
-// addCredential adds the specified credential to the Client, saving its signature
-// imediately, and optionally cm.attributes as well.
-func (client *Client) addCredential(cred *credential, storeAttributes bool) (err error) {
+// addCredential adds the specified credential to the Client, unless we already have it,
+// replacing the previous instance if its credential type is a singleton. Nothing is saved to
+// storage (see commitCredentials): it returns whether the credential was added, and the
+// attributes of the credential it replaced, if any.
+func (client *Client) addCredential(cred *credential) (added bool, replaced *irma.AttributeList) {
 	id := irma.NewCredentialTypeIdentifier("")
 	if cred.CredentialType() != nil {
 		id = cred.CredentialType().Identifier()
@@ -213,14 +280,17 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 	for _, attrlistlist := range client.attributes {
 		for _, attrs := range attrlistlist {
 			if attrs.Hash() == cred.AttributeList().Hash() {
-				return nil
+				return false, nil
 			}
 		}
 	}
 
 	// If this is a singleton credential type, ensure we have at most one by removing any previous instance
-	if !id.Empty() && cred.CredentialType().IsSingleton && len(client.creds(id)) > 0 {
-		client.remove(id, 0, false) // Index is 0, because if we're here we have exactly one
+	if !id.Empty() && cred.CredentialType().IsSingleton && len(client.attrs(id)) > 0 {
+		// Index is 0, because if we're here we have exactly one
+		replaced = client.attributes[id][0]
+		client.attributes[id] = client.attributes[id][1:]
+		delete(client.creds(id), 0)
 	}
 
 	// Append the new cred to our attributes and credentials
@@ -233,21 +303,52 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 		client.credentials[id][counter] = cred
 	}
 
-	if err = client.storage.StoreSignature(cred); err != nil {
-		return
+	return true, replaced
+}
+
+// loadAttributes loads the attributes of all credentials from storage,
+// grouping them by credential type.
+func (client *Client) loadAttributes() error {
+	list, err := client.storage.LoadAttributes()
+	if err != nil {
+		return err
+	}
+	client.attributes = make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList)
+	for _, attrlist := range list {
+		attrlist.MetadataAttribute = irma.MetadataFromInt(attrlist.Ints[0], client.Configuration)
+		id := attrlist.CredentialType()
+		var ct irma.CredentialTypeIdentifier
+		if id != nil {
+			ct = id.Identifier()
+		}
+		client.attributes[ct] = append(client.attributes[ct], attrlist)
 	}
-	if storeAttributes {
-		err = client.storage.StoreAttributes(client.attributes)
+	return nil
+}
+
+// storeAttributes saves the attributes of all credentials to storage.
+func (client *Client) storeAttributes() error {
+	if err := client.finishJournal(); err != nil {
+		return err
 	}
-	return
+	return client.storage.StoreAttributes(client.attributeLists())
 }
 
-func generateSecretKey() (*secretKey, error) {
+// attributeLists returns the attributes of all credentials.
+func (client *Client) attributeLists() []*irma.AttributeList {
+	list := []*irma.AttributeList{}
+	for _, attrlistlist := range client.attributes {
+		list = append(list, attrlistlist...)
+	}
+	return list
+}
+
+func generateSecretKey() (*SecretKey, error) {
 	key, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[1024].Lm)
 	if err != nil {
 		return nil, err
 	}
-	return &secretKey{Key: key}, nil
+	return &SecretKey{Key: key}, nil
 }
 
 // Removal methods
@@ -261,7 +362,7 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 	attrs := list[index]
 	client.attributes[id] = append(list[:index], list[index+1:]...)
 	if storenow {
-		if err := client.storage.StoreAttributes(client.attributes); err != nil {
+		if err := client.storeAttributes(); err != nil {
 			return err
 		}
 	}
@@ -275,6 +376,9 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 	}
 
 	// Remove signature from storage
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
 	if err := client.storage.DeleteSignature(attrs); err != nil {
 		return err
 	}
@@ -294,20 +398,34 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 
 // RemoveCredential removes the specified credential.
 func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index int) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	return client.remove(id, index, true)
 }
 
 // RemoveCredentialByHash removes the specified credential.
 func (client *Client) RemoveCredentialByHash(hash string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	cred, index, err := client.credentialByHash(hash)
 	if err != nil {
 		return err
 	}
-	return client.RemoveCredential(cred.CredentialType().Identifier(), index)
+	if cred == nil {
+		return errors.Errorf("Can't remove credential %s: no such credential", hash)
+	}
+	return client.remove(cred.CredentialType().Identifier(), index, true)
 }
 
 // RemoveAllCredentials removes all credentials.
 func (client *Client) RemoveAllCredentials() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
 	for _, attrlistlist := range client.attributes {
 		for _, attrs := range attrlistlist {
@@ -318,7 +436,7 @@ func (client *Client) RemoveAllCredentials() error {
 		}
 	}
 	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
-	if err := client.storage.StoreAttributes(client.attributes); err != nil {
+	if err := client.storeAttributes(); err != nil {
 		return err
 	}
 
@@ -327,10 +445,7 @@ func (client *Client) RemoveAllCredentials() error {
 		Time:    irma.Timestamp(time.Now()),
 		Removed: removed,
 	}
-	if err := client.addLogEntry(logentry); err != nil {
-		return err
-	}
-	return client.storage.StoreLogs(client.logs)
+	return client.addLogEntry(logentry)
 }
 
 // Attribute and credential getter methods
@@ -356,7 +471,13 @@ func (client *Client) creds(id irma.CredentialTypeIdentifier) map[int]*credentia
 }
 
 // Attributes returns the attribute list of the requested credential, or nil if we do not have it.
-func (client *Client) Attributes(id irma.CredentialTypeIdentifier, counter int) (attributes *irma.AttributeList) {
+func (client *Client) Attributes(id irma.CredentialTypeIdentifier, counter int) *irma.AttributeList {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.attributeList(id, counter)
+}
+
+func (client *Client) attributeList(id irma.CredentialTypeIdentifier, counter int) (attributes *irma.AttributeList) {
 	list := client.attrs(id)
 	if len(list) <= counter {
 		return
@@ -394,7 +515,7 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 	// deserialized during New(). If so, there should be a corresponding signature file,
 	// so we read that, construct the credential, and add it to the credential map
 	if _, exists := client.creds(id)[counter]; !exists {
-		attrs := client.Attributes(id, counter)
+		attrs := client.attributeList(id, counter)
 		if attrs == nil { // We do not have the requested cred
 			return
 		}
@@ -432,6 +553,12 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 // Candidates returns a list of attributes present in this client
 // that satisfy the specified attribute disjunction.
 func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.candidates(disjunction)
+}
+
+func (client *Client) candidates(disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
 	candidates := make([]*irma.AttributeIdentifier, 0, 10)
 
 	for _, attribute := range disjunction.Attributes {
@@ -469,11 +596,14 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 func (client *Client) CheckSatisfiability(
 	disjunctions irma.AttributeDisjunctionList,
 ) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	candidates := [][]*irma.AttributeIdentifier{}
 	missing := irma.AttributeDisjunctionList{}
 	for i, disjunction := range disjunctions {
 		candidates = append(candidates, []*irma.AttributeIdentifier{})
-		candidates[i] = client.Candidates(disjunction)
+		candidates[i] = client.candidates(disjunction)
 		if len(candidates[i]) == 0 {
 			missing = append(missing, disjunction)
 		}
@@ -515,15 +645,39 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (map[irma.
 	return grouped, nil
 }
 
+// disclosedCredentials returns the credentials from which the choice discloses attributes, in
+// the order in which they first occur in the choice. The disclosure proofs are in this order.
+func disclosedCredentials(choice *irma.DisclosureChoice) []irma.CredentialIdentifier {
+	var creds []irma.CredentialIdentifier
+	seen := map[irma.CredentialIdentifier]bool{}
+	if choice == nil {
+		return creds
+	}
+	for _, attribute := range choice.Attributes {
+		if ici := attribute.CredentialIdentifier(); !seen[ici] {
+			seen[ici] = true
+			creds = append(creds, ici)
+		}
+	}
+	return creds
+}
+
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice) (gabi.ProofBuilderList, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.proofBuilders(choice)
+}
+
+func (client *Client) proofBuilders(choice *irma.DisclosureChoice) (gabi.ProofBuilderList, error) {
 	todisclose, err := client.groupCredentials(choice)
 	if err != nil {
 		return nil, err
 	}
 
 	builders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
-	for id, list := range todisclose {
+	for _, id := range disclosedCredentials(choice) {
+		list := todisclose[id]
 		cred, err := client.credentialByID(id)
 		if err != nil {
 			return nil, err
@@ -543,18 +697,16 @@ func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.IrmaSes
 }
 
 // IssuanceProofBuilders constructs a list of proof builders in the issuance protocol
-// for the future credentials as well as possibly any disclosed attributes.
-func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest) (gabi.ProofBuilderList, error) {
-	state, err := newIssuanceState()
-	if err != nil {
-		return nil, err
-	}
-	client.state = state
+// for the future credentials as well as possibly any disclosed attributes, storing the
+// credential builders in the issuance state of the session, which is needed again by
+// ConstructCredentials.
+func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, state *IssuanceState) (gabi.ProofBuilderList, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
 
 	proofBuilders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
 	for _, futurecred := range request.Credentials {
-		var pk *gabi.PublicKey
-		pk, err = client.Configuration.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.KeyCounter)
+		pk, err := client.Configuration.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.KeyCounter)
 		if err != nil {
 			return nil, err
 		}
@@ -564,7 +716,7 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest) (gabi
 		proofBuilders = append(proofBuilders, credBuilder)
 	}
 
-	disclosures, err := client.ProofBuilders(request.Choice)
+	disclosures, err := client.proofBuilders(request.Choice)
 	if err != nil {
 		return nil, err
 	}
@@ -573,56 +725,54 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest) (gabi
 }
 
 // IssueCommitments computes issuance commitments, along with disclosure proofs
-// specified by choice.
-func (client *Client) IssueCommitments(request *irma.IssuanceRequest) (*gabi.IssueCommitmentMessage, error) {
-	proofBuilders, err := client.IssuanceProofBuilders(request)
+// specified by choice, storing the credential builders in the issuance state of the session.
+func (client *Client) IssueCommitments(request *irma.IssuanceRequest, state *IssuanceState) (*gabi.IssueCommitmentMessage, error) {
+	proofBuilders, err := client.IssuanceProofBuilders(request, state)
 	if err != nil {
 		return nil, err
 	}
 	list := proofBuilders.BuildProofList(request.GetContext(), request.GetNonce(), false)
-	return &gabi.IssueCommitmentMessage{Proofs: list, Nonce2: client.state.nonce2}, nil
+	return &gabi.IssueCommitmentMessage{Proofs: list, Nonce2: state.nonce2}, nil
 }
 
-// ConstructCredentials constructs and saves new credentials
-// using the specified issuance signature messages.
-func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest) error {
-	if len(msg) != len(client.state.builders) {
+// ConstructCredentials constructs and saves new credentials using the specified issuance
+// signature messages and the issuance state of the session.
+func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, state *IssuanceState) error {
+	if len(msg) != len(state.builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
 
 	// First collect all credentials in a slice, so that if one of them induces an error,
 	// we save none of them to fail the session cleanly
-	gabicreds := []*gabi.Credential{}
+	creds := []*credential{}
 	for i, sig := range msg {
 		attrs, err := request.Credentials[i].AttributeList(client.Configuration)
 		if err != nil {
 			return err
 		}
-		cred, err := client.state.builders[i].ConstructCredential(sig, attrs.Ints)
+		gabicred, err := state.builders[i].ConstructCredential(sig, attrs.Ints)
 		if err != nil {
 			return err
 		}
-		gabicreds = append(gabicreds, cred)
-	}
-
-	for _, gabicred := range gabicreds {
 		newcred, err := newCredential(gabicred, client.Configuration)
 		if err != nil {
 			return err
 		}
-		if err = client.addCredential(newcred, true); err != nil {
-			return err
-		}
+		creds = append(creds, newcred)
 	}
-
-	return nil
+	return client.commitCredentials(creds)
 }
 
 // Keyshare server handling
 
-// PaillierKey returns a new Paillier key (and generates a new one in a goroutine).
-func (client *Client) paillierKey(wait bool) *paillierPrivateKey {
+// paillierKey returns a new Paillier key (and generates a new one in a goroutine).
+// The caller must not hold the lock.
+func (client *Client) paillierKey(wait bool) *PaillierPrivateKey {
+	client.lock.Lock()
 	cached := client.paillierKeyCache
+	client.lock.Unlock()
 	ch := make(chan bool)
 
 	// Would just write client.paillierKeyCache instead of cached here, but the worker
@@ -632,20 +782,82 @@ func (client *Client) paillierKey(wait bool) *paillierPrivateKey {
 	if cached == nil && wait {
 		<-ch
 		// generate yet another one for future calls, but no need to wait now
+		client.lock.Lock()
+		cached = client.paillierKeyCache
+		client.lock.Unlock()
 		go client.paillierKeyWorker(false, ch)
 	}
-	return client.paillierKeyCache
+	return cached
 }
 
 func (client *Client) paillierKeyWorker(wait bool, ch chan bool) {
 	newkey, _ := paillier.GenerateKey(rand.Reader, 2048)
-	client.paillierKeyCache = (*paillierPrivateKey)(newkey)
+	client.lock.Lock()
+	client.paillierKeyCache = (*PaillierPrivateKey)(newkey)
 	client.storage.StorePaillierKeys(client.paillierKeyCache)
+	client.lock.Unlock()
 	if wait {
 		ch <- true
 	}
 }
 
+// keyshareServersCopy returns a copy of the map of keyshare servers,
+// for use by a session without holding the lock.
+func (client *Client) keyshareServersCopy() map[irma.SchemeManagerIdentifier]*KeyshareServer {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	ksses := make(map[irma.SchemeManagerIdentifier]*KeyshareServer, len(client.keyshareServers))
+	for id, kss := range client.keyshareServers {
+		ksses[id] = kss
+	}
+	return ksses
+}
+
+// downloadConfiguration downloads the issuers, credential types and public keys of the set
+// that the Configuration does not yet have. This modifies the Configuration, which other
+// sessions may be using, so it acquires the lock.
+func (client *Client) downloadConfiguration(set *irma.IrmaIdentifierSet) (*irma.IrmaIdentifierSet, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.Configuration.Download(set)
+}
+
+// credentialInfos populates the CredentialInfoList of the issuance request
+// with the credentials to be issued, acquiring the lock.
+func (client *Client) credentialInfos(request *irma.IssuanceRequest) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for _, credreq := range request.Credentials {
+		info, err := credreq.Info(client.Configuration)
+		if err != nil {
+			return err
+		}
+		request.CredentialInfoList = append(request.CredentialInfoList, info)
+	}
+	return nil
+}
+
+// distributed returns whether any of the scheme managers of the identifiers uses a keyshare server,
+// acquiring the lock.
+func (client *Client) distributed(set *irma.IrmaIdentifierSet) bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return set.Distributed(client.Configuration)
+}
+
+// schemeManagersCopy returns a copy of the map of scheme managers of the Configuration,
+// for use by a session without holding the lock. As sessions may update the Configuration
+// concurrently, they do so only while holding the lock.
+func (client *Client) schemeManagersCopy() map[irma.SchemeManagerIdentifier]*irma.SchemeManager {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	managers := make(map[irma.SchemeManagerIdentifier]*irma.SchemeManager, len(client.Configuration.SchemeManagers))
+	for id, manager := range client.Configuration.SchemeManagers {
+		managers[id] = manager
+	}
+	return managers
+}
+
 func (client *Client) unenrolledSchemeManagers() []irma.SchemeManagerIdentifier {
 	list := []irma.SchemeManagerIdentifier{}
 	for name, manager := range client.Configuration.SchemeManagers {
@@ -668,7 +880,9 @@ func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email
 		}()
 
 		err := client.keyshareEnrollWorker(manager, email, pin)
+		client.lock.Lock()
 		client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
+		client.lock.Unlock()
 		if err != nil {
 			client.handler.EnrollmentError(manager, err)
 		} else {
@@ -679,7 +893,7 @@ func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email
 }
 
 func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifier, email, pin string) error {
-	manager, ok := client.Configuration.SchemeManagers[managerID]
+	manager, ok := client.schemeManagersCopy()[managerID]
 	if !ok {
 		return errors.New("Unknown scheme manager")
 	}
@@ -707,53 +921,104 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return err
 	}
 
+	client.lock.Lock()
+	defer client.lock.Unlock()
 	client.keyshareServers[managerID] = kss
-	return client.storage.StoreKeyshareServers(client.keyshareServers)
+	return client.storeKeyshareServers()
 }
 
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	if _, contains := client.keyshareServers[manager]; !contains {
 		return errors.New("Can't uninstall unknown keyshare server")
 	}
 	delete(client.keyshareServers, manager)
-	return client.storage.StoreKeyshareServers(client.keyshareServers)
+	return client.storeKeyshareServers()
 }
 
 // KeyshareRemoveAll removes all keyshare server registrations.
 func (client *Client) KeyshareRemoveAll() error {
-	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.keyshareServers = map[irma.SchemeManagerIdentifier]*KeyshareServer{}
 	client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
+	return client.storeKeyshareServers()
+}
+
+func (client *Client) storeKeyshareServers() error {
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
 
-// Add, load and store log entries
+// Add and load log entries (see also logstore.go)
 
 func (client *Client) addLogEntry(entry *LogEntry) error {
-	client.logs = append(client.logs, entry)
-	return client.storage.StoreLogs(client.logs)
+	if entry.Outcome == "" {
+		entry.Outcome = LogOutcomeSuccess
+	}
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
+	if err := client.storage.AppendLog(entry); err != nil {
+		return err
+	}
+	if client.logStats != nil {
+		client.logStats.add(entry)
+	}
+	return client.applyLogRetention()
+}
+
+// appendLog adds the entry to the logs, acquiring the lock of the client.
+func (client *Client) appendLog(entry *LogEntry) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.addLogEntry(entry)
 }
 
-// Logs returns the log entries of past events.
+// Logs returns all log entries of past events, oldest first.
+// Use QueryLogs to retrieve only some of them.
 func (client *Client) Logs() ([]*LogEntry, error) {
-	if client.logs == nil || len(client.logs) == 0 {
-		var err error
-		client.logs, err = client.storage.LoadLogs()
-		if err != nil {
-			return nil, err
-		}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if err := client.applyLogRetention(); err != nil {
+		return nil, err
 	}
-	return client.logs, nil
+	return client.logs()
+}
+
+func (client *Client) logs() ([]*LogEntry, error) {
+	logs := []*LogEntry{}
+	err := client.storage.IterateLogs(func(entry *LogEntry) bool {
+		logs = append(logs, entry)
+		return true
+	})
+	return logs, err
 }
 
 // SetCrashReportingPreference toggles whether or not crash reports should be sent to Sentry.
 // Has effect only after restarting.
 func (client *Client) SetCrashReportingPreference(enable bool) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
 	client.Preferences.EnableCrashReporting = enable
-	_ = client.storage.StorePreferences(client.Preferences)
+	_ = client.storePreferences()
 	client.applyPreferences()
 }
 
+func (client *Client) storePreferences() error {
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
+	return client.storage.StorePreferences(client.Preferences)
+}
+
 func (client *Client) applyPreferences() {
 	if client.Preferences.EnableCrashReporting {
 		raven.SetDSN(SentryDSN)
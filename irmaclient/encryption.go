@@ -0,0 +1,256 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the encryption at rest of the file-based storage.
+//
+// If the file storage has a key, each file is stored as
+//   magic (7 bytes) | version (1 byte) | key ID (8 bytes) | nonce (12 bytes) | ciphertext
+// where the ciphertext is the AES-256-GCM encryption of the JSON contents of the file,
+// authenticating the header and the name of the file as associated data (so that files
+// cannot be swapped). The key ID consists of the first 8 bytes of the SHA256 hash of the key.
+//
+// Whether files must be encrypted, and under which keys, is determined only by the keys that
+// the app supplies, never by the contents of the storage, as an attacker able to modify the
+// storage could otherwise make the client accept plaintext files. A storage that has a key
+// accepts plaintext files only if nil is among its old keys; this is used to start encrypting
+// an existing storage. When a storage is opened with old keys, all of its files are
+// reencrypted under its key (or decrypted, if it has none) before the client uses it, so
+// that an interrupted migration or RotateStorageKey() is finished by opening the storage
+// with the same keys again.
+
+var encryptionMagic = []byte("IRMAENC")
+
+const (
+	encryptionVersion      = 1
+	encryptionKeyIDLength  = 8
+	encryptionHeaderLength = 7 + 1 + encryptionKeyIDLength
+	encryptionNonceLength  = 12
+
+	// StorageKeyLength is the length in bytes of storage encryption keys.
+	StorageKeyLength = 32
+)
+
+// NewEncryptedFileStorage returns a Storage that stores JSON files in the specified directory,
+// encrypted and authenticated under the specified key of StorageKeyLength bytes. The key should
+// be supplied by the app, e.g. from the platform keystore or derived from a passphrase.
+// Files that are still encrypted under one of the oldKeys, or are still plaintext if one of
+// them is nil, are accepted, and all files are reencrypted under key when the client is
+// created. This is used to start encrypting a plaintext storage (pass nil as old key), and to
+// finish an interrupted Client.RotateStorageKey() (pass the previous key as old key). If key
+// is nil, the files are decrypted instead, finishing an interrupted RotateStorageKey(nil).
+func NewEncryptedFileStorage(storagePath string, key []byte, oldKeys ...[]byte) (Storage, error) {
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		if k != nil && len(k) != StorageKeyLength {
+			return nil, errors.Errorf("Storage key must be %d bytes", StorageKeyLength)
+		}
+	}
+	return &fileStorage{storagePath: storagePath, key: key, oldKeys: oldKeys}, nil
+}
+
+func storageKeyID(key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return hash[:encryptionKeyIDLength]
+}
+
+func isEncrypted(contents []byte) bool {
+	return bytes.HasPrefix(contents, encryptionMagic)
+}
+
+func newStorageAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptStorageFile encrypts the contents of the specified file under the specified key.
+func encryptStorageFile(key []byte, file string, plaintext []byte) ([]byte, error) {
+	aead, err := newStorageAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, encryptionMagic...), encryptionVersion), storageKeyID(key)...)
+	nonce := make([]byte, encryptionNonceLength)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(out, nonce, plaintext, append(header, file...)), nil
+}
+
+// decryptStorageFile decrypts the contents of the specified file using whichever of the keys it was encrypted with.
+func decryptStorageFile(keys [][]byte, file string, contents []byte) ([]byte, error) {
+	if len(contents) < encryptionHeaderLength+encryptionNonceLength {
+		return nil, errors.Errorf("Encrypted storage file %s is too short", file)
+	}
+	header := contents[:encryptionHeaderLength]
+	if header[len(encryptionMagic)] != encryptionVersion {
+		return nil, errors.Errorf("Encrypted storage file %s has unsupported version %d", file, header[len(encryptionMagic)])
+	}
+	keyID := header[len(encryptionMagic)+1:]
+	for _, key := range keys {
+		if !bytes.Equal(keyID, storageKeyID(key)) {
+			continue
+		}
+		aead, err := newStorageAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		nonce := contents[encryptionHeaderLength : encryptionHeaderLength+encryptionNonceLength]
+		ciphertext := contents[encryptionHeaderLength+encryptionNonceLength:]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, append(append([]byte{}, header...), file...))
+		if err != nil {
+			return nil, errors.Errorf("Storage file %s could not be decrypted: %s", file, err.Error())
+		}
+		return plaintext, nil
+	}
+	return nil, errors.Errorf("Storage file %s is encrypted with an unknown key", file)
+}
+
+// keys returns the keys with which the file storage can decrypt.
+func (s *fileStorage) keys() [][]byte {
+	var keys [][]byte
+	for _, key := range append([][]byte{s.key}, s.oldKeys...) {
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// acceptsPlaintext returns whether the file storage accepts plaintext files, which is the case
+// if it has no key, or if nil is one of its old keys.
+func (s *fileStorage) acceptsPlaintext() bool {
+	if s.key == nil {
+		return true
+	}
+	for _, key := range s.oldKeys {
+		if key == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readFile reads and if necessary decrypts the specified file.
+func (s *fileStorage) readFile(file string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(s.path(file))
+	if err != nil {
+		return nil, err
+	}
+	if isEncrypted(contents) {
+		return decryptStorageFile(s.keys(), file, contents)
+	}
+	if !s.acceptsPlaintext() {
+		return nil, errors.Errorf("Storage file %s is not encrypted", file)
+	}
+	return contents, nil
+}
+
+// writeFile writes the specified file, encrypting it if the storage has a key.
+func (s *fileStorage) writeFile(file string, contents []byte) error {
+	return s.saveFile(file, contents, s.key)
+}
+
+// saveFile writes the specified file, encrypted under the specified key if it is not nil.
+func (s *fileStorage) saveFile(file string, contents []byte, key []byte) (err error) {
+	if key != nil {
+		if contents, err = encryptStorageFile(key, file, contents); err != nil {
+			return err
+		}
+	}
+	return fs.SaveFile(s.path(file), contents)
+}
+
+// files returns the names of all files in the storage except the log entries file
+// (which is encrypted per line, see logstore.go).
+func (s *fileStorage) files() ([]string, error) {
+	var files []string
+	sigs, err := filepath.Glob(s.path(signaturesDir + "/*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range sigs {
+		files = append(files, signaturesDir+"/"+filepath.Base(sig))
+	}
+	for _, file := range []string{skFile, attributesFile, kssFile, paillierFile, logsFile, preferencesFile, sessionsFile, journalFile, updatesFile} {
+		exists, err := fs.PathExists(s.path(file))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// reencrypt rewrites all files of the storage encrypted under the specified key,
+// or in plaintext if key is nil. Afterwards, the storage accepts only files encrypted
+// under that key (or only plaintext files).
+func (s *fileStorage) reencrypt(key []byte) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	if err = s.rewriteLogs(key, nil); err != nil {
+		return err
+	}
+	for _, file := range files {
+		contents, err := s.readFile(file)
+		if err != nil {
+			return err
+		}
+		if err = s.saveFile(file, contents, key); err != nil {
+			return err
+		}
+	}
+	s.key = key
+	s.oldKeys = nil
+	return nil
+}
+
+// finishStorageRotation reencrypts all files of the storage under its key if it was opened
+// with old keys, so that afterwards only that key is accepted.
+func (client *Client) finishStorageRotation() error {
+	s, ok := client.storage.(*fileStorage)
+	if !ok || len(s.oldKeys) == 0 {
+		return nil
+	}
+	return s.reencrypt(s.key)
+}
+
+// RotateStorageKey reencrypts all contents of the storage of the client under the specified key
+// of StorageKeyLength bytes. This can also be used to start encrypting a storage that was
+// not encrypted before, or, if key is nil, to decrypt it. Only the file-based storage
+// supports encryption.
+// If this is interrupted, some of the files may still be encrypted under the old key, or still
+// be plaintext. In that case, pass the new key (which may be nil) and the old key (which is nil
+// if the storage was not encrypted) to NewEncryptedFileStorage(), after which creating the
+// client finishes the rotation.
+func (client *Client) RotateStorageKey(key []byte) error {
+	if key != nil && len(key) != StorageKeyLength {
+		return errors.Errorf("Storage key must be %d bytes", StorageKeyLength)
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	s, ok := client.storage.(*fileStorage)
+	if !ok {
+		return errors.New("Storage does not support encryption")
+	}
+	return s.reencrypt(key)
+}
@@ -0,0 +1,257 @@
+package irmaclient
+
+import (
+	"sync"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains an event-based alternative to the Handler interface. Instead of
+// implementing all callbacks of Handler, a caller may receive the events of a session from
+// a channel, replying to permission and PIN requests by calling the Reply method of the event.
+// The events are produced by an adapter implementing Handler, returned by NewEventHandler,
+// so they can be used with all functions that start or resume a session.
+
+// SessionEvent is an event in an IRMA session. It is one of the *Event types of this package.
+type SessionEvent interface {
+	sessionEvent()
+}
+
+// StatusEvent informs of a change in the status of the session.
+type StatusEvent struct {
+	Action irma.Action
+	Status irma.Status
+}
+
+// SuccessEvent is the last event of a session that succeeded.
+type SuccessEvent struct {
+	Action irma.Action
+	Result string // Only set for manual sessions
+}
+
+// CancelledEvent is the last event of a session that was cancelled.
+type CancelledEvent struct {
+	Action irma.Action
+}
+
+// FailureEvent is the last event of a session that failed.
+type FailureEvent struct {
+	Action irma.Action
+	Err    *irma.SessionError
+}
+
+// UnsatisfiableEvent is the last event of a session asking for attributes that we do not have.
+type UnsatisfiableEvent struct {
+	Action     irma.Action
+	ServerName string
+	Missing    irma.AttributeDisjunctionList
+}
+
+// KeyshareBlockedEvent informs that the user is blocked at the keyshare server, for the
+// specified duration in seconds. It is not the last event of the session: that is a
+// FailureEvent, or a CancelledEvent once the session is dismissed.
+type KeyshareBlockedEvent struct {
+	Manager  irma.SchemeManagerIdentifier
+	Duration int
+}
+
+// KeyshareEnrollmentIncompleteEvent is the last event of a session involving a keyshare server
+// at which the enrollment of the user was not finished.
+type KeyshareEnrollmentIncompleteEvent struct {
+	Manager irma.SchemeManagerIdentifier
+}
+
+// KeyshareEnrollmentMissingEvent is the last event of a session involving a keyshare server
+// at which the user is not enrolled.
+type KeyshareEnrollmentMissingEvent struct {
+	Manager irma.SchemeManagerIdentifier
+}
+
+// PermissionEvent asks the user for permission to perform the session and for the attributes
+// to disclose. Request is an *irma.IssuanceRequest, *irma.DisclosureRequest, or
+// *irma.SignatureRequest, depending on Action. Reply must be called once; further calls are ignored.
+type PermissionEvent struct {
+	Action     irma.Action
+	ServerName string
+	Request    irma.IrmaSession
+	callback   PermissionHandler
+	once       sync.Once
+}
+
+// Reply answers the permission request.
+func (event *PermissionEvent) Reply(proceed bool, choice *irma.DisclosureChoice) {
+	event.once.Do(func() {
+		event.callback(proceed, choice)
+	})
+}
+
+// SchemeManagerPermissionEvent asks the user for permission to install a scheme manager.
+// Reply must be called once; further calls are ignored.
+type SchemeManagerPermissionEvent struct {
+	Manager  *irma.SchemeManager
+	callback func(proceed bool)
+	once     sync.Once
+}
+
+// Reply answers the permission request.
+func (event *SchemeManagerPermissionEvent) Reply(proceed bool) {
+	event.once.Do(func() {
+		event.callback(proceed)
+	})
+}
+
+// PinEvent asks the user for the keyshare PIN. RemainingAttempts is -1 on the first attempt.
+// Reply must be called once; further calls are ignored.
+type PinEvent struct {
+	RemainingAttempts int
+	callback          PinHandler
+	once              sync.Once
+}
+
+// Reply answers the PIN request.
+func (event *PinEvent) Reply(proceed bool, pin string) {
+	event.once.Do(func() {
+		event.callback(proceed, pin)
+	})
+}
+
+func (*StatusEvent) sessionEvent()                       {}
+func (*SuccessEvent) sessionEvent()                      {}
+func (*CancelledEvent) sessionEvent()                    {}
+func (*FailureEvent) sessionEvent()                      {}
+func (*UnsatisfiableEvent) sessionEvent()                {}
+func (*KeyshareBlockedEvent) sessionEvent()              {}
+func (*KeyshareEnrollmentIncompleteEvent) sessionEvent() {}
+func (*KeyshareEnrollmentMissingEvent) sessionEvent()    {}
+func (*PermissionEvent) sessionEvent()                   {}
+func (*SchemeManagerPermissionEvent) sessionEvent()      {}
+func (*PinEvent) sessionEvent()                          {}
+
+// EventSession is an IRMA session whose events are received from a channel.
+type EventSession struct {
+	// Events of the session, closed after the last event
+	// (a SuccessEvent, CancelledEvent, FailureEvent, UnsatisfiableEvent, or
+	// KeyshareEnrollmentIncompleteEvent or KeyshareEnrollmentMissingEvent)
+	Events <-chan SessionEvent
+
+	dismisser SessionDismisser
+}
+
+// Dismiss cancels the session.
+func (session *EventSession) Dismiss() {
+	if session.dismisser != nil {
+		session.dismisser.Dismiss()
+	}
+}
+
+// NewEventSession starts a new interactive IRMA session, whose events are received
+// from the returned EventSession.
+func (client *Client) NewEventSession(qr *irma.Qr) *EventSession {
+	handler, events := NewEventHandler()
+	return &EventSession{Events: events, dismisser: client.NewSession(qr, handler)}
+}
+
+// NewEventHandler returns a Handler that sends the callbacks it receives as events
+// to the returned channel, which is closed after the last event of the session.
+// The channel is not buffered, but sending events never blocks the session.
+func NewEventHandler() (Handler, <-chan SessionEvent) {
+	in := make(chan SessionEvent)
+	out := make(chan SessionEvent)
+
+	// Queue events until they are received, so that the session need not wait for that
+	go func() {
+		var queue []SessionEvent
+		for in != nil || len(queue) > 0 {
+			var send chan SessionEvent
+			var next SessionEvent
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case event, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, event)
+			case send <- next:
+				queue = queue[1:]
+			}
+		}
+		close(out)
+	}()
+
+	return &eventHandler{events: in}, out
+}
+
+// eventHandler is a Handler that sends its callbacks as events to a channel.
+type eventHandler struct {
+	events chan<- SessionEvent
+	lock   sync.Mutex
+	done   bool
+}
+
+func (h *eventHandler) send(event SessionEvent, last bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.done {
+		return
+	}
+	h.events <- event
+	if last {
+		h.done = true
+		close(h.events)
+	}
+}
+
+func (h *eventHandler) StatusUpdate(action irma.Action, status irma.Status) {
+	h.send(&StatusEvent{Action: action, Status: status}, false)
+}
+
+func (h *eventHandler) Success(action irma.Action, result string) {
+	h.send(&SuccessEvent{Action: action, Result: result}, true)
+}
+
+func (h *eventHandler) Cancelled(action irma.Action) {
+	h.send(&CancelledEvent{Action: action}, true)
+}
+
+func (h *eventHandler) Failure(action irma.Action, err *irma.SessionError) {
+	h.send(&FailureEvent{Action: action, Err: err}, true)
+}
+
+func (h *eventHandler) UnsatisfiableRequest(action irma.Action, ServerName string, missing irma.AttributeDisjunctionList) {
+	h.send(&UnsatisfiableEvent{Action: action, ServerName: ServerName, Missing: missing}, true)
+}
+
+func (h *eventHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.send(&KeyshareBlockedEvent{Manager: manager, Duration: duration}, false)
+}
+
+func (h *eventHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.send(&KeyshareEnrollmentIncompleteEvent{Manager: manager}, true)
+}
+
+func (h *eventHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.send(&KeyshareEnrollmentMissingEvent{Manager: manager}, true)
+}
+
+func (h *eventHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName string, callback PermissionHandler) {
+	h.send(&PermissionEvent{Action: irma.ActionIssuing, ServerName: ServerName, Request: &request, callback: callback}, false)
+}
+
+func (h *eventHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName string, callback PermissionHandler) {
+	h.send(&PermissionEvent{Action: irma.ActionDisclosing, ServerName: ServerName, Request: &request, callback: callback}, false)
+}
+
+func (h *eventHandler) RequestSignaturePermission(request irma.SignatureRequest, ServerName string, callback PermissionHandler) {
+	h.send(&PermissionEvent{Action: irma.ActionSigning, ServerName: ServerName, Request: &request, callback: callback}, false)
+}
+
+func (h *eventHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	h.send(&SchemeManagerPermissionEvent{Manager: manager, callback: callback}, false)
+}
+
+func (h *eventHandler) RequestPin(remainingAttempts int, callback PinHandler) {
+	h.send(&PinEvent{RemainingAttempts: remainingAttempts, callback: callback}, false)
+}
@@ -0,0 +1,143 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains a read-only view on the contents of a storage folder,
+// for use by debugging tools such as irmameta.
+
+// StorageInspection contains the contents of a storage folder, as read by InspectStorage.
+type StorageInspection struct {
+	SecretKey       bool // Whether or not a secret key is present
+	PaillierKeys    bool // Whether or not Paillier keys are present
+	Credentials     []*CredentialInspection
+	KeyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServerInspection
+	Logs            []*LogEntry
+	Updates         []UpdateInspection
+}
+
+// CredentialInspection describes a credential in storage.
+type CredentialInspection struct {
+	Attributes *irma.AttributeList
+	Signature  bool   // Whether or not the signature file of this credential is present
+	KeyError   string // Why the public key of this credential is not usable, empty if it is
+}
+
+// KeyshareServerInspection describes our enrollment at a keyshare server.
+type KeyshareServerInspection struct {
+	URL      string
+	Username string
+}
+
+// UpdateInspection describes a client update that was run on the storage.
+type UpdateInspection struct {
+	When    irma.Timestamp
+	Number  int
+	Success bool
+	Error   *string
+	Warning *string
+}
+
+// InspectStorage reads the contents of the specified storage folder, without modifying it
+// and without requiring a Client. Credential types and public keys are looked up in conf.
+func InspectStorage(storagePath string, conf *irma.Configuration) (*StorageInspection, error) {
+	if err := fs.AssertPathExists(storagePath); err != nil {
+		return nil, err
+	}
+	s := &fileStorage{storagePath: storagePath}
+	inspection := &StorageInspection{
+		KeyshareServers: map[irma.SchemeManagerIdentifier]*KeyshareServerInspection{},
+	}
+
+	sk, err := s.LoadSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	inspection.SecretKey = sk != nil
+	paillier, err := s.LoadPaillierKeys()
+	if err != nil {
+		return nil, err
+	}
+	inspection.PaillierKeys = paillier != nil
+
+	attrs, err := s.LoadAttributes()
+	if err != nil {
+		return nil, err
+	}
+	for _, attrlist := range attrs {
+		attrlist.MetadataAttribute = irma.MetadataFromInt(attrlist.Ints[0], conf)
+		exists, err := fs.PathExists(s.path(s.signatureFilename(attrlist)))
+		if err != nil {
+			return nil, err
+		}
+		inspection.Credentials = append(inspection.Credentials, &CredentialInspection{
+			Attributes: attrlist,
+			Signature:  exists,
+			KeyError:   inspectPublicKey(attrlist),
+		})
+	}
+	sort.SliceStable(inspection.Credentials, func(i, j int) bool {
+		return credentialTypeName(inspection.Credentials[i].Attributes) < credentialTypeName(inspection.Credentials[j].Attributes)
+	})
+
+	ksses, err := s.LoadKeyshareServers()
+	if err != nil {
+		return nil, err
+	}
+	for id, kss := range ksses {
+		inspection.KeyshareServers[id] = &KeyshareServerInspection{URL: kss.URL, Username: kss.Username}
+	}
+
+	// Log entries that have not yet been migrated to the log entries file come first
+	if inspection.Logs, err = s.loadOldLogs(); err != nil {
+		return nil, err
+	}
+	err = s.IterateLogs(func(entry *LogEntry) bool {
+		inspection.Logs = append(inspection.Logs, entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range inspection.Logs {
+		entry.migrateDisclosed(conf)
+	}
+	updates, err := s.LoadUpdates()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range updates {
+		inspection.Updates = append(inspection.Updates, UpdateInspection(u))
+	}
+
+	return inspection, nil
+}
+
+func inspectPublicKey(attrs *irma.AttributeList) string {
+	if attrs.CredentialType() == nil {
+		return "unknown credential type"
+	}
+	pk, err := attrs.PublicKey()
+	if err != nil {
+		return err.Error()
+	}
+	if pk == nil {
+		return "public key not found"
+	}
+	if time.Unix(pk.ExpiryDate, 0).Before(time.Now()) {
+		return "public key expired"
+	}
+	return ""
+}
+
+func credentialTypeName(attrs *irma.AttributeList) string {
+	if attrs.CredentialType() == nil {
+		return ""
+	}
+	return attrs.CredentialType().Identifier().String()
+}
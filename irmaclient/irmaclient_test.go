@@ -1,10 +1,20 @@
 package irmaclient
 
 import (
+	"bytes"
+	"html"
+	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/mhe/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -79,7 +89,7 @@ func verifyCredentials(t *testing.T, client *Client) {
 	}
 }
 
-func verifyPaillierKey(t *testing.T, PrivateKey *paillierPrivateKey) {
+func verifyPaillierKey(t *testing.T, PrivateKey *PaillierPrivateKey) {
 	require.NotNil(t, PrivateKey)
 	require.NotNil(t, PrivateKey.L)
 	require.NotNil(t, PrivateKey.U)
@@ -117,6 +127,610 @@ func TestStorageDeserialization(t *testing.T) {
 	test.ClearTestStorage(t)
 }
 
+func TestMemoryStorage(t *testing.T) {
+	test.CreateTestStorage(t)
+	storage := NewMemoryStorage()
+	require.NoError(t, MigrateStorage(NewFileStorage("../testdata/teststorage"), storage))
+
+	client, err := NewWithStorage(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&IgnoringClientHandler{},
+		storage,
+	)
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+
+	// Nothing but irma_configuration should have been written to the storage path
+	exists, err := fs.PathExists("../testdata/storage/test/attrs")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Migrate back to files, and check that a client can be loaded from those
+	require.NoError(t, MigrateStorage(storage, NewFileStorage("../testdata/storage/test")))
+	client, err = New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&IgnoringClientHandler{},
+	)
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+
+	test.ClearTestStorage(t)
+}
+
+func requireStorageEncrypted(t *testing.T, path string, encrypted bool) {
+	s := &fileStorage{storagePath: path}
+	files, err := s.files()
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		bts, err := ioutil.ReadFile(s.path(file))
+		require.NoError(t, err)
+		require.Equal(t, encrypted, isEncrypted(bts), "file %s", file)
+	}
+}
+
+func newEncryptedClient(t *testing.T, key []byte, oldKeys ...[]byte) (*Client, error) {
+	storage, err := NewEncryptedFileStorage("../testdata/storage/test", key, oldKeys...)
+	require.NoError(t, err)
+	return NewWithStorage(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&IgnoringClientHandler{},
+		storage,
+	)
+}
+
+func TestStorageEncryption(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, StorageKeyLength)
+	key2 := bytes.Repeat([]byte{2}, StorageKeyLength)
+
+	// Existing plaintext storage is refused, unless the app indicates that it may still be plaintext
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
+	_, err := newEncryptedClient(t, key1)
+	require.Error(t, err)
+	client, err := newEncryptedClient(t, key1, nil)
+	require.NoError(t, err)
+	require.Len(t, client.updates, len(clientUpdates))
+	require.True(t, client.updates[len(client.updates)-1].Success)
+	requireStorageEncrypted(t, "../testdata/storage/test", true)
+	verifyClientIsUnmarshaled(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+
+	// The storage cannot be read without the key, or with another key
+	_, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.Error(t, err)
+	_, err = newEncryptedClient(t, key2)
+	require.Error(t, err)
+
+	// Rotate to a new key
+	require.NoError(t, client.RotateStorageKey(key2))
+	_, err = newEncryptedClient(t, key1)
+	require.Error(t, err)
+	client, err = newEncryptedClient(t, key2)
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+
+	// Files that are still encrypted under an old key can be read if that key is supplied
+	s := &fileStorage{storagePath: "../testdata/storage/test", key: key2}
+	attrs, err := s.readFile(attributesFile)
+	require.NoError(t, err)
+	require.NoError(t, s.saveFile(attributesFile, attrs, key1))
+	_, err = newEncryptedClient(t, key2)
+	require.Error(t, err)
+	client, err = newEncryptedClient(t, key2, key1)
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+
+	// Once encrypted, plaintext files are refused
+	require.NoError(t, fs.SaveFile("../testdata/storage/test/"+attributesFile, []byte("[]")))
+	_, err = newEncryptedClient(t, key2)
+	require.Error(t, err)
+	require.NoError(t, s.saveFile(attributesFile, attrs, key2))
+
+	// Decrypt the storage again
+	client, err = newEncryptedClient(t, key2)
+	require.NoError(t, err)
+	require.NoError(t, client.RotateStorageKey(nil))
+	requireStorageEncrypted(t, "../testdata/storage/test", false)
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+
+	// An interrupted decryption is finished by supplying the old key
+	require.NoError(t, s.saveFile(attributesFile, attrs, key2))
+	_, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.Error(t, err)
+	client, err = newEncryptedClient(t, nil, key2)
+	require.NoError(t, err)
+	requireStorageEncrypted(t, "../testdata/storage/test", false)
+	verifyClientIsUnmarshaled(t, client)
+
+	// Supplying a key to a plaintext storage whose updates have already run also encrypts it
+	client, err = newEncryptedClient(t, key1, nil)
+	require.NoError(t, err)
+	requireStorageEncrypted(t, "../testdata/storage/test", true)
+	verifyClientIsUnmarshaled(t, client)
+
+	test.ClearTestStorage(t)
+}
+
+func TestBackup(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, StorageKeyLength)
+	client := parseStorage(t)
+	require.NoError(t, client.RemoveCredential(irma.NewCredentialTypeIdentifier("test.test.mijnirma"), 0))
+	var exported bytes.Buffer
+	require.NoError(t, client.ExportBackup(&exported, key))
+	test.ClearTestStorage(t)
+
+	// Restore into a new, empty wallet (reusing the Paillier key, so that none is generated in the background)
+	test.CreateTestStorage(t)
+	require.NoError(t, fs.Copy("../testdata/teststorage/paillier", "../testdata/storage/test/paillier"))
+	client, err := New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	require.Error(t, client.ImportBackup(bytes.NewReader(exported.Bytes()), bytes.Repeat([]byte{2}, StorageKeyLength), false))
+	tampered := append([]byte{}, exported.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	require.Error(t, client.ImportBackup(bytes.NewReader(tampered), key, false))
+	require.NoError(t, client.ImportBackup(bytes.NewReader(exported.Bytes()), key, false))
+	verifyCredentials(t, client)
+	require.Contains(t, client.keyshareServers, irma.NewSchemeManagerIdentifier("test"))
+	verifyPaillierKey(t, client.keyshareServers[irma.NewSchemeManagerIdentifier("test")].PrivateKey)
+	cred, err := client.credential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0)
+	require.NoError(t, err)
+	require.NotNil(t, cred)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	// The restored wallet was written to storage
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	verifyCredentials(t, client)
+	require.Len(t, client.CredentialInfoList(), 1)
+
+	// Importing again into the same wallet merges without duplicates
+	require.NoError(t, client.ImportBackup(bytes.NewReader(exported.Bytes()), key, false))
+	require.Len(t, client.CredentialInfoList(), 1)
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	// Another credential of a singleton credential type conflicts with the one in the wallet
+	studentCard := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0]
+	ints := append([]*big.Int{}, studentCard.Ints...)
+	ints[1] = big.NewInt(42)
+	conflicts := client.backupConflicts(&backup{
+		SecretKey:  client.secretkey,
+		Attributes: []*irma.AttributeList{irma.NewAttributeListFromInts(ints, client.Configuration)},
+	})
+	require.Len(t, conflicts, 1)
+	require.Contains(t, conflicts[0], "irma-demo.RU.studentCard")
+
+	// A non-empty wallet with a different secret key conflicts, unless we overwrite it
+	client.secretkey = &SecretKey{Key: big.NewInt(42)}
+	err = client.ImportBackup(bytes.NewReader(exported.Bytes()), key, false)
+	require.Error(t, err)
+	require.IsType(t, &BackupConflictError{}, err)
+	require.NoError(t, client.ImportBackup(bytes.NewReader(exported.Bytes()), key, true))
+	verifyCredentials(t, client)
+
+	test.ClearTestStorage(t)
+}
+
+// preferencesFailingStorage is a Storage that fails to store preferences.
+type preferencesFailingStorage struct {
+	Storage
+}
+
+func (s preferencesFailingStorage) StorePreferences(prefs Preferences) error {
+	return errors.New("disk full")
+}
+
+func TestBackupInterrupted(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, StorageKeyLength)
+	client := parseStorage(t)
+
+	// Distinct entries within the same second, and identical entries, are all kept
+	now := irma.Timestamp(time.Now())
+	for _, msg := range []string{"a", "b", "b"} {
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: irma.ActionSigning, Time: now, SignedMessage: []byte(msg)}))
+	}
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	count := len(logs)
+	var backup bytes.Buffer
+	require.NoError(t, client.ExportBackup(&backup, key))
+	credcount := len(client.CredentialInfoList())
+	require.NoError(t, client.RemoveCredential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0))
+
+	// If restoring is interrupted, it is finished when reopening the storage
+	storage := client.storage
+	client.storage = preferencesFailingStorage{storage}
+	require.Error(t, client.ImportBackup(bytes.NewReader(backup.Bytes()), key, true))
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	require.Len(t, client.CredentialInfoList(), credcount)
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, count)
+
+	// Merging the backup again adds only the log entries that are missing
+	require.NoError(t, client.ImportBackup(bytes.NewReader(backup.Bytes()), key, false))
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, count)
+	require.NoError(t, client.storage.DeleteLogs(func(entry *LogEntry) bool {
+		return string(entry.SignedMessage) == "b"
+	}))
+	require.NoError(t, client.ImportBackup(bytes.NewReader(backup.Bytes()), key, false))
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, count)
+
+	// Credentials whose signature cannot be verified are refused
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	credtype := client.Configuration.CredentialTypes[studentCard]
+	delete(client.Configuration.CredentialTypes, studentCard)
+	require.Error(t, client.ImportBackup(bytes.NewReader(backup.Bytes()), key, true))
+	client.Configuration.CredentialTypes[studentCard] = credtype
+
+	test.ClearTestStorage(t)
+}
+
+func addTestLogs(t *testing.T, client *Client, start time.Time, count int) {
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	for i := 0; i < count; i++ {
+		entry := &LogEntry{
+			Type: irma.ActionDisclosing,
+			Time: irma.Timestamp(start.Add(time.Duration(i) * time.Hour)),
+		}
+		if i%2 == 0 {
+			entry.Type = irma.ActionIssuing
+			entry.Received = map[irma.CredentialTypeIdentifier][]irma.TranslatedString{studentCard: nil}
+		}
+		require.NoError(t, client.addLogEntry(entry))
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	client := parseStorage(t)
+	start := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	addTestLogs(t, client, start, 10)
+
+	// Filters
+	count, err := client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+	count, err = client.CountLogs(&LogQuery{Types: []irma.Action{irma.ActionIssuing}})
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+	count, err = client.CountLogs(&LogQuery{From: start.Add(2 * time.Hour), Until: start.Add(5 * time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	count, err = client.CountLogs(&LogQuery{CredentialType: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")})
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	// Pagination, in both orders
+	for _, newestFirst := range []bool{false, true} {
+		query := &LogQuery{NewestFirst: newestFirst, Limit: 4}
+		var ids []uint64
+		for {
+			page, err := client.QueryLogs(query)
+			require.NoError(t, err)
+			for _, entry := range page.Entries {
+				ids = append(ids, entry.ID)
+			}
+			if page.Next == "" {
+				break
+			}
+			query.Cursor = page.Next
+		}
+		require.Len(t, ids, 10)
+		for i := 1; i < len(ids); i++ {
+			require.Equal(t, newestFirst, ids[i] < ids[i-1])
+		}
+	}
+	_, err = client.QueryLogs(&LogQuery{Cursor: "foo"})
+	require.Error(t, err)
+
+	// An incompletely written last entry is ignored, and overwritten by the next one
+	f, err := os.OpenFile("../testdata/storage/test/"+logEntriesFile, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(`{"ID":11,"Type":"disc`))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	count, err = client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+	addTestLogs(t, client, start, 1)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 11)
+	require.Equal(t, uint64(11), logs[10].ID)
+
+	test.ClearTestStorage(t)
+}
+
+func TestLogMigration(t *testing.T) {
+	// Logs stored by earlier versions are moved to the log store by a client update
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
+	require.NoError(t, fs.SaveFile("../testdata/storage/test/"+logsFile,
+		[]byte(`[{"Type":"issuing","Time":1500000000},{"Type":"disclosing","Time":1500000001,`+
+			`"Disclosed":{"irma-demo.RU.studentCard":{"4":{"en":"456","nl":"456"}},"irma-demo.MijnOverheid.root":{}}}]`)))
+	client, err := New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	exists, err := fs.PathExists("../testdata/storage/test/" + logsFile)
+	require.NoError(t, err)
+	require.False(t, exists)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	require.Equal(t, irma.ActionIssuing, logs[0].Type)
+	require.Equal(t, uint64(2), logs[1].ID)
+
+	// Disclosed attributes are grouped by credential and keyed by attribute type
+	require.Equal(t, []*DisclosedCredential{
+		{
+			Type:       irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+			Attributes: map[irma.AttributeTypeIdentifier]*DisclosedAttribute{irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root"): {}},
+		},
+		{
+			Type:       irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+			Attributes: map[irma.AttributeTypeIdentifier]*DisclosedAttribute{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"): {Value: "456"}},
+		},
+	}, logs[1].Disclosed)
+
+	// Log entries are encrypted along with the rest of the storage
+	key := bytes.Repeat([]byte{1}, StorageKeyLength)
+	require.NoError(t, client.RotateStorageKey(key))
+	bts, err := ioutil.ReadFile("../testdata/storage/test/" + logEntriesFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "issuing")
+	client, err = newEncryptedClient(t, key)
+	require.NoError(t, err)
+	addTestLogs(t, client, time.Now(), 1)
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 3)
+	require.Equal(t, irma.ActionDisclosing, logs[1].Type)
+
+	// Encrypted entries cannot be duplicated or reordered
+	bts, err = ioutil.ReadFile("../testdata/storage/test/" + logEntriesFile)
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(bts), []byte("\n"))
+	require.Len(t, lines, 3)
+	for _, changed := range [][][]byte{
+		{lines[0], lines[1], lines[1], lines[2]},
+		{lines[1], lines[0], lines[2]},
+	} {
+		require.NoError(t, ioutil.WriteFile("../testdata/storage/test/"+logEntriesFile, append(bytes.Join(changed, []byte("\n")), '\n'), 0600))
+		_, err = client.Logs()
+		require.Error(t, err)
+	}
+
+	// Encrypted entries cannot be swapped
+	id := string(bytes.SplitN(lines[0], []byte(" "), 2)[0])
+	lines[0] = []byte(id + " " + string(bytes.SplitN(lines[1], []byte(" "), 2)[1]))
+	require.NoError(t, ioutil.WriteFile("../testdata/storage/test/"+logEntriesFile, append(bytes.Join(lines, []byte("\n")), '\n'), 0600))
+	_, err = client.Logs()
+	require.Error(t, err)
+
+	test.ClearTestStorage(t)
+}
+
+func TestLogRetention(t *testing.T) {
+	client := parseStorage(t)
+	start := time.Now().Add(-10 * 24 * time.Hour)
+	addTestLogs(t, client, start, 5)
+
+	// Deleting an entry is logged without its contents
+	require.NoError(t, client.DeleteLogEntry(2))
+	require.Error(t, client.DeleteLogEntry(2))
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 5)
+	require.Equal(t, actionLogDeletion, logs[4].Type)
+	require.Equal(t, 1, logs[4].DeletedLogs)
+	require.Nil(t, logs[4].Received)
+
+	require.NoError(t, client.DeleteLogsBefore(start.Add(150*time.Minute)))
+	logs, err = client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 4)
+	require.Equal(t, uint64(4), logs[0].ID)
+	require.Equal(t, 2, logs[3].DeletedLogs)
+
+	// Retention by number of entries and by age, also applied when opening the client
+	require.NoError(t, client.SetLogRetentionPreference(0, 3))
+	count, err := client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.NoError(t, client.SetLogRetentionPreference(1, 0))
+	count, err = client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	addTestLogs(t, client, start, 1)
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	require.Equal(t, 1, client.Preferences.LogRetentionDays)
+	count, err = client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Error(t, client.SetLogRetentionPreference(-1, 0))
+
+	// Adding entries does not read all entries, unless some are to be deleted
+	storage := &iterationCountingStorage{Storage: client.storage}
+	client.storage = storage
+	addTestLogs(t, client, time.Now(), 3)
+	require.Zero(t, storage.iterations)
+	addTestLogs(t, client, start, 1)
+	require.Equal(t, 1, storage.iterations)
+	count, err = client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	// Entries that expired since they were added are not returned; we simulate this by adding
+	// an expired entry to the storage directly, and updating the statistics accordingly
+	require.NoError(t, client.storage.AppendLog(&LogEntry{Type: irma.ActionSigning, Time: irma.Timestamp(start)}))
+	client.logStats.oldest = start
+	count, err = client.CountLogs(&LogQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	test.ClearTestStorage(t)
+}
+
+// iterationCountingStorage is a Storage that counts how often all log entries are read.
+type iterationCountingStorage struct {
+	Storage
+	iterations int
+}
+
+func (s *iterationCountingStorage) IterateLogs(handler func(entry *LogEntry) bool) error {
+	s.iterations++
+	return s.Storage.IterateLogs(handler)
+}
+
+func TestDisclosedLogEntry(t *testing.T) {
+	client := parseStorage(t)
+	studentCard := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0]
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+
+	session := &session{
+		Action: irma.ActionDisclosing,
+		client: client,
+		choice: &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{
+			{Type: studentID, CredentialHash: studentCard.Hash()},
+		}},
+		irmaSession: &irma.DisclosureRequest{Content: irma.AttributeDisjunctionList{
+			{Label: "Student number", Attributes: []irma.AttributeTypeIdentifier{studentID}},
+		}},
+	}
+	entry, err := session.createLogEntry(gabi.ProofList{&gabi.ProofD{ADisclosed: map[int]*big.Int{
+		1: studentCard.Ints[0],
+		4: studentCard.Ints[3],
+		5: studentCard.Ints[4],
+	}}})
+	require.NoError(t, err)
+	require.Len(t, entry.Disclosed, 1)
+	require.Equal(t, studentCard.Hash(), entry.Disclosed[0].CredentialHash)
+	require.Len(t, entry.Disclosed[0].Attributes, 2)
+	require.Equal(t, &DisclosedAttribute{
+		Value: studentCard.UntranslatedAttribute(studentID),
+		Label: "Student number",
+	}, entry.Disclosed[0].Attributes[studentID])
+	require.Equal(t, studentCard.UntranslatedAttribute(level), entry.Disclosed[0].Attributes[level].Value)
+	require.Empty(t, entry.Disclosed[0].Attributes[level].Label)
+	require.Equal(t, "Student number", client.Configuration.AttributeName(studentID)["en"])
+
+	// Attributes of the same type from different credentials are recorded separately,
+	// each with the credential and disjunction from the disclosure choice
+	session.choice.Attributes = append(session.choice.Attributes, &irma.AttributeIdentifier{Type: studentID, CredentialHash: "other"})
+	session.irmaSession.(*irma.DisclosureRequest).Content = append(session.irmaSession.ToDisclose(),
+		&irma.AttributeDisjunction{Label: "Other student number", Attributes: []irma.AttributeTypeIdentifier{studentID}},
+	)
+	proofd := &gabi.ProofD{ADisclosed: map[int]*big.Int{1: studentCard.Ints[0], 4: studentCard.Ints[3]}}
+	entry, err = session.createLogEntry(gabi.ProofList{proofd, proofd})
+	require.NoError(t, err)
+	require.Len(t, entry.Disclosed, 2)
+	require.Equal(t, studentCard.Hash(), entry.Disclosed[0].CredentialHash)
+	require.Equal(t, "Student number", entry.Disclosed[0].Attributes[studentID].Label)
+	require.Equal(t, "other", entry.Disclosed[1].CredentialHash)
+	require.Equal(t, "Other student number", entry.Disclosed[1].Attributes[studentID].Label)
+
+	// The entry survives a roundtrip through storage
+	require.NoError(t, client.addLogEntry(entry))
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Equal(t, entry.Disclosed, logs[len(logs)-1].Disclosed)
+
+	test.ClearTestStorage(t)
+}
+
+func TestAndroidLogs(t *testing.T) {
+	logs := `[
+		{"type":"issue","value":{"timestamp":"September 29, 2017 11:12:57 AM GMT+02:00","credential":{"identifier":"irma-demo.RU.studentCard"}}},
+		{"type":"unknown","value":{"timestamp":"September 29, 2017 11:13:00 AM GMT+02:00"}},
+		{"type":"issue","value":{"timestamp":"yesterday","credential":{"identifier":"irma-demo.RU.studentCard"}}},
+		{"type":"verification","value":{"timestamp":"September 30, 2017 1:00:00 PM GMT+02:00","credential":{"identifier":"irma-demo.RU.studentCard"},"attributeDisclosed":{"studentID":true,"level":false}}},
+		{"type":"signature","value":{"timestamp":"October 1, 2017 9:30:00 AM GMT+02:00","credential":{"identifier":"irma-demo.RU.studentCard"},"attributeDisclosed":{"level":true},"message":"I owe you everything"}},
+		{"type":"remove","value":{"timestamp":"October 2, 2017 9:30:00 AM GMT+02:00","credential":{"identifier":"irma-demo.RU.studentCard"}}}
+	]`
+	cardemu := `<?xml version='1.0' encoding='utf-8' standalone='yes' ?><map><string name="logs">` +
+		html.EscapeString(logs) + `</string></map>`
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
+	require.NoError(t, os.MkdirAll("../testdata/storage/test/android/shared_prefs", 0700))
+	require.NoError(t, fs.SaveFile("../testdata/storage/test/android/shared_prefs/cardemu.xml", []byte(cardemu)))
+
+	client, err := New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"../testdata/storage/test/android",
+		&IgnoringClientHandler{},
+	)
+	require.NoError(t, err)
+	entries, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// The unparseable entries are skipped and reported in the update
+	update := client.updates[len(client.updates)-1]
+	require.True(t, update.Success)
+	require.NotNil(t, update.Warning)
+	require.Contains(t, *update.Warning, "skipped 2 Android log entries")
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.Equal(t, irma.ActionIssuing, entries[0].Type)
+	require.Contains(t, entries[0].Received, studentCard)
+	expected := time.Date(2017, 9, 29, 9, 12, 57, 0, time.UTC)
+	require.True(t, expected.Equal(time.Time(entries[0].Time)), "%s", time.Time(entries[0].Time))
+	require.Equal(t, irma.ActionDisclosing, entries[1].Type)
+	require.Equal(t, []*DisclosedCredential{{
+		Type:       studentCard,
+		Attributes: map[irma.AttributeTypeIdentifier]*DisclosedAttribute{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"): {}},
+	}}, entries[1].Disclosed)
+	require.Equal(t, irma.ActionSigning, entries[2].Type)
+	require.Equal(t, "I owe you everything", string(entries[2].SignedMessage))
+	require.Len(t, entries[2].Disclosed, 1)
+	require.Contains(t, entries[2].Disclosed[0].Attributes, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"))
+	require.Equal(t, actionRemoval, entries[3].Type)
+	require.Contains(t, entries[3].Removed, studentCard)
+
+	test.ClearTestStorage(t)
+}
+
+func TestInspectStorage(t *testing.T) {
+	conf, err := irma.NewConfiguration("../testdata/irma_configuration", "")
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	inspection, err := InspectStorage("../testdata/teststorage", conf)
+	require.NoError(t, err)
+	require.True(t, inspection.SecretKey)
+	require.True(t, inspection.PaillierKeys)
+	require.Len(t, inspection.Credentials, 2)
+	require.Equal(t, "irma-demo.RU.studentCard", inspection.Credentials[0].Attributes.CredentialType().Identifier().String())
+	for _, cred := range inspection.Credentials {
+		require.True(t, cred.Signature)
+		require.Empty(t, cred.KeyError)
+	}
+	require.Contains(t, inspection.KeyshareServers, irma.NewSchemeManagerIdentifier("test"))
+	require.Equal(t, "testusername", inspection.KeyshareServers[irma.NewSchemeManagerIdentifier("test")].Username)
+	require.NotEmpty(t, inspection.Updates)
+}
+
 func TestLogging(t *testing.T) {
 	client := parseStorage(t)
 
@@ -239,6 +853,271 @@ func TestCredentialRemoval(t *testing.T) {
 	test.ClearTestStorage(t)
 }
 
+// journalFailingStorage is a Storage that fails to store the issuance journal.
+type journalFailingStorage struct {
+	Storage
+}
+
+func (s journalFailingStorage) StoreIssuanceJournal(journal *IssuanceJournal) error {
+	return errors.New("disk full")
+}
+
+// attributesFailingStorage is a Storage that fails to store the attributes.
+type attributesFailingStorage struct {
+	Storage
+}
+
+func (s attributesFailingStorage) StoreAttributes(attributes []*irma.AttributeList) error {
+	return errors.New("disk full")
+}
+
+func TestIssuanceJournal(t *testing.T) {
+	client := parseStorage(t)
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	cred, err := client.credential(id, 0)
+	require.NoError(t, err)
+	require.NotNil(t, cred)
+	require.NoError(t, client.RemoveCredential(id, 0))
+
+	// Committing a credential stores it along with its signature
+	require.NoError(t, client.commitCredentials([]*credential{cred}))
+	journal, err := client.storage.LoadIssuanceJournal()
+	require.NoError(t, err)
+	require.Nil(t, journal)
+	sig, err := client.storage.LoadSignature(cred.AttributeList())
+	require.NoError(t, err)
+	require.NotNil(t, sig)
+	require.NoError(t, client.RemoveCredential(id, 0))
+
+	// If we are interrupted after saving the journal, the credential is saved when reopening the storage
+	journal = &IssuanceJournal{
+		Attributes: append(client.attributeLists(), cred.AttributeList()),
+		Signatures: map[string]*gabi.CLSignature{cred.AttributeList().Hash(): cred.Signature},
+	}
+	require.NoError(t, client.storage.StoreIssuanceJournal(journal))
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	recovered, err := client.credential(id, 0)
+	require.NoError(t, err)
+	require.NotNil(t, recovered)
+	require.Equal(t, cred.AttributeList().Hash(), recovered.AttributeList().Hash())
+	journal, err = client.storage.LoadIssuanceJournal()
+	require.NoError(t, err)
+	require.Nil(t, journal)
+	require.NoError(t, client.RemoveCredential(id, 0))
+
+	// If the journal cannot be saved, none of the credentials become visible
+	count := len(client.CredentialInfoList())
+	storage := client.storage
+	client.storage = journalFailingStorage{storage}
+	require.Error(t, client.commitCredentials([]*credential{cred}))
+	client.storage = storage
+	require.Len(t, client.CredentialInfoList(), count)
+	require.Nil(t, client.Attributes(id, 0))
+	sig, err = client.storage.LoadSignature(cred.AttributeList())
+	require.NoError(t, err)
+	require.Nil(t, sig)
+
+	// If the journal cannot be performed, it is performed before any later change,
+	// so that it does not overwrite that change when reopening the storage
+	client.storage = attributesFailingStorage{storage}
+	require.Error(t, client.commitCredentials([]*credential{cred}))
+	client.storage = storage
+	require.NotNil(t, client.Attributes(id, 0))
+	require.NoError(t, client.RemoveCredential(id, 0))
+	journal, err = client.storage.LoadIssuanceJournal()
+	require.NoError(t, err)
+	require.Nil(t, journal)
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	require.Nil(t, client.Attributes(id, 0))
+
+	test.ClearTestStorage(t)
+}
+
+// TestConcurrentClientAccess accesses the client from many goroutines at once.
+// Run with -race to check that the client is safe for concurrent use.
+func TestConcurrentClientAccess(t *testing.T) {
+	client := parseStorage(t)
+
+	attrtype := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	disjunction := &irma.AttributeDisjunction{Attributes: []irma.AttributeTypeIdentifier{attrtype}}
+	errs := make(chan error, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.CredentialInfoList()
+			client.Candidates(disjunction)
+			client.Attributes(attrtype.CredentialTypeIdentifier(), 0)
+			client.SetCrashReportingPreference(i%2 == 0)
+			errs <- client.appendLog(&LogEntry{Type: irma.ActionDisclosing, Time: irma.Timestamp(time.Now())})
+			_, err := client.QueryLogs(&LogQuery{Limit: 5})
+			errs <- err
+			errs <- client.ExportBackup(ioutil.Discard, make([]byte, StorageKeyLength))
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- client.RemoveCredential(attrtype.CredentialTypeIdentifier(), 0)
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	count, err := client.CountLogs(&LogQuery{Types: []irma.Action{irma.ActionDisclosing}})
+	require.NoError(t, err)
+	require.True(t, count >= 10)
+	require.Nil(t, client.Attributes(attrtype.CredentialTypeIdentifier(), 0))
+
+	test.ClearTestStorage(t)
+}
+
+func TestConcurrentIssuanceState(t *testing.T) {
+	client := parseStorage(t)
+
+	request := getIssuanceRequest(true)
+	states := make([]*IssuanceState, 10)
+	errs := make(chan error, len(states))
+	var wg sync.WaitGroup
+	for i := range states {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state, err := NewIssuanceState()
+			if err != nil {
+				errs <- err
+				return
+			}
+			states[i] = state
+			_, err = client.IssueCommitments(request, state)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Each session has its own issuance state, containing builders for its own credentials only
+	for _, state := range states {
+		require.Len(t, state.builders, len(request.Credentials))
+	}
+
+	test.ClearTestStorage(t)
+}
+
+// TestConcurrentConfigurationDownload issues credentials while another session downloads part
+// of the Configuration. Run with -race to check that the Configuration is not accessed concurrently.
+func TestConcurrentConfigurationDownload(t *testing.T) {
+	client := parseStorage(t)
+
+	// Serve the test scheme manager, from which we download a credential type that we remove
+	// from the Configuration of the client
+	server := httptest.NewServer(http.FileServer(http.Dir("../testdata/irma_configuration/test")))
+	defer server.Close()
+	mijnirma := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	set := &irma.IrmaIdentifierSet{
+		SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{mijnirma: {}},
+	}
+	removeCredentialType := func() error {
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		client.Configuration.SchemeManagers[mijnirma.IssuerIdentifier().SchemeManagerIdentifier()].URL = server.URL
+		delete(client.Configuration.CredentialTypes, mijnirma)
+		return os.Remove(filepath.Join(client.Configuration.Path, "test", "test", "Issues", "mijnirma", "description.xml"))
+	}
+
+	// Issue the credentials of the request using the private keys of their issuers
+	request := getIssuanceRequest(true)
+	request.Context, request.Nonce = big.NewInt(1), big.NewInt(1)
+	issuers := make([]*gabi.Issuer, len(request.Credentials))
+	attrs := make([]*irma.AttributeList, len(request.Credentials))
+	for i, credreq := range request.Credentials {
+		id := credreq.CredentialTypeID.IssuerIdentifier()
+		sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(
+			"../testdata/irma_configuration", strings.Replace(id.String(), ".", "/", -1), "PrivateKeys", "0.xml"))
+		require.NoError(t, err)
+		pk, err := client.Configuration.PublicKey(id, credreq.KeyCounter)
+		require.NoError(t, err)
+		issuers[i] = gabi.NewIssuer(sk, pk, request.Context)
+		attrs[i], err = credreq.AttributeList(client.Configuration)
+		require.NoError(t, err)
+	}
+	issue := func() error {
+		state, err := NewIssuanceState()
+		if err != nil {
+			return err
+		}
+		commitments, err := client.IssueCommitments(request, state)
+		if err != nil {
+			return err
+		}
+		sigs := make([]*gabi.IssueSignatureMessage, len(issuers))
+		for i, issuer := range issuers {
+			proof, ok := commitments.Proofs[i].(*gabi.ProofU)
+			if !ok {
+				return errors.New("Issuance commitment is not a ProofU")
+			}
+			if sigs[i], err = issuer.IssueSignature(proof.U, attrs[i].Ints, commitments.Nonce2); err != nil {
+				return err
+			}
+		}
+		return client.ConstructCredentials(sigs, request, state)
+	}
+
+	errs := make(chan error, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := issue(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := removeCredentialType(); err != nil {
+				errs <- err
+				return
+			}
+			downloaded, err := client.downloadConfiguration(set)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, ok := downloaded.CredentialTypes[mijnirma]; !ok {
+				errs <- errors.New("Credential type was not downloaded")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Contains(t, client.Configuration.CredentialTypes, mijnirma)
+	require.NotNil(t, client.Attributes(*request.Credentials[0].CredentialTypeID, 0))
+
+	test.ClearTestStorage(t)
+}
+
 func TestWrongSchemeManager(t *testing.T) {
 	client := parseStorage(t)
 
@@ -0,0 +1,191 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the journal with which new credentials are saved to storage.
+//
+// Saving a credential involves writing its signature as well as the list of attributes of
+// all credentials, and an issuance session may yield several credentials. So that we are never
+// left with only some of these writes done, we first save a journal containing all of them
+// in a single write, then perform the writes, and then delete the journal. If we are
+// interrupted after saving the journal, New() performs the writes from the journal again,
+// so that either all or none of the new credentials become visible. If performing the writes
+// fails without us being interrupted, they are retried before any later change to storage.
+//
+// Importing a backup (see backup.go) uses the same journal, additionally containing the secret
+// key, keyshare enrollments, preferences and log entries that the backup replaces or adds.
+
+// IssuanceJournal contains the changes to storage with which new credentials are saved.
+type IssuanceJournal struct {
+	Attributes []*irma.AttributeList        // Attributes of all credentials, including the new ones
+	Signatures map[string]*gabi.CLSignature // Signatures of the new credentials, by attribute list hash
+	Removed    []*irma.AttributeList        // Credentials replaced by the new ones, whose signatures are to be deleted
+
+	// Only when importing a backup; nil if unchanged
+	SecretKey       *SecretKey                                       `json:",omitempty"`
+	KeyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer // All keyshare enrollments
+	Preferences     *Preferences                                     `json:",omitempty"`
+	Logs            []*LogEntry                                      `json:",omitempty"` // Log entries to add, unless already present
+	ReplaceLogs     bool                                             `json:",omitempty"` // Whether to delete the existing log entries first
+}
+
+// commitCredentials adds the credentials to the client and saves them to storage, such that
+// either all or none of them are stored even if we are interrupted.
+func (client *Client) commitCredentials(creds []*credential) error {
+	if err := client.finishJournal(); err != nil {
+		return err
+	}
+
+	journal := &IssuanceJournal{Signatures: map[string]*gabi.CLSignature{}}
+	for _, cred := range creds {
+		added, replaced := client.addCredential(cred)
+		if added {
+			journal.Signatures[cred.AttributeList().Hash()] = cred.Signature
+		}
+		if replaced != nil {
+			delete(journal.Signatures, replaced.Hash()) // In case it was one of the new ones
+			journal.Removed = append(journal.Removed, replaced)
+		}
+	}
+	journal.Attributes = client.attributeLists()
+
+	if err := client.storage.StoreIssuanceJournal(journal); err != nil {
+		// Nothing was stored, so undo our changes by reloading the credentials from storage
+		client.credentials = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+		if loadErr := client.loadAttributes(); loadErr != nil {
+			return loadErr
+		}
+		return err
+	}
+
+	// From here on the credentials are committed: if we do not manage to perform the
+	// writes of the journal now, finishJournal() or recoverIssuance() does so later.
+	client.journal = journal
+	return client.finishJournal()
+}
+
+// finishJournal performs the writes of the journal of an earlier commitCredentials() or
+// ImportBackup() that we did not manage to perform at the time, if any. It must be called
+// before any other change to the data that the journal contains, as performing the journal
+// afterwards, e.g. by recoverIssuance() in New(), would overwrite that change.
+func (client *Client) finishJournal() error {
+	if client.journal == nil {
+		return nil
+	}
+	if err := client.applyIssuanceJournal(client.journal); err != nil {
+		return err
+	}
+	client.journal = nil
+	return nil
+}
+
+// applyIssuanceJournal performs the writes contained in the journal, and then deletes it.
+// This may be done more than once for the same journal.
+func (client *Client) applyIssuanceJournal(journal *IssuanceJournal) error {
+	for _, attrs := range journal.Attributes {
+		if sig, ok := journal.Signatures[attrs.Hash()]; ok {
+			if err := client.storage.StoreSignature(attrs, sig); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.storage.StoreAttributes(journal.Attributes); err != nil {
+		return err
+	}
+	for _, attrs := range journal.Removed {
+		if err := client.storage.DeleteSignature(attrs); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if journal.SecretKey != nil {
+		if err := client.storage.StoreSecretKey(journal.SecretKey); err != nil {
+			return err
+		}
+	}
+	if journal.KeyshareServers != nil {
+		if err := client.storage.StoreKeyshareServers(journal.KeyshareServers); err != nil {
+			return err
+		}
+	}
+	if journal.Preferences != nil {
+		if err := client.storage.StorePreferences(*journal.Preferences); err != nil {
+			return err
+		}
+	}
+	if err := client.applyJournalLogs(journal); err != nil {
+		return err
+	}
+	return client.storage.DeleteIssuanceJournal()
+}
+
+// applyJournalLogs adds the log entries of the journal that are not yet present, after deleting
+// the existing ones if the journal replaces them.
+func (client *Client) applyJournalLogs(journal *IssuanceJournal) error {
+	if len(journal.Logs) == 0 && !journal.ReplaceLogs {
+		return nil
+	}
+	client.logStats = nil // Recomputed when next needed
+	if journal.ReplaceLogs {
+		if err := client.storage.DeleteLogs(func(*LogEntry) bool { return true }); err != nil {
+			return err
+		}
+	}
+
+	// Count the present entries, so that of identical entries only as many are added as are missing
+	present := map[string]int{}
+	var keyErr error
+	err := client.storage.IterateLogs(func(entry *LogEntry) bool {
+		entry.migrateDisclosed(client.Configuration)
+		var key string
+		key, keyErr = logEntryKey(entry)
+		present[key]++
+		return keyErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if keyErr != nil {
+		return keyErr
+	}
+	for _, entry := range journal.Logs {
+		key, err := logEntryKey(entry)
+		if err != nil {
+			return err
+		}
+		if present[key] > 0 {
+			present[key]--
+			continue
+		}
+		entry.ID = 0 // Assign a new ID that is unique within this wallet
+		if err = client.storage.AppendLog(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logEntryKey identifies a log entry by its contents, so that entries from a backup that the
+// wallet already has are recognized regardless of their IDs.
+func logEntryKey(entry *LogEntry) (string, error) {
+	id := entry.ID
+	entry.ID = 0
+	bts, err := json.Marshal(entry)
+	entry.ID = id
+	return string(bts), err
+}
+
+// recoverIssuance finishes saving the credentials of an interrupted commitCredentials(),
+// or the contents of an interrupted ImportBackup().
+func (client *Client) recoverIssuance() error {
+	journal, err := client.storage.LoadIssuanceJournal()
+	if err != nil || journal == nil {
+		return err
+	}
+	return client.applyIssuanceJournal(journal)
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"math/big"
 	"strconv"
+	"sync"
 
 	"github.com/go-errors/errors"
 	"github.com/mhe/gabi"
@@ -37,20 +38,34 @@ type keyshareSession struct {
 	pinRequestor    KeysharePinRequestor
 	builders        gabi.ProofBuilderList
 	session         irma.IrmaSession
-	conf            *irma.Configuration
-	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer
-	keyshareServer  *keyshareServer // The one keyshare server in use in case of issuance
+	schemeManagers  map[irma.SchemeManagerIdentifier]*irma.SchemeManager
+	keyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer
+	keyshareServer  *KeyshareServer // The one keyshare server in use in case of issuance
 	transports      map[irma.SchemeManagerIdentifier]*irma.HTTPTransport
-	state           *issuanceState
+	state           *IssuanceState
 }
 
-type keyshareServer struct {
+// KeyshareServer contains the registration of the client at the keyshare server of a scheme manager.
+type KeyshareServer struct {
 	URL                     string              `json:"url"`
 	Username                string              `json:"username"`
 	Nonce                   []byte              `json:"nonce"`
-	PrivateKey              *paillierPrivateKey `json:"keyPair"`
+	PrivateKey              *PaillierPrivateKey `json:"keyPair"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
 	token                   string
+	tokenLock               sync.Mutex // Guards token, which may be set by concurrent sessions
+}
+
+func (kss *KeyshareServer) getToken() string {
+	kss.tokenLock.Lock()
+	defer kss.tokenLock.Unlock()
+	return kss.token
+}
+
+func (kss *KeyshareServer) setToken(token string) {
+	kss.tokenLock.Lock()
+	defer kss.tokenLock.Unlock()
+	kss.token = token
 }
 
 type keyshareEnrollment struct {
@@ -114,10 +129,10 @@ const (
 
 func newKeyshareServer(
 	schemeManagerIdentifier irma.SchemeManagerIdentifier,
-	privatekey *paillierPrivateKey,
+	privatekey *PaillierPrivateKey,
 	url, email string,
-) (ks *keyshareServer, err error) {
-	ks = &keyshareServer{
+) (ks *KeyshareServer, err error) {
+	ks = &KeyshareServer{
 		Nonce:                   make([]byte, 32),
 		URL:                     url,
 		Username:                email,
@@ -128,7 +143,7 @@ func newKeyshareServer(
 	return
 }
 
-func (ks *keyshareServer) HashedPin(pin string) string {
+func (ks *KeyshareServer) HashedPin(pin string) string {
 	hash := sha256.Sum256(append(ks.Nonce, []byte(pin)...))
 	// We must be compatible with the old Android app here,
 	// which uses Base64.encodeToString(hash, Base64.DEFAULT),
@@ -146,13 +161,13 @@ func startKeyshareSession(
 	pin KeysharePinRequestor,
 	builders gabi.ProofBuilderList,
 	session irma.IrmaSession,
-	conf *irma.Configuration,
-	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer,
-	state *issuanceState,
+	schemeManagers map[irma.SchemeManagerIdentifier]*irma.SchemeManager,
+	keyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer,
+	state *IssuanceState,
 ) {
 	ksscount := 0
 	for managerID := range session.Identifiers().SchemeManagers {
-		if conf.SchemeManagers[managerID].Distributed() {
+		if schemeManagers[managerID].Distributed() {
 			ksscount++
 			if _, enrolled := keyshareServers[managerID]; !enrolled {
 				err := errors.New("Not enrolled to keyshare server of scheme manager " + managerID.String())
@@ -173,7 +188,7 @@ func startKeyshareSession(
 		sessionHandler:  sessionHandler,
 		transports:      map[irma.SchemeManagerIdentifier]*irma.HTTPTransport{},
 		pinRequestor:    pin,
-		conf:            conf,
+		schemeManagers:  schemeManagers,
 		keyshareServers: keyshareServers,
 		state:           state,
 	}
@@ -181,14 +196,14 @@ func startKeyshareSession(
 	requestPin := false
 
 	for managerID := range session.Identifiers().SchemeManagers {
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if !ks.schemeManagers[managerID].Distributed() {
 			continue
 		}
 
 		ks.keyshareServer = ks.keyshareServers[managerID]
 		transport := irma.NewHTTPTransport(ks.keyshareServer.URL)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
-		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
+		transport.SetHeader(kssAuthHeader, ks.keyshareServer.getToken())
 		ks.transports[managerID] = transport
 
 		authstatus := &keyshareAuthorization{}
@@ -275,7 +290,7 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 func (ks *keyshareSession) verifyPinAttempt(pin string) (
 	success bool, tries int, blocked int, manager irma.SchemeManagerIdentifier, err error) {
 	for manager = range ks.session.Identifiers().SchemeManagers {
-		if !ks.conf.SchemeManagers[manager].Distributed() {
+		if !ks.schemeManagers[manager].Distributed() {
 			continue
 		}
 
@@ -290,8 +305,8 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 
 		switch pinresult.Status {
 		case kssPinSuccess:
-			kss.token = pinresult.Message
-			transport.SetHeader(kssAuthHeader, kss.token)
+			kss.setToken(pinresult.Message)
+			transport.SetHeader(kssAuthHeader, pinresult.Message)
 		case kssPinFailure:
 			tries, err = strconv.Atoi(pinresult.Message)
 			return
@@ -320,7 +335,7 @@ func (ks *keyshareSession) GetCommitments() {
 	for _, builder := range ks.builders {
 		pk := builder.PublicKey()
 		managerID := irma.NewIssuerIdentifier(pk.Issuer).SchemeManagerIdentifier()
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if !ks.schemeManagers[managerID].Distributed() {
 			continue
 		}
 		if _, contains := pkids[managerID]; !contains {
@@ -332,7 +347,7 @@ func (ks *keyshareSession) GetCommitments() {
 	// Now inform each keyshare server of with respect to which public keys
 	// we want them to send us commitments
 	for managerID := range ks.session.Identifiers().SchemeManagers {
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if !ks.schemeManagers[managerID].Distributed() {
 			continue
 		}
 
@@ -436,7 +451,7 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 	for i, builder := range ks.builders {
 		// Parse each received JWT
 		managerID := irma.NewIssuerIdentifier(builder.PublicKey().Issuer).SchemeManagerIdentifier()
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if !ks.schemeManagers[managerID].Distributed() {
 			continue
 		}
 		msg := struct {
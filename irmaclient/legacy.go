@@ -5,6 +5,7 @@ import (
 	"math/big"
 
 	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
 )
 
 // TODO remove on protocol upgrade
@@ -15,6 +16,32 @@ type logSessionInfo struct {
 	Keys    map[string]int `json:"keys"`
 }
 
+func newLogSessionInfo(info *irma.SessionInfo) *logSessionInfo {
+	si := &logSessionInfo{
+		Jwt:     info.Jwt,
+		Nonce:   info.Nonce,
+		Context: info.Context,
+		Keys:    make(map[string]int),
+	}
+	for iss, count := range info.Keys {
+		si.Keys[iss.String()] = count
+	}
+	return si
+}
+
+func (si *logSessionInfo) sessionInfo() *irma.SessionInfo {
+	info := &irma.SessionInfo{
+		Jwt:     si.Jwt,
+		Nonce:   si.Nonce,
+		Context: si.Context,
+		Keys:    make(map[irma.IssuerIdentifier]int),
+	}
+	for iss, count := range si.Keys {
+		info.Keys[irma.NewIssuerIdentifier(iss)] = count
+	}
+	return info
+}
+
 func (pki *publicKeyIdentifier) MarshalJSON() ([]byte, error) {
 	temp := struct {
 		Issuer  map[string]string `json:"issuer"`
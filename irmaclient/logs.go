@@ -1,7 +1,11 @@
 package irmaclient
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -12,28 +16,88 @@ import (
 // LogEntry is a log entry of a past event.
 type LogEntry struct {
 	// General info
+	ID          uint64 // Assigned when the entry is stored, increasing in the order of storing
 	Type        irma.Action
 	Time        irma.Timestamp    // Time at which the session was completed
 	SessionInfo *irma.SessionInfo // Message that started the session
+	Group       string            // Shared by the entries of chained sessions, empty otherwise
+	Outcome     LogOutcome        // Whether the session succeeded, failed, was cancelled or unsatisfiable
+	Policy      *DisclosurePolicy // Disclosure policy that approved or denied the session, if any
+
+	// In case of sessions that did not succeed
+	ErrorType irma.ErrorType                // Type of the error, in case of failure
+	Requested irma.AttributeDisjunctionList // Attributes that the requestor asked for
 
 	// Session type-specific info
-	Disclosed         map[irma.CredentialTypeIdentifier]map[int]irma.TranslatedString // Any session type
-	Received          map[irma.CredentialTypeIdentifier][]irma.TranslatedString       // In case of issuance session
-	Removed           map[irma.CredentialTypeIdentifier][]irma.TranslatedString       // In case of credential removal
-	SignedMessage     []byte                                                          // In case of signature sessions
-	SignedMessageType string                                                          // In case of signature sessions
-
-	response    interface{}     // Our response (ProofList or IssueCommitmentMessage)
-	rawResponse json.RawMessage // Unparsed []byte version of response
+	Disclosed         []*DisclosedCredential                                    // Any session type
+	Received          map[irma.CredentialTypeIdentifier][]irma.TranslatedString // In case of issuance session
+	Removed           map[irma.CredentialTypeIdentifier][]irma.TranslatedString // In case of credential removal
+	SignedMessage     []byte                                                    // In case of signature sessions
+	SignedMessageType string                                                    // In case of signature sessions
+	DeletedLogs       int                                                       // In case of log deletion
+
+	response        interface{}     // Our response (ProofList or IssueCommitmentMessage)
+	rawResponse     json.RawMessage // Unparsed []byte version of response
+	legacyDisclosed legacyDisclosed // Disclosed attributes as stored by earlier versions, see migrateDisclosed()
+}
+
+// DisclosedCredential contains the attributes disclosed from a single credential in a session.
+// If only the possession of the credential was disclosed, its Attributes contain one
+// attribute keyed by the identifier of the credential type, whose Value is empty.
+type DisclosedCredential struct {
+	Type           irma.CredentialTypeIdentifier
+	CredentialHash string                                               `json:",omitempty"` // Empty in entries of earlier versions
+	Attributes     map[irma.AttributeTypeIdentifier]*DisclosedAttribute // Keyed by attribute type
 }
 
-const actionRemoval = irma.Action("removal")
+// DisclosedAttribute is an attribute disclosed in a session. The Value is empty in entries
+// converted from the old Android app, which did not store it. Use
+// irma.Configuration.AttributeName() to obtain the name of the attribute.
+type DisclosedAttribute struct {
+	Value string
+	Label string `json:",omitempty"` // Label of the requested disjunction that the attribute satisfied
+}
+
+// legacyDisclosed is the format in which earlier versions stored disclosed attributes:
+// keyed by credential type and the index of the attribute in the disclosure proof, with the
+// value of the attribute as "translation" in all languages.
+type legacyDisclosed map[irma.CredentialTypeIdentifier]map[int]irma.TranslatedString
 
+// LogOutcome is the outcome of the session or event that a log entry records.
+type LogOutcome string
+
+const (
+	LogOutcomeSuccess       = LogOutcome("success")
+	LogOutcomeFailure       = LogOutcome("failure")       // The session failed with an error
+	LogOutcomeCancelled     = LogOutcome("cancelled")     // The user declined or dismissed the session
+	LogOutcomeUnsatisfiable = LogOutcome("unsatisfiable") // The user does not have the requested attributes
+)
+
+const (
+	actionRemoval     = irma.Action("removal")
+	actionLogDeletion = irma.Action("logdeletion")
+)
+
+// newLogGroup returns a new random identifier for grouping the log entries of chained sessions.
+func newLogGroup() string {
+	bts := make([]byte, 16)
+	_, _ = rand.Read(bts)
+	return hex.EncodeToString(bts)
+}
+
+// createLogEntry returns the log entry of the session, having sent the response.
+// It acquires the lock of the client, as it reads the Configuration.
 func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
+	session.client.lock.Lock()
+	defer session.client.lock.Unlock()
+
 	entry := &LogEntry{
 		Type:        session.Action,
 		Time:        irma.Timestamp(time.Now()),
 		SessionInfo: session.info,
+		Group:       session.logGroup,
+		Outcome:     LogOutcomeSuccess,
+		Policy:      session.policy,
 		response:    response,
 	}
 
@@ -70,28 +134,136 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		return nil, errors.New("Invalid log type")
 	}
 
-	// Populate the list of disclosed attributes .Disclosed
+	// Populate the list of disclosed attributes .Disclosed. The disclosure proofs are in the
+	// order of the credentials in the disclosure choice (see proofBuilders()).
+	var creds []irma.CredentialIdentifier
+	if session.choice != nil {
+		creds = disclosedCredentials(session.choice)
+	}
 	for _, proof := range prooflist {
-		if proofd, isproofd := proof.(*gabi.ProofD); isproofd {
-			if entry.Disclosed == nil {
-				entry.Disclosed = map[irma.CredentialTypeIdentifier]map[int]irma.TranslatedString{}
-			}
-			meta := irma.MetadataFromInt(proofd.ADisclosed[1], session.client.Configuration)
-			id := meta.CredentialType().Identifier()
-			entry.Disclosed[id] = map[int]irma.TranslatedString{}
-			for i, attr := range proofd.ADisclosed {
-				if i == 1 {
-					continue
-				}
-				val := string(attr.Bytes())
-				entry.Disclosed[id][i] = irma.TranslatedString{"en": val, "nl": val}
+		proofd, isproofd := proof.(*gabi.ProofD)
+		if !isproofd {
+			continue
+		}
+		credtype := irma.MetadataFromInt(proofd.ADisclosed[1], session.client.Configuration).CredentialType()
+		if credtype == nil {
+			return nil, errors.New("Disclosed credential has unknown type")
+		}
+		disclosed := &DisclosedCredential{
+			Type:       credtype.Identifier(),
+			Attributes: map[irma.AttributeTypeIdentifier]*DisclosedAttribute{},
+		}
+		var cred irma.CredentialIdentifier
+		if index := len(entry.Disclosed); index < len(creds) && creds[index].Type == disclosed.Type {
+			cred = creds[index]
+			disclosed.CredentialHash = cred.Hash
+		}
+		for i, attr := range proofd.ADisclosed {
+			// Index 0 is the secret key, 1 the metadata attribute
+			if i < 2 || i-2 >= len(credtype.Attributes) {
+				continue
 			}
+			id := irma.NewAttributeTypeIdentifier(credtype.Identifier().String() + "." + credtype.Attributes[i-2].ID)
+			disclosed.Attributes[id] = &DisclosedAttribute{Value: string(attr.Bytes()), Label: session.disclosedLabel(cred, id)}
+		}
+		if len(disclosed.Attributes) == 0 {
+			id := irma.NewAttributeTypeIdentifier(credtype.Identifier().String())
+			disclosed.Attributes[id] = &DisclosedAttribute{Label: session.disclosedLabel(cred, id)}
 		}
+		entry.Disclosed = append(entry.Disclosed, disclosed)
 	}
 
 	return entry, nil
 }
 
+// disclosedLabel returns the label of the requested disjunction that the specified attribute
+// of the specified credential satisfied. If the credential is unknown, the first disjunction
+// containing the attribute is used.
+func (session *session) disclosedLabel(cred irma.CredentialIdentifier, id irma.AttributeTypeIdentifier) string {
+	disjunctions := session.irmaSession.ToDisclose()
+	if session.choice != nil && cred.Hash != "" {
+		for i, chosen := range session.choice.Attributes {
+			if i < len(disjunctions) && chosen.Type == id && chosen.CredentialIdentifier() == cred {
+				return disjunctions[i].Label
+			}
+		}
+	}
+	for _, disjunction := range disjunctions {
+		for _, requested := range disjunction.Attributes {
+			if requested == id {
+				return disjunction.Label
+			}
+		}
+	}
+	return ""
+}
+
+// credentialTypeOf returns the credential type of the attribute, or the credential type
+// itself if the identifier refers to a credential.
+func credentialTypeOf(id irma.AttributeTypeIdentifier) irma.CredentialTypeIdentifier {
+	if id.IsCredential() {
+		return irma.NewCredentialTypeIdentifier(id.String())
+	}
+	return id.CredentialTypeIdentifier()
+}
+
+// migrateDisclosed converts disclosed attributes stored by earlier versions to the current
+// format, using the credential type descriptions to determine which attribute was disclosed.
+func (entry *LogEntry) migrateDisclosed(conf *irma.Configuration) {
+	if entry.legacyDisclosed == nil {
+		return
+	}
+	entry.Disclosed = []*DisclosedCredential{}
+	for credid, attrs := range entry.legacyDisclosed {
+		disclosed := &DisclosedCredential{Type: credid, Attributes: map[irma.AttributeTypeIdentifier]*DisclosedAttribute{}}
+		entry.Disclosed = append(entry.Disclosed, disclosed)
+		if len(attrs) == 0 {
+			disclosed.Attributes[irma.NewAttributeTypeIdentifier(credid.String())] = &DisclosedAttribute{}
+			continue
+		}
+		credtype := conf.CredentialTypes[credid]
+		for index, value := range attrs {
+			// Without the credential type, we can only record the index of the attribute
+			name := strconv.Itoa(index)
+			if credtype != nil && index >= 2 && index-2 < len(credtype.Attributes) {
+				name = credtype.Attributes[index-2].ID
+			}
+			disclosed.Attributes[irma.NewAttributeTypeIdentifier(credid.String()+"."+name)] = &DisclosedAttribute{Value: value["en"]}
+		}
+	}
+	sort.Slice(entry.Disclosed, func(i, j int) bool {
+		return entry.Disclosed[i].Type.String() < entry.Disclosed[j].Type.String()
+	})
+	entry.legacyDisclosed = nil
+}
+
+// logOutcome logs that the session did not succeed, recording the requestor and the attributes
+// it asked for, if we got that far. Each session is logged at most once.
+func (session *session) logOutcome(outcome LogOutcome, err *irma.SessionError) {
+	if session.logged {
+		return
+	}
+	session.logged = true
+
+	entry := &LogEntry{
+		Type:    session.Action,
+		Time:    irma.Timestamp(time.Now()),
+		Group:   session.logGroup,
+		Outcome: outcome,
+		Policy:  session.policy,
+	}
+	if session.info != nil && session.info.Jwt != "" {
+		entry.SessionInfo = session.info
+	}
+	if session.irmaSession != nil {
+		entry.Requested = session.irmaSession.ToDisclose()
+	}
+	if err != nil {
+		entry.ErrorType = err.ErrorType
+	}
+	_ = session.client.appendLog(entry) // TODO err
+}
+
 // Jwt returns the JWT from the requestor that started the IRMA session which the
 // current log entry tracks.
 func (entry *LogEntry) Jwt() (irma.RequestorJwt, error) {
@@ -100,9 +272,12 @@ func (entry *LogEntry) Jwt() (irma.RequestorJwt, error) {
 
 // GetResponse returns our response to the requestor from the log entry.
 func (entry *LogEntry) GetResponse() (interface{}, error) {
+	if entry.Outcome != LogOutcomeSuccess {
+		return nil, nil // We did not respond
+	}
 	if entry.response == nil {
 		switch entry.Type {
-		case actionRemoval:
+		case actionRemoval, actionLogDeletion:
 			return nil, nil
 		case irma.ActionSigning:
 			fallthrough
@@ -123,15 +298,22 @@ func (entry *LogEntry) GetResponse() (interface{}, error) {
 }
 
 type jsonLogEntry struct {
+	ID          uint64 `json:",omitempty"`
 	Type        irma.Action
 	Time        irma.Timestamp
 	SessionInfo *logSessionInfo
+	Group       string                        `json:",omitempty"`
+	Outcome     LogOutcome                    `json:",omitempty"`
+	Policy      *DisclosurePolicy             `json:",omitempty"`
+	ErrorType   irma.ErrorType                `json:",omitempty"`
+	Requested   irma.AttributeDisjunctionList `json:",omitempty"`
 
-	Disclosed         map[irma.CredentialTypeIdentifier]map[int]irma.TranslatedString `json:",omitempty"`
-	Received          map[irma.CredentialTypeIdentifier][]irma.TranslatedString       `json:",omitempty"`
-	Removed           map[irma.CredentialTypeIdentifier][]irma.TranslatedString       `json:",omitempty"`
-	SignedMessage     []byte                                                          `json:",omitempty"`
-	SignedMessageType string                                                          `json:",omitempty"`
+	Disclosed         json.RawMessage                                           `json:",omitempty"`
+	Received          map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"`
+	Removed           map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"`
+	SignedMessage     []byte                                                    `json:",omitempty"`
+	SignedMessageType string                                                    `json:",omitempty"`
+	DeletedLogs       int                                                       `json:",omitempty"`
 
 	Response json.RawMessage
 }
@@ -145,26 +327,41 @@ func (entry *LogEntry) UnmarshalJSON(bytes []byte) error {
 	}
 
 	*entry = LogEntry{
-		Type: temp.Type,
-		Time: temp.Time,
-		SessionInfo: &irma.SessionInfo{
-			Jwt:     temp.SessionInfo.Jwt,
-			Nonce:   temp.SessionInfo.Nonce,
-			Context: temp.SessionInfo.Context,
-			Keys:    make(map[irma.IssuerIdentifier]int),
-		},
+		ID:                temp.ID,
+		Type:              temp.Type,
+		Time:              temp.Time,
+		Group:             temp.Group,
+		Outcome:           temp.Outcome,
+		Policy:            temp.Policy,
+		ErrorType:         temp.ErrorType,
+		Requested:         temp.Requested,
 		Removed:           temp.Removed,
-		Disclosed:         temp.Disclosed,
 		Received:          temp.Received,
 		SignedMessage:     temp.SignedMessage,
 		SignedMessageType: temp.SignedMessageType,
+		DeletedLogs:       temp.DeletedLogs,
 		rawResponse:       temp.Response,
 	}
+	// Entries stored by earlier versions only recorded successes
+	if entry.Outcome == "" {
+		entry.Outcome = LogOutcomeSuccess
+	}
+	if len(temp.Disclosed) > 0 {
+		// In the format of earlier versions, the attributes are keyed by credential type, so that
+		// the current format (a list of credentials) does not parse as such
+		legacy := legacyDisclosed{}
+		if json.Unmarshal(temp.Disclosed, &legacy) == nil {
+			entry.legacyDisclosed = legacy
+		} else if err = json.Unmarshal(temp.Disclosed, &entry.Disclosed); err != nil {
+			return err
+		}
+	}
 
-	// TODO remove on protocol upgrade
-	for iss, count := range temp.SessionInfo.Keys {
-		entry.SessionInfo.Keys[irma.NewIssuerIdentifier(iss)] = count
+	// Removal and log deletion entries have no session info
+	if temp.SessionInfo == nil {
+		return nil
 	}
+	entry.SessionInfo = temp.SessionInfo.sessionInfo()
 
 	return nil
 }
@@ -182,27 +379,40 @@ func (entry *LogEntry) MarshalJSON() ([]byte, error) {
 
 	var si *logSessionInfo
 	if entry.SessionInfo != nil {
-		si = &logSessionInfo{
-			Jwt:     entry.SessionInfo.Jwt,
-			Nonce:   entry.SessionInfo.Nonce,
-			Context: entry.SessionInfo.Context,
-			Keys:    make(map[string]int),
-		}
-		// TODO remove on protocol upgrade
-		for iss, count := range entry.SessionInfo.Keys {
-			si.Keys[iss.String()] = count
+		si = newLogSessionInfo(entry.SessionInfo)
+	}
+	var disclosed interface{}
+	if entry.legacyDisclosed != nil {
+		disclosed = entry.legacyDisclosed
+	} else if len(entry.Disclosed) > 0 {
+		disclosed = entry.Disclosed
+	}
+	var disclosedJson json.RawMessage
+	if disclosed != nil {
+		bts, err := json.Marshal(disclosed)
+		if err != nil {
+			return nil, err
 		}
+		disclosedJson = bts
 	}
+
 	temp := &jsonLogEntry{
+		ID:                entry.ID,
 		Type:              entry.Type,
 		Time:              entry.Time,
 		Response:          entry.rawResponse,
 		SessionInfo:       si,
+		Group:             entry.Group,
+		Outcome:           entry.Outcome,
+		Policy:            entry.Policy,
+		ErrorType:         entry.ErrorType,
+		Requested:         entry.Requested,
 		Removed:           entry.Removed,
-		Disclosed:         entry.Disclosed,
+		Disclosed:         disclosedJson,
 		Received:          entry.Received,
 		SignedMessage:     entry.SignedMessage,
 		SignedMessageType: entry.SignedMessageType,
+		DeletedLogs:       entry.DeletedLogs,
 	}
 
 	return json.Marshal(temp)
@@ -0,0 +1,702 @@
+package irmaclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the append-only storage of log entries, and the API to query them.
+//
+// The file storage stores log entries in the logEntriesFile, one per line: either the JSON
+// serialization of the entry, or if the storage is encrypted, the ID of the entry followed by
+// a space and the base64 encoding of its encryption (see encryption.go). The ID is authenticated
+// as associated data, so that encrypted entries cannot be swapped, and the IDs of the entries
+// must increase through the file, so that duplicated or reordered entries are refused (the
+// removal of entries is not detected). New entries are appended to the file, so that storing an
+// entry does not require reading or rewriting the existing ones, and queries stream through
+// the file instead of loading all entries into memory.
+//
+// Log entries can be deleted by the user, and are deleted automatically according to the
+// retention preferences. Deletions by the user are themselves logged, recording only the
+// number of deleted entries. So that the retention preferences can be checked whenever an
+// entry is added or the logs are read without reading all entries, the client keeps track
+// of the number of entries and the time of the oldest one.
+
+// LogQuery specifies which log entries to retrieve using QueryLogs or to count using CountLogs.
+// Entries match if they satisfy all of the specified (i.e. nonzero) conditions.
+type LogQuery struct {
+	Types          []irma.Action                 // Entries of one of these types
+	From           time.Time                     // Entries at or after this time
+	Until          time.Time                     // Entries before this time
+	Requestor      string                        // Entries of sessions with this requestor (ServerJwt.ServerName)
+	CredentialType irma.CredentialTypeIdentifier // Entries that disclosed, received, removed or were asked for this credential type
+	Outcomes       []LogOutcome                  // Entries with one of these outcomes
+
+	NewestFirst bool   // Return the newest entries first instead of the oldest ones
+	Limit       int    // Return at most this many entries per page; 0 means no limit
+	Cursor      string // Return the page after the one with this LogPage.Next; empty for the first page
+}
+
+// LogPage is a page of log entries, returned by QueryLogs.
+type LogPage struct {
+	Entries []*LogEntry
+	// Cursor with which to retrieve the next page, empty if there are no more entries
+	Next string
+}
+
+// QueryLogs returns a page of log entries matching the query.
+func (client *Client) QueryLogs(query *LogQuery) (*LogPage, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if err := client.applyLogRetention(); err != nil {
+		return nil, err
+	}
+
+	var cursor uint64
+	if query.Cursor != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(query.Cursor, 10, 64); err != nil {
+			return nil, errors.New("Invalid log cursor")
+		}
+	}
+
+	var entries []*LogEntry
+	err := client.storage.IterateLogs(func(entry *LogEntry) bool {
+		if query.NewestFirst {
+			if cursor != 0 && entry.ID >= cursor {
+				return false
+			}
+			if query.matches(entry) {
+				entries = append(entries, entry)
+				// Keep only the newest Limit+1 matching entries seen so far
+				if query.Limit > 0 && len(entries) > query.Limit+1 {
+					entries = entries[1:]
+				}
+			}
+			return true
+		}
+
+		if entry.ID <= cursor || !query.matches(entry) {
+			return true
+		}
+		entries = append(entries, entry)
+		return query.Limit == 0 || len(entries) <= query.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if query.NewestFirst {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	page := &LogPage{Entries: entries}
+	if query.Limit > 0 && len(entries) > query.Limit {
+		page.Entries = entries[:query.Limit]
+		page.Next = strconv.FormatUint(entries[query.Limit-1].ID, 10)
+	}
+	if page.Entries == nil {
+		page.Entries = []*LogEntry{}
+	}
+	return page, nil
+}
+
+// CountLogs returns the number of log entries matching the query, ignoring its Limit and Cursor.
+func (client *Client) CountLogs(query *LogQuery) (int, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if err := client.applyLogRetention(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err := client.storage.IterateLogs(func(entry *LogEntry) bool {
+		if query.matches(entry) {
+			count++
+		}
+		return true
+	})
+	return count, err
+}
+
+func (query *LogQuery) matches(entry *LogEntry) bool {
+	if len(query.Types) > 0 {
+		found := false
+		for _, t := range query.Types {
+			if entry.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(query.Outcomes) > 0 {
+		found := false
+		for _, o := range query.Outcomes {
+			if entry.Outcome == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !query.From.IsZero() && time.Time(entry.Time).Before(query.From) {
+		return false
+	}
+	if !query.Until.IsZero() && !time.Time(entry.Time).Before(query.Until) {
+		return false
+	}
+	if query.Requestor != "" {
+		if entry.SessionInfo == nil || entry.SessionInfo.Jwt == "" {
+			return false
+		}
+		jwt, err := entry.Jwt()
+		if err != nil || jwt.Requestor() != query.Requestor {
+			return false
+		}
+	}
+	if !query.CredentialType.Empty() {
+		_, received := entry.Received[query.CredentialType]
+		_, removed := entry.Removed[query.CredentialType]
+		if !received && !removed && !entry.disclosed(query.CredentialType) && !entry.requested(query.CredentialType) {
+			return false
+		}
+	}
+	return true
+}
+
+// disclosed returns whether attributes of the specified credential type were disclosed.
+func (entry *LogEntry) disclosed(credtype irma.CredentialTypeIdentifier) bool {
+	for _, cred := range entry.Disclosed {
+		if cred.Type == credtype {
+			return true
+		}
+	}
+	return false
+}
+
+// requested returns whether the requestor asked for attributes of the specified credential type.
+func (entry *LogEntry) requested(credtype irma.CredentialTypeIdentifier) bool {
+	for _, disjunction := range entry.Requested {
+		for _, attr := range disjunction.Attributes {
+			if credentialTypeOf(attr) == credtype {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetLogRetentionPreference sets how long log entries are kept: entries older than the specified
+// number of days are deleted, as are all but the specified number of most recent entries.
+// Zero means no limit. The preference is applied immediately.
+func (client *Client) SetLogRetentionPreference(days, entries int) error {
+	if days < 0 || entries < 0 {
+		return errors.New("Log retention must not be negative")
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.Preferences.LogRetentionDays = days
+	client.Preferences.LogRetentionEntries = entries
+	if err := client.storePreferences(); err != nil {
+		return err
+	}
+	return client.applyLogRetention()
+}
+
+// logStats contains the number of log entries and the time of the oldest one.
+type logStats struct {
+	count  int
+	oldest time.Time
+}
+
+// add updates the statistics with a newly added log entry.
+func (stats *logStats) add(entry *LogEntry) {
+	if stats.count == 0 || time.Time(entry.Time).Before(stats.oldest) {
+		stats.oldest = time.Time(entry.Time)
+	}
+	stats.count++
+}
+
+// applyLogRetention deletes the log entries that are to be deleted according to the preferences.
+// The entries are read only if the statistics of the log entries are unknown, or if they
+// show that entries are to be deleted.
+func (client *Client) applyLogRetention() error {
+	days, limit := client.Preferences.LogRetentionDays, client.Preferences.LogRetentionEntries
+	if days <= 0 && limit <= 0 {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	if stats := client.logStats; stats != nil && (limit <= 0 || stats.count <= limit) &&
+		(days <= 0 || stats.count == 0 || !stats.oldest.Before(cutoff)) {
+		return nil
+	}
+
+	// Determine the entries to delete first, so that we only rewrite the logs if necessary
+	remove := map[uint64]bool{}
+	var kept []*LogEntry
+	err := client.storage.IterateLogs(func(entry *LogEntry) bool {
+		if days > 0 && time.Time(entry.Time).Before(cutoff) {
+			remove[entry.ID] = true
+		} else {
+			kept = append(kept, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if limit > 0 && len(kept) > limit {
+		for _, entry := range kept[:len(kept)-limit] {
+			remove[entry.ID] = true
+		}
+		kept = kept[len(kept)-limit:]
+	}
+	if len(remove) > 0 {
+		if err = client.finishJournal(); err != nil {
+			return err
+		}
+		err = client.storage.DeleteLogs(func(entry *LogEntry) bool {
+			return remove[entry.ID]
+		})
+		if err != nil {
+			client.logStats = nil
+			return err
+		}
+	}
+	client.logStats = &logStats{}
+	for _, entry := range kept {
+		client.logStats.add(entry)
+	}
+	return nil
+}
+
+// DeleteLogEntry deletes the log entry with the specified ID.
+func (client *Client) DeleteLogEntry(id uint64) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	count, err := client.deleteLogs(func(entry *LogEntry) bool {
+		return entry.ID == id
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.Errorf("Log entry %d not found", id)
+	}
+	return nil
+}
+
+// DeleteLogsBefore deletes all log entries of events that happened before the specified time.
+func (client *Client) DeleteLogsBefore(t time.Time) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	_, err := client.deleteLogs(func(entry *LogEntry) bool {
+		return time.Time(entry.Time).Before(t)
+	})
+	return err
+}
+
+// deleteLogs deletes the log entries for which remove returns true, and logs the number of
+// deleted entries (but not their contents).
+func (client *Client) deleteLogs(remove func(entry *LogEntry) bool) (int, error) {
+	if err := client.finishJournal(); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := client.storage.DeleteLogs(func(entry *LogEntry) bool {
+		if remove(entry) {
+			count++
+			return true
+		}
+		return false
+	})
+	client.logStats = nil // Recomputed when next needed
+	if err != nil || count == 0 {
+		return count, err
+	}
+	return count, client.addLogEntry(&LogEntry{
+		Type:        actionLogDeletion,
+		Time:        irma.Timestamp(time.Now()),
+		DeletedLogs: count,
+	})
+}
+
+// File storage
+
+// AppendLog stores the entry at the end of the log entries file, assigning it an ID if it has none.
+func (s *fileStorage) AppendLog(entry *LogEntry) error {
+	if s.nextLogID == 0 {
+		if err := s.initNextLogID(); err != nil {
+			return err
+		}
+	}
+	if entry.ID == 0 {
+		entry.ID = s.nextLogID
+	}
+	if entry.ID < s.nextLogID {
+		// After deleting entries, nextLogID may exceed the ID of the last entry in the file
+		if err := s.initNextLogID(); err != nil {
+			return err
+		}
+		if entry.ID < s.nextLogID {
+			return errors.Errorf("Log entry %d must have an ID of at least %d", entry.ID, s.nextLogID)
+		}
+	}
+	line, err := s.encodeLogEntry(entry, s.key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path(logEntriesFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if entry.ID >= s.nextLogID {
+		s.nextLogID = entry.ID + 1
+	}
+	return nil
+}
+
+// IterateLogs calls the handler for each log entry in order of their IDs, until it returns false.
+func (s *fileStorage) IterateLogs(handler func(entry *LogEntry) bool) error {
+	return s.iterateLogLines(func(line []byte, entry *LogEntry) bool {
+		return handler(entry)
+	})
+}
+
+// UpdateLogs rewrites the log entries file with the changes that update makes to the entries.
+func (s *fileStorage) UpdateLogs(update func(entry *LogEntry)) error {
+	return s.rewriteLogs(s.key, func(entry *LogEntry) bool {
+		update(entry)
+		return false
+	})
+}
+
+// DeleteLogs removes the log entries for which remove returns true.
+func (s *fileStorage) DeleteLogs(remove func(entry *LogEntry) bool) error {
+	return s.rewriteLogs(s.key, remove)
+}
+
+// iterateLogLines calls the handler for each line of the log entries file and the entry it
+// contains, until it returns false. An incomplete last line, which may be the result of
+// being interrupted while appending, is skipped. An error is returned if the IDs of the
+// entries do not increase.
+func (s *fileStorage) iterateLogLines(handler func(line []byte, entry *LogEntry) bool) error {
+	f, err := os.Open(s.path(logEntriesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var lastID uint64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF {
+			// Incomplete last line, or end of file
+			if len(bytes.TrimSpace(line)) > 0 {
+				if entry, decodeErr := s.decodeLogEntry(line); decodeErr == nil && entry.ID > lastID {
+					handler(line, entry)
+				}
+			}
+			return nil
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry, err := s.decodeLogEntry(line)
+		if err != nil {
+			return err
+		}
+		if entry.ID <= lastID {
+			return errors.Errorf("Log entry %d is out of order", entry.ID)
+		}
+		lastID = entry.ID
+		if !handler(line, entry) {
+			return nil
+		}
+	}
+}
+
+// rewriteLogs rewrites the log entries file, encrypting the entries under the specified key
+// (or in plaintext if it is nil), and omitting the entries for which remove returns true.
+// Changes that remove makes to the other entries are stored.
+func (s *fileStorage) rewriteLogs(key []byte, remove func(entry *LogEntry) bool) error {
+	exists, err := fs.PathExists(s.path(logEntriesFile))
+	if err != nil || !exists {
+		return err
+	}
+	var contents []byte
+	var encodeErr error
+	err = s.iterateLogLines(func(line []byte, entry *LogEntry) bool {
+		if remove != nil && remove(entry) {
+			return true
+		}
+		line, encodeErr = s.encodeLogEntry(entry, key)
+		contents = append(contents, line...)
+		return encodeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return fs.SaveFile(s.path(logEntriesFile), contents)
+}
+
+// initNextLogID determines the ID of the next log entry from the last entry in the log entries file,
+// after removing any incomplete last line so that new entries can be appended to the file.
+func (s *fileStorage) initNextLogID() error {
+	s.nextLogID = 1
+	if err := truncateIncompleteLine(s.path(logEntriesFile)); err != nil {
+		return err
+	}
+	line, err := lastLine(s.path(logEntriesFile))
+	if err != nil {
+		return err
+	}
+	if line != nil {
+		if entry, err := s.decodeLogEntry(line); err == nil {
+			s.nextLogID = entry.ID + 1
+			return nil
+		}
+	}
+	// The last line is absent or incomplete; look through all entries instead
+	return s.IterateLogs(func(entry *LogEntry) bool {
+		if entry.ID >= s.nextLogID {
+			s.nextLogID = entry.ID + 1
+		}
+		return true
+	})
+}
+
+// encodeLogEntry returns the line of the log entries file containing the entry.
+func (s *fileStorage) encodeLogEntry(entry *LogEntry, key []byte) ([]byte, error) {
+	bts, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if bts, err = encryptStorageFile(key, logEntryFile(entry.ID), bts); err != nil {
+			return nil, err
+		}
+		bts = []byte(strconv.FormatUint(entry.ID, 10) + " " + base64.StdEncoding.EncodeToString(bts))
+	}
+	return append(bts, '\n'), nil
+}
+
+// logEntryFile returns the name that is authenticated along with the encryption of the log entry with the specified ID.
+func logEntryFile(id uint64) string {
+	return logEntriesFile + "/" + strconv.FormatUint(id, 10)
+}
+
+// decodeLogEntry parses a line of the log entries file, decrypting it if necessary.
+func (s *fileStorage) decodeLogEntry(line []byte) (*LogEntry, error) {
+	line = bytes.TrimSpace(line)
+	var id uint64
+	encrypted := !bytes.HasPrefix(line, []byte("{"))
+	if encrypted {
+		parts := bytes.SplitN(line, []byte(" "), 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid encrypted log entry")
+		}
+		var err error
+		if id, err = strconv.ParseUint(string(parts[0]), 10, 64); err != nil {
+			return nil, err
+		}
+		bts, err := base64.StdEncoding.DecodeString(string(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if line, err = decryptStorageFile(s.keys(), logEntryFile(id), bts); err != nil {
+			return nil, err
+		}
+	} else if !s.acceptsPlaintext() {
+		return nil, errors.New("Log entry is not encrypted")
+	}
+	entry := &LogEntry{}
+	if err := json.Unmarshal(line, entry); err != nil {
+		return nil, err
+	}
+	if encrypted && entry.ID != id {
+		return nil, errors.Errorf("Log entry %d has wrong ID %d", id, entry.ID)
+	}
+	return entry, nil
+}
+
+// loadOldLogs returns the log entries from the logsFile, in which earlier versions
+// stored all log entries as a single JSON array.
+func (s *fileStorage) loadOldLogs() (logs []*LogEntry, err error) {
+	logs = []*LogEntry{}
+	if err := s.load(&logs, logsFile); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// lastLine returns the last nonempty line of the specified file, or nil if the file
+// does not exist or is empty, without reading the entire file.
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunkSize = 4096
+	var line []byte
+	for offset := info.Size(); offset > 0; {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err = f.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		line = append(chunk, line...)
+		trimmed := bytes.TrimRight(line, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+	line = bytes.TrimRight(line, "\n")
+	if len(line) == 0 {
+		return nil, nil
+	}
+	return line, nil
+}
+
+// truncateIncompleteLine removes the last line of the specified file if it does not end with
+// a newline, which happens if we were interrupted while appending it.
+func truncateIncompleteLine(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const chunkSize = 4096
+	end := info.Size()
+	for offset := end; offset > 0; {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err = f.ReadAt(chunk, offset); err != nil {
+			return err
+		}
+		i := bytes.LastIndexByte(chunk, '\n')
+		if i < 0 {
+			continue
+		}
+		if offset+int64(i)+1 == end {
+			return nil // The file ends with a newline
+		}
+		return f.Truncate(offset + int64(i) + 1)
+	}
+	return f.Truncate(0)
+}
+
+// Memory storage
+
+func (s *memoryStorage) AppendLog(entry *LogEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	if entry.ID == 0 {
+		entry.ID = s.lastLogID + 1
+	}
+	if entry.ID > s.lastLogID {
+		s.lastLogID = entry.ID
+	}
+	s.logs = append(s.logs, entry)
+	return nil
+}
+
+func (s *memoryStorage) IterateLogs(handler func(entry *LogEntry) bool) error {
+	s.Lock()
+	logs := append([]*LogEntry{}, s.logs...)
+	s.Unlock()
+	for _, entry := range logs {
+		if !handler(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) UpdateLogs(update func(entry *LogEntry)) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, entry := range s.logs {
+		update(entry)
+	}
+	return nil
+}
+
+func (s *memoryStorage) DeleteLogs(remove func(entry *LogEntry) bool) error {
+	s.Lock()
+	defer s.Unlock()
+	logs := make([]*LogEntry, 0, len(s.logs))
+	for _, entry := range s.logs {
+		if !remove(entry) {
+			logs = append(logs, entry)
+		}
+	}
+	s.logs = logs
+	return nil
+}
@@ -1,12 +1,14 @@
 package irmaclient
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
 )
 
 type ManualSessionHandler struct {
@@ -100,3 +102,224 @@ func (sh *ManualSessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdenti
 func (sh *ManualSessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
 	sh.Failure(irma.ActionUnknown, &irma.SessionError{Err: errors.New("KeyshareEnrollmentIncomplete")})
 }
+
+type unsatisfiableHandler struct {
+	*ManualSessionHandler
+}
+
+func (sh *unsatisfiableHandler) UnsatisfiableRequest(irmaAction irma.Action, serverName string, missingAttributes irma.AttributeDisjunctionList) {
+}
+
+func TestSessionOutcomeLogging(t *testing.T) {
+	client := parseStorage(t)
+	handler := &ManualSessionHandler{t: t, c: make(chan *irma.SessionError, 1)}
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+
+	// Unsatisfiable requests are logged along with the requested attributes
+	request := `{"nonce": 0, "message":"I owe you everything","messageType":"STRING","content":[{"label":"BSN","attributes":["irma-demo.MijnOverheid.root.BSN"]}]}`
+	client.NewManualSession(request, &unsatisfiableHandler{handler})
+
+	// Failed and cancelled sessions are logged once, with the error type if any
+	sigrequest := &irma.SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(request), sigrequest))
+	failed := &session{Action: irma.ActionSigning, Handler: handler, client: client, irmaSession: sigrequest}
+	failed.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto})
+	<-handler.c
+	failed.Dismiss()
+	cancelled := &session{Action: irma.ActionSigning, Handler: handler, client: client, irmaSession: sigrequest}
+	cancelled.Dismiss()
+	<-handler.c
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Len(t, logs, 3)
+	require.Equal(t, LogOutcomeUnsatisfiable, logs[0].Outcome)
+	require.Equal(t, bsn, logs[0].Requested[0].Attributes[0])
+	require.Equal(t, LogOutcomeFailure, logs[1].Outcome)
+	require.Equal(t, irma.ErrorCrypto, logs[1].ErrorType)
+	require.Equal(t, LogOutcomeCancelled, logs[2].Outcome)
+	require.Empty(t, logs[2].ErrorType)
+	response, err := logs[2].GetResponse()
+	require.NoError(t, err)
+	require.Nil(t, response)
+
+	count, err := client.CountLogs(&LogQuery{Outcomes: []LogOutcome{LogOutcomeFailure, LogOutcomeCancelled}})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	count, err = client.CountLogs(&LogQuery{CredentialType: bsn.CredentialTypeIdentifier()})
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	test.ClearTestStorage(t)
+}
+
+func TestDismissChainedSession(t *testing.T) {
+	client := parseStorage(t)
+	handler := &ManualSessionHandler{t: t, c: make(chan *irma.SessionError, 1)}
+	sigrequest := &irma.SignatureRequest{}
+	request := `{"nonce": 0, "message":"I owe you everything","messageType":"STRING","content":[]}`
+	require.NoError(t, json.Unmarshal([]byte(request), sigrequest))
+
+	// Dismissing a finished session that started a follow-up session cancels the follow-up session
+	next := &session{Action: irma.ActionSigning, Handler: handler, client: client, irmaSession: sigrequest}
+	first := &session{Action: irma.ActionDisclosing, Handler: handler, client: client, done: true}
+	first.lock.Lock()
+	first.next = next
+	first.lock.Unlock()
+	first.Dismiss()
+	require.Error(t, (<-handler.c).Err)
+	require.True(t, next.done)
+	require.True(t, first.dismissed)
+
+	test.ClearTestStorage(t)
+}
+
+func TestEventSession(t *testing.T) {
+	client := parseStorage(t)
+
+	// Refuse permission for a manual session
+	handler, events := NewEventHandler()
+	request := `{"nonce": 0, "message":"I owe you everything","messageType":"STRING","content":[{"label":"Student number (RU)","attributes":["irma-demo.RU.studentCard.studentID"]}]}`
+	client.NewManualSession(request, handler)
+	status := (<-events).(*StatusEvent)
+	require.Equal(t, irma.StatusManualStarted, status.Status)
+	permission := (<-events).(*PermissionEvent)
+	require.Equal(t, irma.ActionSigning, permission.Action)
+	require.Equal(t, "I owe you everything", permission.Request.(*irma.SignatureRequest).Message)
+	permission.Reply(false, nil)
+	cancelled := (<-events).(*CancelledEvent)
+	require.Equal(t, irma.ActionSigning, cancelled.Action)
+	_, open := <-events
+	require.False(t, open)
+
+	// Failures before the session has even started are delivered as well
+	session := client.NewEventSession(&irma.Qr{URL: "http://localhost", Type: irma.ActionDisclosing, ProtocolVersion: "3.0", ProtocolMaxVersion: "3.0"})
+	failure := (<-session.Events).(*FailureEvent)
+	require.Equal(t, irma.ErrorProtocolVersionNotSupported, failure.Err.ErrorType)
+	_, open = <-session.Events
+	require.False(t, open)
+	session.Dismiss()
+
+	// Only the first reply to a request is passed on to the session
+	replies := 0
+	permission = &PermissionEvent{callback: func(proceed bool, choice *irma.DisclosureChoice) { replies++ }}
+	permission.Reply(true, nil)
+	permission.Reply(false, nil)
+	pin := &PinEvent{callback: func(proceed bool, pin string) { replies++ }}
+	pin.Reply(true, "12345")
+	pin.Reply(true, "12345")
+	require.Equal(t, 2, replies)
+
+	// Being blocked at the keyshare server does not end the session
+	handler, events = NewEventHandler()
+	handler.KeyshareBlocked(irma.NewSchemeManagerIdentifier("test"), 60)
+	handler.Failure(irma.ActionDisclosing, &irma.SessionError{ErrorType: irma.ErrorKeyshare})
+	require.Equal(t, 60, (<-events).(*KeyshareBlockedEvent).Duration)
+	require.Equal(t, irma.ErrorKeyshare, (<-events).(*FailureEvent).Err.ErrorType)
+	_, open = <-events
+	require.False(t, open)
+
+	test.ClearTestStorage(t)
+}
+
+func TestDisclosurePolicies(t *testing.T) {
+	client := parseStorage(t)
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	email := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+
+	require.Error(t, client.AddDisclosurePolicy(&DisclosurePolicy{Kind: PolicyApprove, Requestor: "MijnIRMA", Attributes: []irma.AttributeTypeIdentifier{email}}))
+	require.Error(t, client.AddDisclosurePolicy(&DisclosurePolicy{Kind: PolicyPrefer}))
+	require.Error(t, client.AddDisclosurePolicy(&DisclosurePolicy{Kind: "foo"}))
+
+	// A deny policy for the credential type makes the request unsatisfiable, which is logged
+	deny := &DisclosurePolicy{Kind: PolicyDeny, Attributes: []irma.AttributeTypeIdentifier{
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard"),
+	}}
+	require.NoError(t, client.AddDisclosurePolicy(deny))
+	require.Equal(t, "1", deny.ID)
+	handler, events := NewEventHandler()
+	request := `{"nonce": 0, "message":"I owe you everything","messageType":"STRING","content":[{"label":"Student number (RU)","attributes":["irma-demo.RU.studentCard.studentID"]}]}`
+	client.NewManualSession(request, handler)
+	<-events // StatusEvent
+	unsatisfiable := (<-events).(*UnsatisfiableEvent)
+	require.Len(t, unsatisfiable.Missing, 1)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Equal(t, LogOutcomeUnsatisfiable, logs[0].Outcome)
+	require.NotNil(t, logs[0].Policy)
+	require.Equal(t, deny.ID, logs[0].Policy.ID)
+
+	// The handler cannot choose to disclose attributes that a deny policy forbids
+	disjunctions := irma.AttributeDisjunctionList{
+		{Label: "Identifier", Attributes: []irma.AttributeTypeIdentifier{studentID, email}},
+	}
+	candidates, _ := client.CheckSatisfiability(disjunctions)
+	require.Equal(t, studentID, candidates[0][0].Type)
+	handler, events = NewEventHandler()
+	request = `{"nonce": 0, "message":"I owe you everything","messageType":"STRING","content":[{"label":"Identifier","attributes":["irma-demo.RU.studentCard.studentID","test.test.mijnirma.email"]}]}`
+	client.NewManualSession(request, handler)
+	<-events // StatusEvent
+	permission := (<-events).(*PermissionEvent)
+	require.Len(t, permission.Request.(*irma.SignatureRequest).Candidates[0], 1)
+	permission.Reply(true, &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{candidates[0][0]}})
+	failure := (<-events).(*FailureEvent)
+	require.Equal(t, irma.ErrorInvalidChoice, failure.Err.ErrorType)
+	require.False(t, choiceAllowed(nil, candidates))
+	require.True(t, choiceAllowed(&irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{candidates[0][1]}}, candidates))
+
+	// Policies are stored in the preferences
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	require.Len(t, client.DisclosurePolicies(), 1)
+	require.Error(t, client.RemoveDisclosurePolicy("2"))
+	require.NoError(t, client.RemoveDisclosurePolicy(deny.ID))
+	require.Empty(t, client.DisclosurePolicies())
+
+	// A prefer policy puts the candidates from its credential type first
+	candidates, missing := client.CheckSatisfiability(disjunctions)
+	require.Empty(t, missing)
+	require.Len(t, candidates[0], 2)
+	require.Equal(t, studentID, candidates[0][0].Type)
+	require.NoError(t, client.AddDisclosurePolicy(&DisclosurePolicy{
+		Kind: PolicyPrefer, Label: "Identifier", Credential: email.CredentialTypeIdentifier(),
+	}))
+	candidates, missing, policy := client.applyDisclosurePolicies("", disjunctions, candidates, missing)
+	require.Nil(t, policy)
+	require.Empty(t, missing)
+	require.Equal(t, email, candidates[0][0].Type)
+
+	// An approve policy only approves disclosure of its attributes in sessions with the IRMA server
+	// at its origin over https, and of its requestor
+	approve := &DisclosurePolicy{
+		Kind: PolicyApprove, Origin: "privacybydesign.foundation", Requestor: "MijnIRMA",
+		Attributes: []irma.AttributeTypeIdentifier{email},
+	}
+	require.NoError(t, client.AddDisclosurePolicy(approve))
+	server := "https://privacybydesign.foundation/irma/session/abc"
+	policy, choice := client.approvingPolicy(irma.ActionDisclosing, server, "MijnIRMA", candidates)
+	require.Equal(t, approve, policy)
+	require.Equal(t, []*irma.AttributeIdentifier{candidates[0][0]}, choice.Attributes)
+	policy, _ = client.approvingPolicy(irma.ActionDisclosing, server, "Webshop", candidates)
+	require.Nil(t, policy)
+	policy, _ = client.approvingPolicy(irma.ActionSigning, server, "MijnIRMA", candidates)
+	require.Nil(t, policy)
+	// The requestor name is not authenticated, so it does not suffice on another server
+	policy, _ = client.approvingPolicy(irma.ActionDisclosing, "https://example.com/irma/session/abc", "MijnIRMA", candidates)
+	require.Nil(t, policy)
+	policy, _ = client.approvingPolicy(irma.ActionDisclosing, "http://privacybydesign.foundation/irma/session/abc", "MijnIRMA", candidates)
+	require.Nil(t, policy)
+	// The default port is not part of the origin, other ports are
+	policy, _ = client.approvingPolicy(irma.ActionDisclosing, "https://PrivacyByDesign.foundation:443/irma/session/abc", "MijnIRMA", candidates)
+	require.Equal(t, approve, policy)
+	policy, _ = client.approvingPolicy(irma.ActionDisclosing, "https://privacybydesign.foundation:8443/irma/session/abc", "MijnIRMA", candidates)
+	require.Nil(t, policy)
+	require.NoError(t, client.AddDisclosurePolicy(&DisclosurePolicy{
+		Kind: PolicyApprove, Origin: "example.com:443", Attributes: []irma.AttributeTypeIdentifier{email},
+	}))
+	require.Equal(t, "example.com", client.DisclosurePolicies()[2].Origin)
+	candidates[0][0], candidates[0][1] = candidates[0][1], candidates[0][0]
+	policy, _ = client.approvingPolicy(irma.ActionDisclosing, server, "MijnIRMA", candidates)
+	require.Nil(t, policy)
+
+	test.ClearTestStorage(t)
+}
@@ -0,0 +1,184 @@
+package irmaclient
+
+import (
+	"sync"
+
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// memoryStorage is a Storage that keeps everything in memory, e.g. for tests.
+// Stored values are not copied, so they should not be modified after storing them.
+type memoryStorage struct {
+	sync.Mutex
+
+	secretKey       *SecretKey
+	attributes      []*irma.AttributeList
+	signatures      map[string]*gabi.CLSignature
+	keyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer
+	paillierKeys    *PaillierPrivateKey
+	logs            []*LogEntry
+	lastLogID       uint64
+	updates         []Update
+	preferences     *Preferences
+	checkpoints     map[string]*SessionCheckpoint
+	journal         *IssuanceJournal
+}
+
+// NewMemoryStorage returns a Storage that keeps everything in memory, so that it is lost
+// when the process exits. Use MigrateStorage to copy its contents to another Storage.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{signatures: map[string]*gabi.CLSignature{}}
+}
+
+func (s *memoryStorage) EnsureStorageExists() error {
+	return nil
+}
+
+func (s *memoryStorage) LoadSecretKey() (*SecretKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.secretKey, nil
+}
+
+func (s *memoryStorage) LoadAttributes() ([]*irma.AttributeList, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*irma.AttributeList{}, s.attributes...), nil
+}
+
+func (s *memoryStorage) LoadSignature(attrs *irma.AttributeList) (*gabi.CLSignature, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.signatures[attrs.Hash()], nil
+}
+
+func (s *memoryStorage) LoadKeyshareServers() (map[irma.SchemeManagerIdentifier]*KeyshareServer, error) {
+	s.Lock()
+	defer s.Unlock()
+	ksses := make(map[irma.SchemeManagerIdentifier]*KeyshareServer, len(s.keyshareServers))
+	for id, kss := range s.keyshareServers {
+		ksses[id] = kss
+	}
+	return ksses, nil
+}
+
+func (s *memoryStorage) LoadPaillierKeys() (*PaillierPrivateKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.paillierKeys, nil
+}
+
+func (s *memoryStorage) LoadUpdates() ([]Update, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]Update{}, s.updates...), nil
+}
+
+func (s *memoryStorage) LoadPreferences() (Preferences, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.preferences == nil {
+		return defaultPreferences, nil
+	}
+	return *s.preferences, nil
+}
+
+func (s *memoryStorage) LoadSessionCheckpoints() (map[string]*SessionCheckpoint, error) {
+	s.Lock()
+	defer s.Unlock()
+	checkpoints := make(map[string]*SessionCheckpoint, len(s.checkpoints))
+	for id, checkpoint := range s.checkpoints {
+		checkpoints[id] = checkpoint
+	}
+	return checkpoints, nil
+}
+
+func (s *memoryStorage) LoadIssuanceJournal() (*IssuanceJournal, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.journal, nil
+}
+
+func (s *memoryStorage) StoreSecretKey(sk *SecretKey) error {
+	s.Lock()
+	defer s.Unlock()
+	s.secretKey = sk
+	return nil
+}
+
+func (s *memoryStorage) StoreAttributes(attributes []*irma.AttributeList) error {
+	s.Lock()
+	defer s.Unlock()
+	s.attributes = append([]*irma.AttributeList{}, attributes...)
+	return nil
+}
+
+func (s *memoryStorage) StoreSignature(attrs *irma.AttributeList, signature *gabi.CLSignature) error {
+	s.Lock()
+	defer s.Unlock()
+	s.signatures[attrs.Hash()] = signature
+	return nil
+}
+
+func (s *memoryStorage) DeleteSignature(attrs *irma.AttributeList) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.signatures, attrs.Hash())
+	return nil
+}
+
+func (s *memoryStorage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer) error {
+	s.Lock()
+	defer s.Unlock()
+	s.keyshareServers = make(map[irma.SchemeManagerIdentifier]*KeyshareServer, len(keyshareServers))
+	for id, kss := range keyshareServers {
+		s.keyshareServers[id] = kss
+	}
+	return nil
+}
+
+func (s *memoryStorage) StorePaillierKeys(key *PaillierPrivateKey) error {
+	s.Lock()
+	defer s.Unlock()
+	s.paillierKeys = key
+	return nil
+}
+
+func (s *memoryStorage) StoreUpdates(updates []Update) error {
+	s.Lock()
+	defer s.Unlock()
+	s.updates = append([]Update{}, updates...)
+	return nil
+}
+
+func (s *memoryStorage) StorePreferences(prefs Preferences) error {
+	s.Lock()
+	defer s.Unlock()
+	s.preferences = &prefs
+	return nil
+}
+
+func (s *memoryStorage) StoreIssuanceJournal(journal *IssuanceJournal) error {
+	s.Lock()
+	defer s.Unlock()
+	s.journal = journal
+	return nil
+}
+
+func (s *memoryStorage) DeleteIssuanceJournal() error {
+	s.Lock()
+	defer s.Unlock()
+	s.journal = nil
+	return nil
+}
+
+func (s *memoryStorage) StoreSessionCheckpoints(checkpoints map[string]*SessionCheckpoint) error {
+	s.Lock()
+	defer s.Unlock()
+	s.checkpoints = make(map[string]*SessionCheckpoint, len(checkpoints))
+	for id, checkpoint := range checkpoints {
+		s.checkpoints[id] = checkpoint
+	}
+	return nil
+}
@@ -7,11 +7,11 @@ import (
 	"github.com/credentials/go-go-gadget-paillier"
 )
 
-// paillierPrivateKey is an alias for paillier.PrivateKey so that we can add a custom unmarshaler to it.
-type paillierPrivateKey paillier.PrivateKey
+// PaillierPrivateKey is an alias for paillier.PrivateKey so that we can add a custom unmarshaler to it.
+type PaillierPrivateKey paillier.PrivateKey
 type paillierPublicKey paillier.PublicKey
 
-func (psk *paillierPrivateKey) UnmarshalJSON(bytes []byte) (err error) {
+func (psk *PaillierPrivateKey) UnmarshalJSON(bytes []byte) (err error) {
 	// First try to unmarshal it as a keypair serialized in the old Android format
 	oldFormat := &struct {
 		PrivateKey struct {
@@ -40,19 +40,19 @@ func (psk *paillierPrivateKey) UnmarshalJSON(bytes []byte) (err error) {
 	if err = json.Unmarshal(bytes, newFormat); err != nil {
 		return
 	}
-	*psk = paillierPrivateKey(*newFormat)
+	*psk = PaillierPrivateKey(*newFormat)
 	return
 }
 
-func (psk *paillierPrivateKey) MarshalJSON() ([]byte, error) {
+func (psk *PaillierPrivateKey) MarshalJSON() ([]byte, error) {
 	return json.Marshal(paillier.PrivateKey(*psk))
 }
 
-func (psk *paillierPrivateKey) Encrypt(bytes []byte) ([]byte, error) {
+func (psk *PaillierPrivateKey) Encrypt(bytes []byte) ([]byte, error) {
 	return paillier.Encrypt(&psk.PublicKey, bytes)
 }
 
-func (psk *paillierPrivateKey) Decrypt(bytes []byte) ([]byte, error) {
+func (psk *PaillierPrivateKey) Decrypt(bytes []byte) ([]byte, error) {
 	return paillier.Decrypt((*paillier.PrivateKey)(psk), bytes)
 }
 
@@ -0,0 +1,264 @@
+package irmaclient
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains disclosure policies: rules, stored in the preferences, that the client
+// applies to disclosure requests before asking the user for permission. Deny policies remove
+// attributes from the candidates for disclosure, prefer policies change the order of the
+// candidates so that the preferred ones are chosen by default, and approve policies grant
+// permission to disclose specific attributes without asking the user. Sessions in which the
+// handler chooses attributes that are not among the candidates fail, so that deny policies
+// also hold when the handler does not respect the candidates.
+//
+// The requestor name in the session request is not authenticated: anyone can start a session
+// claiming to be any requestor. Approve policies are therefore bound to the origin of the IRMA
+// server with which the session runs, which is authenticated by TLS, trusting that server to
+// have authenticated the requestor. Sessions with a server not reached over https are never
+// approved without asking the user.
+//
+// The log entry of a session records the policy that decided its outcome, if any.
+
+// PolicyKind is the kind of a DisclosurePolicy.
+type PolicyKind string
+
+const (
+	// Disclose the first candidate of each disjunction without asking for permission, if the
+	// session is a disclosure session with the IRMA server at the Origin (and of the Requestor,
+	// if set) and these are all among the Attributes
+	PolicyApprove = PolicyKind("approve")
+	// Put the attributes of the Credential first among the candidates of disjunctions with the Label
+	PolicyPrefer = PolicyKind("prefer")
+	// Never disclose the Attributes
+	PolicyDeny = PolicyKind("deny")
+)
+
+// DisclosurePolicy is a rule that the client applies to disclosure requests. Which of its
+// fields are used depends on its Kind. Requestor and Label restrict the sessions and disjunctions
+// to which a prefer or deny policy applies, and match all requestors or disjunctions if empty;
+// approve policies are restricted to the sessions with the IRMA server at their Origin, and
+// additionally to those of their Requestor if set.
+// Attributes may also contain credential type identifiers, matching all attributes of the credential.
+type DisclosurePolicy struct {
+	ID         string // Assigned by AddDisclosurePolicy
+	Kind       PolicyKind
+	Requestor  string                         `json:",omitempty"`
+	Origin     string                         `json:",omitempty"` // Host (and port, if not 443) of the IRMA server, for approve policies
+	Label      string                         `json:",omitempty"`
+	Attributes []irma.AttributeTypeIdentifier `json:",omitempty"`
+	Credential irma.CredentialTypeIdentifier
+}
+
+// DisclosurePolicies returns the disclosure policies of the client.
+func (client *Client) DisclosurePolicies() []*DisclosurePolicy {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return append([]*DisclosurePolicy{}, client.Preferences.DisclosurePolicies...)
+}
+
+// AddDisclosurePolicy checks the policy, assigns it an ID, and adds it to the disclosure policies.
+func (client *Client) AddDisclosurePolicy(policy *DisclosurePolicy) error {
+	switch policy.Kind {
+	case PolicyApprove:
+		if policy.Origin == "" || len(policy.Attributes) == 0 {
+			return errors.New("Approve policy requires an origin and attributes")
+		}
+		origin := sessionOrigin("https://" + policy.Origin)
+		if origin == "" {
+			return errors.Errorf("Invalid origin %s", policy.Origin)
+		}
+		policy.Origin = origin
+	case PolicyPrefer:
+		if policy.Credential.String() == "" {
+			return errors.New("Prefer policy requires a credential type")
+		}
+	case PolicyDeny:
+		if len(policy.Attributes) == 0 {
+			return errors.New("Deny policy requires attributes")
+		}
+	default:
+		return errors.Errorf("Unknown policy kind %s", policy.Kind)
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	id := 0
+	for _, p := range client.Preferences.DisclosurePolicies {
+		if i, err := strconv.Atoi(p.ID); err == nil && i > id {
+			id = i
+		}
+	}
+	policy.ID = strconv.Itoa(id + 1)
+	// Don't modify the existing slice, which may be shared with the stored preferences
+	policies := append([]*DisclosurePolicy{}, client.Preferences.DisclosurePolicies...)
+	client.Preferences.DisclosurePolicies = append(policies, policy)
+	return client.storePreferences()
+}
+
+// RemoveDisclosurePolicy removes the disclosure policy with the specified ID.
+func (client *Client) RemoveDisclosurePolicy(id string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	policies := []*DisclosurePolicy{}
+	for _, policy := range client.Preferences.DisclosurePolicies {
+		if policy.ID != id {
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) == len(client.Preferences.DisclosurePolicies) {
+		return errors.Errorf("Disclosure policy %s not found", id)
+	}
+	client.Preferences.DisclosurePolicies = policies
+	return client.storePreferences()
+}
+
+// covers returns whether the attribute is one of the attributes of the policy.
+func (policy *DisclosurePolicy) covers(attr irma.AttributeTypeIdentifier) bool {
+	for _, id := range policy.Attributes {
+		if id == attr || (id.IsCredential() && credentialTypeOf(id) == credentialTypeOf(attr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *DisclosurePolicy) appliesTo(requestor string, disjunction *irma.AttributeDisjunction) bool {
+	return (policy.Requestor == "" || policy.Requestor == requestor) &&
+		(policy.Label == "" || policy.Label == disjunction.Label)
+}
+
+// applyDisclosurePolicies removes the candidates that deny policies forbid disclosing to the
+// requestor, and puts the candidates preferred by prefer policies first. Disjunctions left without
+// candidates are added to missing. If that happens, the deny policy responsible is returned.
+func (client *Client) applyDisclosurePolicies(
+	requestor string,
+	disjunctions irma.AttributeDisjunctionList,
+	candidates [][]*irma.AttributeIdentifier,
+	missing irma.AttributeDisjunctionList,
+) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList, *DisclosurePolicy) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	var decided *DisclosurePolicy
+	for i, disjunction := range disjunctions {
+		if len(candidates[i]) == 0 {
+			continue // Already missing
+		}
+		for _, policy := range client.Preferences.DisclosurePolicies {
+			if policy.Kind != PolicyDeny || !policy.appliesTo(requestor, disjunction) {
+				continue
+			}
+			allowed := []*irma.AttributeIdentifier{}
+			for _, candidate := range candidates[i] {
+				if !policy.covers(candidate.Type) {
+					allowed = append(allowed, candidate)
+				}
+			}
+			candidates[i] = allowed
+			if len(allowed) == 0 {
+				missing = append(missing, disjunction)
+				decided = policy
+				break
+			}
+		}
+		for _, policy := range client.Preferences.DisclosurePolicies {
+			if policy.Kind != PolicyPrefer || !policy.appliesTo(requestor, disjunction) {
+				continue
+			}
+			preferred, others := []*irma.AttributeIdentifier{}, []*irma.AttributeIdentifier{}
+			for _, candidate := range candidates[i] {
+				if credentialTypeOf(candidate.Type) == policy.Credential {
+					preferred = append(preferred, candidate)
+				} else {
+					others = append(others, candidate)
+				}
+			}
+			candidates[i] = append(preferred, others...)
+		}
+	}
+	return candidates, missing, decided
+}
+
+// choiceAllowed returns whether the choice discloses one of the candidates of each disjunction,
+// so that the handler cannot disclose attributes that deny policies removed from the candidates.
+func choiceAllowed(choice *irma.DisclosureChoice, candidates [][]*irma.AttributeIdentifier) bool {
+	var attrs []*irma.AttributeIdentifier
+	if choice != nil {
+		attrs = choice.Attributes
+	}
+	if len(attrs) != len(candidates) {
+		return false
+	}
+	for i, attr := range attrs {
+		found := false
+		for _, candidate := range candidates[i] {
+			if attr != nil && *candidate == *attr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionOrigin returns the origin of the IRMA server at the session URL to which approve
+// policies are bound: its host in lower case, and its port if that is not the default 443.
+// It returns the empty string if the server is not authenticated by TLS.
+func sessionOrigin(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != "443" {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+// approvingPolicy returns the approve policy that allows disclosing the first candidate of each
+// disjunction in the session with the IRMA server at the URL without asking for permission,
+// along with that choice, if any.
+func (client *Client) approvingPolicy(
+	action irma.Action, serverURL string, requestor string, candidates [][]*irma.AttributeIdentifier,
+) (*DisclosurePolicy, *irma.DisclosureChoice) {
+	origin := sessionOrigin(serverURL)
+	if action != irma.ActionDisclosing || origin == "" || len(candidates) == 0 {
+		return nil, nil
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	for _, policy := range client.Preferences.DisclosurePolicies {
+		if policy.Kind != PolicyApprove || policy.Origin != origin {
+			continue
+		}
+		if policy.Requestor != "" && policy.Requestor != requestor {
+			continue
+		}
+		choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+		for _, list := range candidates {
+			if len(list) == 0 || !policy.covers(list[0].Type) {
+				choice = nil
+				break
+			}
+			choice.Attributes = append(choice.Attributes, list[0])
+		}
+		if choice != nil {
+			return policy, choice
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,376 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the checkpointing and resuming of interactive sessions.
+//
+// Mobile operating systems may kill the app while the user switches to another app during
+// a session, e.g. to look up a PIN or an email code. So that such a session need not be lost,
+// we save a checkpoint of it to storage when asking the user for permission, which we update
+// when the user gives permission. It contains everything needed to continue the session with
+// the server, and is removed when the session finishes. After a restart, ResumableSessions
+// lists the checkpoints of interrupted sessions, which can then be continued with
+// ResumeSession or discarded with DiscardSession. Checkpoints of sessions that have expired
+// are pruned by New and when checkpointing another session, and logged as failed. While a
+// session is running, the client keeps track of its checkpoint, so that it is not resumed
+// a second time concurrently.
+
+// sessionCheckpointLifetime is the age after which a checkpointed session is no longer
+// resumed, as by then the server will have timed out the session.
+const sessionCheckpointLifetime = 10 * time.Minute
+
+// SessionCheckpoint contains the state of an interactive session from which it can be resumed.
+type SessionCheckpoint struct {
+	ServerURL string                 `json:"url"`
+	Action    irma.Action            `json:"action"`
+	Version   irma.Version           `json:"version"`
+	Info      *logSessionInfo        `json:"info"`
+	Choice    *irma.DisclosureChoice `json:"choice,omitempty"` // Set once the user has given permission
+	LogGroup  string                 `json:"group,omitempty"`
+	Created   irma.Timestamp         `json:"created"`
+}
+
+// ResumableSession describes an interrupted session, which can be resumed with ResumeSession.
+type ResumableSession struct {
+	ID        string
+	Action    irma.Action
+	Requestor string // Empty if the request could not be parsed
+	Created   time.Time
+	Permitted bool // Whether the user already gave permission for the session
+	Expired   bool // If true, resuming the session will fail
+}
+
+func (checkpoint *SessionCheckpoint) expired() bool {
+	return time.Since(time.Time(checkpoint.Created)) > sessionCheckpointLifetime
+}
+
+// expiredLogEntry returns the log entry of the checkpointed session, having expired.
+func (checkpoint *SessionCheckpoint) expiredLogEntry() *LogEntry {
+	entry := &LogEntry{
+		Type:      checkpoint.Action,
+		Time:      irma.Timestamp(time.Now()),
+		Group:     checkpoint.LogGroup,
+		Outcome:   LogOutcomeFailure,
+		ErrorType: irma.ErrorSessionExpired,
+	}
+	if checkpoint.Info != nil && checkpoint.Info.Jwt != "" {
+		entry.SessionInfo = checkpoint.Info.sessionInfo()
+	}
+	return entry
+}
+
+func newCheckpointID() string {
+	bts := make([]byte, 16)
+	_, _ = rand.Read(bts)
+	return hex.EncodeToString(bts)
+}
+
+// checkpoint saves the current state of an interactive session to storage, so that it can
+// be resumed if we are interrupted.
+func (session *session) checkpoint() {
+	if !session.IsInteractive() || session.info == nil {
+		return
+	}
+	if session.checkpointID == "" {
+		session.checkpointID = newCheckpointID()
+		session.client.lock.Lock()
+		session.client.liveCheckpoints[session.checkpointID] = true
+		session.client.lock.Unlock()
+	}
+	// Failing to save the checkpoint just means that the session cannot be resumed
+	// after an interruption, so we carry on with the session regardless
+	_ = session.client.storeCheckpoint(session.checkpointID, &SessionCheckpoint{
+		ServerURL: session.ServerURL,
+		Action:    session.Action,
+		Version:   session.Version,
+		Info:      newLogSessionInfo(session.info),
+		Choice:    session.choice,
+		LogGroup:  session.logGroup,
+		Created:   irma.Timestamp(time.Now()),
+	})
+}
+
+// releaseCheckpoint marks the checkpoint of the session, if any, as no longer in use by
+// a running session, keeping it in storage so that the session can be resumed later.
+func (session *session) releaseCheckpoint() {
+	if session.checkpointID == "" {
+		return
+	}
+	session.client.lock.Lock()
+	delete(session.client.liveCheckpoints, session.checkpointID)
+	session.client.lock.Unlock()
+	session.checkpointID = ""
+}
+
+// removeCheckpoint removes the checkpoint of the session, if any, from storage.
+func (session *session) removeCheckpoint() {
+	if session.checkpointID == "" {
+		return
+	}
+	_ = session.client.removeCheckpoint(session.checkpointID) // TODO err
+	session.checkpointID = ""
+}
+
+// storeCheckpoint saves the checkpoint under the specified ID, keeping the creation time of
+// the checkpoint that it replaces, if any.
+func (client *Client) storeCheckpoint(id string, checkpoint *SessionCheckpoint) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	checkpoints, err := client.storage.LoadSessionCheckpoints()
+	if err != nil {
+		return err
+	}
+	if existing, ok := checkpoints[id]; ok {
+		checkpoint.Created = existing.Created
+		delete(checkpoints, id) // The session is still running, so we don't prune it
+	}
+	expired := pruneCheckpoints(checkpoints)
+	checkpoints[id] = checkpoint
+	if err = client.storage.StoreSessionCheckpoints(checkpoints); err != nil {
+		return err
+	}
+	return client.logExpiredCheckpoints(expired)
+}
+
+// pruneCheckpoints removes the checkpoints of expired sessions from the map, returning them.
+func pruneCheckpoints(checkpoints map[string]*SessionCheckpoint) []*SessionCheckpoint {
+	var expired []*SessionCheckpoint
+	for id, checkpoint := range checkpoints {
+		if checkpoint.expired() {
+			expired = append(expired, checkpoint)
+			delete(checkpoints, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return time.Time(expired[i].Created).Before(time.Time(expired[j].Created))
+	})
+	return expired
+}
+
+// logExpiredCheckpoints logs the sessions of the pruned checkpoints as expired,
+// as resuming them would have.
+func (client *Client) logExpiredCheckpoints(expired []*SessionCheckpoint) error {
+	for _, checkpoint := range expired {
+		if err := client.addLogEntry(checkpoint.expiredLogEntry()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeExpiredCheckpoints removes the checkpoints of expired sessions from storage.
+func (client *Client) removeExpiredCheckpoints() error {
+	checkpoints, err := client.storage.LoadSessionCheckpoints()
+	if err != nil {
+		return err
+	}
+	expired := pruneCheckpoints(checkpoints)
+	if len(expired) == 0 {
+		return nil
+	}
+	if err = client.storage.StoreSessionCheckpoints(checkpoints); err != nil {
+		return err
+	}
+	return client.logExpiredCheckpoints(expired)
+}
+
+func (client *Client) removeCheckpoint(id string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	delete(client.liveCheckpoints, id)
+
+	checkpoints, err := client.storage.LoadSessionCheckpoints()
+	if err != nil {
+		return err
+	}
+	if _, ok := checkpoints[id]; !ok {
+		return nil
+	}
+	delete(checkpoints, id)
+	return client.storage.StoreSessionCheckpoints(checkpoints)
+}
+
+// loadCheckpoint returns the checkpoint with the specified ID, or nil if there is none.
+// If claim is true, it is marked as in use by a session, unless another running session
+// already uses it, in which case an error is returned.
+func (client *Client) loadCheckpoint(id string, claim bool) (*SessionCheckpoint, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.liveCheckpoints[id] {
+		return nil, errors.Errorf("Session %s is still running", id)
+	}
+	checkpoints, err := client.storage.LoadSessionCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := checkpoints[id]
+	if claim && checkpoint != nil {
+		client.liveCheckpoints[id] = true
+	}
+	return checkpoint, nil
+}
+
+// ResumableSessions returns the interrupted sessions that were checkpointed, oldest first.
+// Sessions that are still running in this process are not included.
+func (client *Client) ResumableSessions() ([]*ResumableSession, error) {
+	client.lock.Lock()
+	checkpoints, err := client.storage.LoadSessionCheckpoints()
+	for id := range client.liveCheckpoints {
+		delete(checkpoints, id)
+	}
+	client.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*ResumableSession, 0, len(checkpoints))
+	for id, checkpoint := range checkpoints {
+		rs := &ResumableSession{
+			ID:        id,
+			Action:    checkpoint.Action,
+			Created:   time.Time(checkpoint.Created),
+			Permitted: checkpoint.Choice != nil,
+			Expired:   checkpoint.expired(),
+		}
+		if checkpoint.Info != nil {
+			if jwt, err := irma.ParseRequestorJwt(checkpoint.Action, checkpoint.Info.Jwt); err == nil {
+				rs.Requestor = jwt.Requestor()
+			}
+		}
+		sessions = append(sessions, rs)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+// DiscardSession removes the checkpoint of the specified interrupted session,
+// and informs the server that we will not finish the session.
+func (client *Client) DiscardSession(id string) error {
+	checkpoint, err := client.loadCheckpoint(id, false)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		return errors.Errorf("Session %s not found", id)
+	}
+	if !checkpoint.expired() {
+		irma.NewHTTPTransport(checkpoint.ServerURL).Delete()
+	}
+	return client.removeCheckpoint(id)
+}
+
+// ResumeSession continues the specified interrupted session using the specified handler.
+// If the user already gave permission for the session and we still have the chosen attributes,
+// the session continues where it was interrupted; otherwise the handler is asked for permission
+// again. If the session has expired or was already finished, handler.Failure() is called with
+// an irma.ErrorSessionExpired or irma.ErrorSessionAnswered error, respectively, and the
+// checkpoint is removed. Sessions that are still running cannot be resumed.
+func (client *Client) ResumeSession(id string, handler Handler) SessionDismisser {
+	checkpoint, err := client.loadCheckpoint(id, true)
+	if err != nil {
+		handler.Failure(irma.ActionUnknown, &irma.SessionError{Err: err})
+		return nil
+	}
+	if checkpoint == nil {
+		handler.Failure(irma.ActionUnknown, &irma.SessionError{ErrorType: irma.ErrorSessionExpired, Info: id})
+		return nil
+	}
+	if checkpoint.Info == nil {
+		client.lock.Lock()
+		delete(client.liveCheckpoints, id)
+		client.lock.Unlock()
+		handler.Failure(irma.ActionUnknown, &irma.SessionError{ErrorType: irma.ErrorSessionExpired, Info: id})
+		return nil
+	}
+
+	session := &session{
+		ServerURL:    checkpoint.ServerURL,
+		transport:    irma.NewHTTPTransport(checkpoint.ServerURL),
+		Action:       checkpoint.Action,
+		Version:      checkpoint.Version,
+		Handler:      handler,
+		client:       client,
+		info:         checkpoint.Info.sessionInfo(),
+		logGroup:     checkpoint.LogGroup,
+		checkpointID: id,
+	}
+	go session.resume(checkpoint)
+	return session
+}
+
+// resume checks that the server still awaits our response to the checkpointed session,
+// and if so continues the session.
+func (session *session) resume(checkpoint *SessionCheckpoint) {
+	defer session.panicFailure()
+
+	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+
+	if checkpoint.expired() {
+		session.expire(&irma.SessionError{ErrorType: irma.ErrorSessionExpired})
+		return
+	}
+
+	var status string
+	if err := session.transport.Get("status", &status); err != nil {
+		serr := err.(*irma.SessionError)
+		if serr.Status == http.StatusNotFound || (serr.ApiError != nil && serr.ApiError.ErrorName == "SESSION_UNKNOWN") {
+			session.expire(&irma.SessionError{ErrorType: irma.ErrorSessionExpired, Err: serr})
+			return
+		}
+		// We keep the checkpoint, so that resuming can be retried e.g. once we are online again
+		session.releaseCheckpoint()
+		session.Handler.Failure(session.Action, serr)
+		return
+	}
+	switch strings.Trim(status, `"`) {
+	case "DONE":
+		session.expire(&irma.SessionError{ErrorType: irma.ErrorSessionAnswered})
+		return
+	case "CANCELLED":
+		session.expire(&irma.SessionError{ErrorType: irma.ErrorSessionExpired})
+		return
+	}
+
+	session.processSessionInfo(checkpoint.Choice)
+}
+
+// expire ends a resumed session that the server no longer awaits.
+func (session *session) expire(err *irma.SessionError) {
+	session.done = true // Nothing to DELETE at the server
+	session.removeCheckpoint()
+	session.logOutcome(LogOutcomeFailure, err)
+	session.Handler.Failure(session.Action, err)
+}
+
+// choiceAvailable returns whether all attributes of the choice are among the candidates.
+func choiceAvailable(choice *irma.DisclosureChoice, candidates [][]*irma.AttributeIdentifier) bool {
+	for _, attr := range choice.Attributes {
+		found := false
+		for _, list := range candidates {
+			for _, candidate := range list {
+				if *candidate == *attr {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -3,9 +3,10 @@ package irmaclient
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 
 	"math/big"
 
@@ -25,7 +26,9 @@ type PermissionHandler func(proceed bool, choice *irma.DisclosureChoice)
 // PinHandler is used to provide the user's PIN code.
 type PinHandler func(proceed bool, pin string)
 
-// A Handler contains callbacks for communication to the user.
+// A Handler contains callbacks for communication to the user. If the server continues a
+// session with a follow-up session, the callbacks of both are made on the same Handler, and
+// Success is called only once the last session of the chain has finished.
 type Handler interface {
 	StatusUpdate(action irma.Action, status irma.Status)
 	Success(action irma.Action, result string)
@@ -60,6 +63,26 @@ type session struct {
 	downloaded  *irma.IrmaIdentifierSet
 	irmaSession irma.IrmaSession
 	done        bool
+	logged      bool
+
+	// Issuance state of this session, created when computing the issuance commitments
+	state *IssuanceState
+
+	// ID of the checkpoint of this session in storage, if any (see resume.go)
+	checkpointID string
+
+	// Disclosure policy that decided the outcome of this session, if any (see policies.go)
+	policy *DisclosurePolicy
+
+	// Session chaining: previous is the session after which this one was started
+	// by the server, and next is set when this session started a follow-up session.
+	// All sessions in a chain share the same log group. As next is set by the session
+	// goroutine and read by Dismiss(), it and dismissed are guarded by lock.
+	previous  *session
+	next      *session
+	dismissed bool
+	lock      sync.Mutex
+	logGroup  string
 
 	// These are empty on manual sessions
 	ServerURL string
@@ -78,18 +101,12 @@ var supportedVersions = map[int][]int{
 
 func calcVersion(qr *irma.Qr) (string, error) {
 	// Parse range supported by server
-	var minmajor, minminor, maxmajor, maxminor int
-	var err error
-	if minmajor, err = strconv.Atoi(string(qr.ProtocolVersion[0])); err != nil {
-		return "", err
-	}
-	if minminor, err = strconv.Atoi(string(qr.ProtocolVersion[2])); err != nil {
-		return "", err
-	}
-	if maxmajor, err = strconv.Atoi(string(qr.ProtocolMaxVersion[0])); err != nil {
+	minmajor, minminor, err := irma.ParseProtocolVersion(qr.ProtocolVersion)
+	if err != nil {
 		return "", err
 	}
-	if maxminor, err = strconv.Atoi(string(qr.ProtocolMaxVersion[2])); err != nil {
+	maxmajor, maxminor, err := irma.ParseProtocolVersion(qr.ProtocolMaxVersion)
+	if err != nil {
 		return "", err
 	}
 
@@ -125,7 +142,10 @@ func (session *session) getBuilders() (gabi.ProofBuilderList, error) {
 	case irma.ActionDisclosing:
 		builders, err = session.client.ProofBuilders(session.choice)
 	case irma.ActionIssuing:
-		builders, err = session.client.IssuanceProofBuilders(session.irmaSession.(*irma.IssuanceRequest))
+		if session.state, err = NewIssuanceState(); err != nil {
+			return nil, err
+		}
+		builders, err = session.client.IssuanceProofBuilders(session.irmaSession.(*irma.IssuanceRequest), session.state)
 	}
 
 	return builders, err
@@ -141,7 +161,10 @@ func (session *session) getProof() (interface{}, error) {
 	case irma.ActionDisclosing:
 		message, err = session.client.Proofs(session.choice, session.irmaSession, false)
 	case irma.ActionIssuing:
-		message, err = session.client.IssueCommitments(session.irmaSession.(*irma.IssuanceRequest))
+		if session.state, err = NewIssuanceState(); err != nil {
+			return nil, err
+		}
+		message, err = session.client.IssueCommitments(session.irmaSession.(*irma.IssuanceRequest), session.state)
 	}
 
 	return message, err
@@ -150,14 +173,17 @@ func (session *session) getProof() (interface{}, error) {
 // checkKeyshareEnrollment checks if we are enrolled into all involved keyshare servers,
 // and aborts the session if not
 func (session *session) checkKeyshareEnrollment() bool {
+	managers := session.client.schemeManagersCopy()
 	for id := range session.irmaSession.Identifiers().SchemeManagers {
-		manager, ok := session.client.Configuration.SchemeManagers[id]
+		manager, ok := managers[id]
 		if !ok {
 			session.Handler.Failure(session.Action, &irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: id.String()})
 			return false
 		}
 		distributed := manager.Distributed()
+		session.client.lock.Lock()
 		_, enrolled := session.client.keyshareServers[id]
+		session.client.lock.Unlock()
 		if distributed && !enrolled {
 			session.Handler.KeyshareEnrollmentMissing(id)
 			return false
@@ -168,6 +194,7 @@ func (session *session) checkKeyshareEnrollment() bool {
 
 func (session *session) panicFailure() {
 	if e := recover(); e != nil {
+		session.releaseCheckpoint()
 		if session.Handler != nil {
 			session.Handler.Failure(session.Action, panicToError(e))
 		}
@@ -176,8 +203,9 @@ func (session *session) panicFailure() {
 
 func (session *session) checkAndUpateConfiguration(client *Client) bool {
 	var err error
+	managers := client.schemeManagersCopy()
 	for id := range session.irmaSession.Identifiers().SchemeManagers {
-		manager, contains := client.Configuration.SchemeManagers[id]
+		manager, contains := managers[id]
 		if !contains {
 			session.fail(&irma.SessionError{
 				ErrorType: irma.ErrorUnknownSchemeManager,
@@ -196,11 +224,12 @@ func (session *session) checkAndUpateConfiguration(client *Client) bool {
 
 	// Check if we are enrolled into all involved keyshare servers
 	if !session.checkKeyshareEnrollment() {
+		session.releaseCheckpoint() // A resumed session can be resumed again after enrolling
 		return false
 	}
 
 	// Download missing credential types/issuers/public keys from the scheme manager
-	if session.downloaded, err = session.client.Configuration.Download(session.irmaSession.Identifiers()); err != nil {
+	if session.downloaded, err = client.downloadConfiguration(session.irmaSession.Identifiers()); err != nil {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 		return false
 	}
@@ -231,7 +260,10 @@ func (client *Client) NewManualSession(sigrequestJSONString string, handler Hand
 	}
 
 	candidates, missing := session.client.CheckSatisfiability(session.irmaSession.ToDisclose())
+	candidates, missing, session.policy = session.client.applyDisclosurePolicies(
+		"", session.irmaSession.ToDisclose(), candidates, missing)
 	if len(missing) > 0 {
+		session.logOutcome(LogOutcomeUnsatisfiable, nil)
 		session.Handler.UnsatisfiableRequest(session.Action, "E-mail request", missing)
 		// TODO: session.transport.Delete() on dialog cancel
 		return
@@ -240,6 +272,10 @@ func (client *Client) NewManualSession(sigrequestJSONString string, handler Hand
 
 	// Ask for permission to execute the session
 	callback := PermissionHandler(func(proceed bool, choice *irma.DisclosureChoice) {
+		if proceed && !choiceAllowed(choice, candidates) {
+			go session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidChoice})
+			return
+		}
 		session.choice = choice
 		session.irmaSession.SetDisclosureChoice(choice)
 		go session.do(proceed)
@@ -250,15 +286,33 @@ func (client *Client) NewManualSession(sigrequestJSONString string, handler Hand
 
 // NewSession creates and starts a new interactive IRMA session
 func (client *Client) NewSession(qr *irma.Qr, handler Handler) SessionDismisser {
+	session := client.newSession(qr, handler, nil)
+	if session == nil {
+		return nil
+	}
+	return session
+}
+
+// newSession creates and starts a new interactive IRMA session. If previous is not nil,
+// the new session is a follow-up session that the server of previous asked us to start.
+func (client *Client) newSession(qr *irma.Qr, handler Handler, previous *session) *session {
 	session := &session{
 		ServerURL: qr.URL,
 		transport: irma.NewHTTPTransport(qr.URL),
 		Action:    irma.Action(qr.Type),
 		Handler:   handler,
 		client:    client,
+		previous:  previous,
+	}
+	if previous != nil {
+		session.logGroup = previous.logGroup
 	}
 
 	if session.Action == irma.ActionSchemeManager {
+		if previous != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(session.Action)})
+			return nil
+		}
 		go session.managerSession()
 		return session
 	}
@@ -306,6 +360,14 @@ func (session *session) start() {
 		return
 	}
 
+	session.processSessionInfo(nil)
+}
+
+// processSessionInfo parses and checks the request contained in the first IRMA protocol message,
+// and asks the user for permission to perform it. If choice is not nil, the user already gave
+// permission before the session was interrupted, and we proceed with the chosen attributes
+// if we still have them.
+func (session *session) processSessionInfo(choice *irma.DisclosureChoice) {
 	var err error
 	session.jwt, err = irma.ParseRequestorJwt(session.Action, session.info.Jwt)
 	if err != nil {
@@ -329,31 +391,59 @@ func (session *session) start() {
 
 	if session.Action == irma.ActionIssuing {
 		ir := session.irmaSession.(*irma.IssuanceRequest)
-		for _, credreq := range ir.Credentials {
-			info, err := credreq.Info(session.client.Configuration)
-			if err != nil {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownCredentialType, Err: err})
-				return
-			}
-			ir.CredentialInfoList = append(ir.CredentialInfoList, info)
+		if err := session.client.credentialInfos(ir); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownCredentialType, Err: err})
+			return
 		}
 	}
 
 	candidates, missing := session.client.CheckSatisfiability(session.irmaSession.ToDisclose())
+	candidates, missing, session.policy = session.client.applyDisclosurePolicies(
+		session.jwt.Requestor(), session.irmaSession.ToDisclose(), candidates, missing)
 	if len(missing) > 0 {
+		session.logOutcome(LogOutcomeUnsatisfiable, nil)
+		session.removeCheckpoint() // In case we are resuming the session
 		session.Handler.UnsatisfiableRequest(session.Action, session.jwt.Requestor(), missing)
 		// TODO: session.transport.Delete() on dialog cancel
 		return
 	}
 	session.irmaSession.SetCandidates(candidates)
 
-	// Ask for permission to execute the session
+	// Ask for permission to execute the session. From here on, the session can be resumed
+	// if we are interrupted while the user is busy with this or with entering the PIN.
 	callback := PermissionHandler(func(proceed bool, choice *irma.DisclosureChoice) {
+		if proceed && !choiceAllowed(choice, candidates) {
+			go session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidChoice})
+			return
+		}
 		session.choice = choice
 		session.irmaSession.SetDisclosureChoice(choice)
+		if proceed {
+			session.checkpoint()
+		}
 		go session.do(proceed)
 	})
 	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
+
+	if choice != nil && choiceAvailable(choice, candidates) {
+		callback(true, choice)
+		return
+	}
+	// A follow-up session of a chain is approved along with the previous session only if the
+	// user saw it announced there; other follow-up sessions ask permission like any session.
+	if session.announced() {
+		callback(true, &irma.DisclosureChoice{})
+		return
+	}
+	policy, approved := session.client.approvingPolicy(session.Action, session.ServerURL, session.jwt.Requestor(), candidates)
+	if policy != nil {
+		session.policy = policy
+		callback(true, approved)
+		return
+	}
+
+	session.checkpoint()
+
 	switch session.Action {
 	case irma.ActionDisclosing:
 		session.Handler.RequestVerificationPermission(
@@ -369,6 +459,43 @@ func (session *session) start() {
 	}
 }
 
+// announced returns whether this is a follow-up issuance session that the user approved
+// together with the previous session of the chain: the request of the previous session must
+// have announced exactly the credentials of this session, and the user must have been asked
+// permission for it. As the requestor name in the JWT is not authenticated, this session must
+// also run at the same origin as the previous one.
+func (session *session) announced() bool {
+	previous := session.previous
+	if previous == nil || previous.policy != nil || session.Action != irma.ActionIssuing {
+		return false
+	}
+	var next *irma.IssuanceRequest
+	switch request := previous.irmaSession.(type) {
+	case *irma.DisclosureRequest:
+		next = request.Next
+	case *irma.SignatureRequest:
+		next = request.Next
+	}
+	origin := sessionOrigin(session.ServerURL)
+	if next == nil || origin == "" || origin != sessionOrigin(previous.ServerURL) {
+		return false
+	}
+
+	request := session.irmaSession.(*irma.IssuanceRequest)
+	if len(request.Disclose) != 0 || len(request.Credentials) != len(next.Credentials) {
+		return false
+	}
+	for i, cred := range request.Credentials {
+		announced := next.Credentials[i]
+		if cred.CredentialTypeID == nil || announced.CredentialTypeID == nil ||
+			*cred.CredentialTypeID != *announced.CredentialTypeID ||
+			!reflect.DeepEqual(cred.Attributes, announced.Attributes) {
+			return false
+		}
+	}
+	return true
+}
+
 func (session *session) do(proceed bool) {
 	defer session.panicFailure()
 
@@ -378,7 +505,7 @@ func (session *session) do(proceed bool) {
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
-	if !session.irmaSession.Identifiers().Distributed(session.client.Configuration) {
+	if !session.client.distributed(session.irmaSession.Identifiers()) {
 		message, err := session.getProof()
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
@@ -389,15 +516,16 @@ func (session *session) do(proceed bool) {
 		builders, err := session.getBuilders()
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			return
 		}
 		startKeyshareSession(
 			session,
 			session.Handler,
 			builders,
 			session.irmaSession,
-			session.client.Configuration,
-			session.client.keyshareServers,
-			session.client.state,
+			session.client.schemeManagersCopy(),
+			session.client.keyshareServersCopy(),
+			session.state,
 		)
 	}
 }
@@ -437,12 +565,40 @@ func (session *session) KeysharePinOK() {
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 }
 
-type disclosureResponse string
+// disclosureResponse is the reply of the server to our disclosure proofs. Older servers
+// send just a status string; servers supporting session chaining may instead send an
+// object containing the status as well as a follow-up session to perform next.
+type disclosureResponse struct {
+	Status string   `json:"status"`
+	Next   *irma.Qr `json:"next,omitempty"`
+}
+
+const disclosureResponseValid = "VALID"
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (dr *disclosureResponse) UnmarshalJSON(bytes []byte) error {
+	var status string
+	if err := json.Unmarshal(bytes, &status); err == nil {
+		*dr = disclosureResponse{Status: status}
+		return nil
+	}
+
+	temp := struct {
+		Status string   `json:"status"`
+		Next   *irma.Qr `json:"next"`
+	}{}
+	if err := json.Unmarshal(bytes, &temp); err != nil {
+		return err
+	}
+	*dr = disclosureResponse{Status: temp.Status, Next: temp.Next}
+	return nil
+}
 
 func (session *session) sendResponse(message interface{}) {
 	var log *LogEntry
 	var err error
 	var messageJson []byte
+	var next *irma.Qr
 
 	if session.IsInteractive() {
 		switch session.Action {
@@ -454,10 +610,13 @@ func (session *session) sendResponse(message interface{}) {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
-			if response != "VALID" {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)})
+			if response.Status != disclosureResponseValid {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: response.Status})
 				return
 			}
+			if next = response.Next; next != nil && session.logGroup == "" {
+				session.logGroup = newLogGroup()
+			}
 			log, _ = session.createLogEntry(message.(gabi.ProofList)) // TODO err
 		case irma.ActionIssuing:
 			response := []*gabi.IssueSignatureMessage{}
@@ -465,7 +624,7 @@ func (session *session) sendResponse(message interface{}) {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
-			if err = session.client.ConstructCredentials(response, session.irmaSession.(*irma.IssuanceRequest)); err != nil {
+			if err = session.client.ConstructCredentials(response, session.irmaSession.(*irma.IssuanceRequest), session.state); err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 				return
 			}
@@ -479,7 +638,11 @@ func (session *session) sendResponse(message interface{}) {
 		}
 	}
 
-	_ = session.client.addLogEntry(log) // TODO err
+	session.logged = true
+	session.removeCheckpoint()
+	if log != nil {
+		_ = session.client.appendLog(log) // TODO err
+	}
 	if !session.downloaded.Empty() {
 		session.client.handler.UpdateConfiguration(session.downloaded)
 	}
@@ -487,6 +650,29 @@ func (session *session) sendResponse(message interface{}) {
 		session.client.handler.UpdateAttributes()
 	}
 	session.done = true
+
+	// If the server wants us to continue with a follow-up session, we start it using
+	// the same handler, which will be informed of success once the chain is complete
+	if next != nil {
+		session.lock.Lock()
+		dismissed := session.dismissed
+		session.lock.Unlock()
+		if dismissed {
+			session.Handler.Cancelled(next.Type)
+			return
+		}
+
+		session.Handler.StatusUpdate(next.Type, irma.StatusCommunicating)
+		nextSession := session.client.newSession(next, session.Handler, session)
+		session.lock.Lock()
+		session.next = nextSession
+		dismissed = session.dismissed
+		session.lock.Unlock()
+		if dismissed && nextSession != nil {
+			nextSession.Dismiss()
+		}
+		return
+	}
 	session.Handler.Success(session.Action, string(messageJson))
 }
 
@@ -513,15 +699,19 @@ func (session *session) managerSession() {
 			session.Handler.Cancelled(session.Action) // No need to DELETE session here
 			return
 		}
-		if err := session.client.Configuration.InstallSchemeManager(manager); err != nil {
+		// Installing modifies the Configuration, which other sessions may be using
+		session.client.lock.Lock()
+		err := session.client.Configuration.InstallSchemeManager(manager)
+		if err == nil && manager.Distributed() {
+			session.client.UnenrolledSchemeManagers = session.client.unenrolledSchemeManagers()
+		}
+		session.client.lock.Unlock()
+		if err != nil {
 			session.Handler.Failure(session.Action, &irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 			return
 		}
 
-		// Update state and inform user of success
-		if manager.Distributed() {
-			session.client.UnenrolledSchemeManagers = session.client.unenrolledSchemeManagers()
-		}
+		// Inform user of success
 		session.client.handler.UpdateConfiguration(
 			&irma.IrmaIdentifierSet{
 				SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{manager.Identifier(): {}},
@@ -557,6 +747,7 @@ func (session *session) delete() bool {
 			session.transport.Delete()
 		}
 		session.done = true
+		session.removeCheckpoint()
 		return true
 	}
 	return false
@@ -564,6 +755,7 @@ func (session *session) delete() bool {
 
 func (session *session) fail(err *irma.SessionError) {
 	if session.delete() {
+		session.logOutcome(LogOutcomeFailure, err)
 		err.Err = errors.Wrap(err.Err, 0)
 		if session.downloaded != nil && !session.downloaded.Empty() {
 			session.client.handler.UpdateConfiguration(session.downloaded)
@@ -574,6 +766,7 @@ func (session *session) fail(err *irma.SessionError) {
 
 func (session *session) cancel() {
 	if session.delete() {
+		session.logOutcome(LogOutcomeCancelled, nil)
 		if session.downloaded != nil && !session.downloaded.Empty() {
 			session.client.handler.UpdateConfiguration(session.downloaded)
 		}
@@ -581,21 +774,35 @@ func (session *session) cancel() {
 	}
 }
 
+// Dismiss cancels the session, or if it has started a follow-up session, the follow-up session.
 func (session *session) Dismiss() {
+	session.lock.Lock()
+	session.dismissed = true
+	next := session.next
+	session.lock.Unlock()
+
+	if next != nil {
+		next.Dismiss()
+		return
+	}
 	session.cancel()
 }
 
-type issuanceState struct {
+// IssuanceState contains the state of an issuance session that is needed to construct
+// the new credentials: one is created with NewIssuanceState for each session, passed to
+// IssuanceProofBuilders or IssueCommitments, and then to ConstructCredentials.
+type IssuanceState struct {
 	nonce2   *big.Int
 	builders []*gabi.CredentialBuilder
 }
 
-func newIssuanceState() (*issuanceState, error) {
+// NewIssuanceState returns a new issuance state, with a fresh nonce.
+func NewIssuanceState() (*IssuanceState, error) {
 	nonce2, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[4096].Lstatzk)
 	if err != nil {
 		return nil, err
 	}
-	return &issuanceState{
+	return &IssuanceState{
 		nonce2:   nonce2,
 		builders: []*gabi.CredentialBuilder{},
 	}, nil
@@ -6,6 +6,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -339,3 +344,270 @@ func TestKeyshareSessions(t *testing.T) {
 
 	test.ClearTestStorage(t)
 }
+
+func TestDisclosureResponse(t *testing.T) {
+	var response disclosureResponse
+	require.NoError(t, json.Unmarshal([]byte(`"VALID"`), &response))
+	require.Equal(t, disclosureResponseValid, response.Status)
+	require.Nil(t, response.Next)
+
+	chained := `{"status":"VALID","next":{"u":"http://localhost:8088/irma_api_server/api/v2/issue/abc","irmaqr":"issuing","v":"2.0","vmax":"2.2"}}`
+	require.NoError(t, json.Unmarshal([]byte(chained), &response))
+	require.Equal(t, disclosureResponseValid, response.Status)
+	require.NotNil(t, response.Next)
+	require.Equal(t, irma.ActionIssuing, response.Next.Type)
+	require.Equal(t, "2.2", response.Next.ProtocolMaxVersion)
+}
+
+func TestChainedSession(t *testing.T) {
+	client := parseStorage(t)
+	bts, err := json.Marshal(irma.NewServiceProviderJwt("testsp", &irma.DisclosureRequest{Content: irma.AttributeDisjunctionList{}}))
+	require.NoError(t, err)
+	jwt := "eyJhbGciOiJub25lIn0." + base64.RawStdEncoding.EncodeToString(bts) + "."
+
+	// Server whose first disclosure session is followed by a second one
+	var lock sync.Mutex
+	var proofs []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/jwt"):
+			fmt.Fprintf(w, `{"jwt":"%s","nonce":1,"context":1,"keys":[]}`, jwt)
+		case strings.HasSuffix(r.URL.Path, "/proofs"):
+			lock.Lock()
+			proofs = append(proofs, r.URL.Path)
+			lock.Unlock()
+			if strings.HasPrefix(r.URL.Path, "/first/") {
+				fmt.Fprintf(w, `{"status":"VALID","next":{"u":"%s/second/","irmaqr":"disclosing","v":"2.0","vmax":"2.2"}}`, server.URL)
+			} else {
+				fmt.Fprint(w, `"VALID"`)
+			}
+		}
+	}))
+	defer server.Close()
+
+	// Success is reported once, after the follow-up session has finished
+	handler := TestHandler{t: t, c: make(chan *irma.SessionError, 2), client: client}
+	client.NewSession(&irma.Qr{URL: server.URL + "/first/", Type: irma.ActionDisclosing, ProtocolVersion: "2.0", ProtocolMaxVersion: "2.2"}, handler)
+	serr := <-handler.c
+	require.Nil(t, serr, "%v", serr)
+	lock.Lock()
+	require.Equal(t, []string{"/first/proofs", "/second/proofs"}, proofs)
+	lock.Unlock()
+	select {
+	case err := <-handler.c:
+		t.Fatal("Unexpected second outcome", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	test.ClearTestStorage(t)
+}
+
+func TestAnnouncedFollowUp(t *testing.T) {
+	credential := func(value string) *irma.CredentialRequest {
+		id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+		return &irma.CredentialRequest{CredentialTypeID: &id, Attributes: map[string]string{"studentID": value}}
+	}
+	previous := &session{
+		ServerURL: "https://example.com/irma/session/abc/",
+		Action:    irma.ActionDisclosing,
+		irmaSession: &irma.DisclosureRequest{
+			Next: &irma.IssuanceRequest{Credentials: []*irma.CredentialRequest{credential("456")}},
+		},
+	}
+	followUp := func(url string, value string) *session {
+		return &session{
+			ServerURL:   url,
+			Action:      irma.ActionIssuing,
+			previous:    previous,
+			irmaSession: &irma.IssuanceRequest{Credentials: []*irma.CredentialRequest{credential(value)}},
+		}
+	}
+
+	require.True(t, followUp("https://example.com/irma/session/def/", "456").announced())
+	require.False(t, followUp("https://example.com/irma/session/def/", "789").announced(), "other attributes")
+	require.False(t, followUp("https://example.org/irma/session/def/", "456").announced(), "other origin")
+	require.False(t, followUp("http://example.com/irma/session/def/", "456").announced(), "unauthenticated origin")
+
+	previous.policy = &DisclosurePolicy{}
+	require.False(t, followUp("https://example.com/irma/session/def/", "456").announced(), "not shown to the user")
+	previous.policy = nil
+
+	previous.irmaSession = &irma.DisclosureRequest{}
+	require.False(t, followUp("https://example.com/irma/session/def/", "456").announced(), "not announced")
+}
+
+func TestCalcVersion(t *testing.T) {
+	version, err := calcVersion(&irma.Qr{ProtocolVersion: "2.0", ProtocolMaxVersion: "2.2"})
+	require.NoError(t, err)
+	require.Equal(t, "2.2", version)
+
+	version, err = calcVersion(&irma.Qr{ProtocolVersion: "2.0", ProtocolMaxVersion: "2.1"})
+	require.NoError(t, err)
+	require.Equal(t, "2.1", version)
+
+	_, err = calcVersion(&irma.Qr{ProtocolVersion: "3.0", ProtocolMaxVersion: "3.1"})
+	require.Error(t, err)
+
+	// Malformed versions should result in an error instead of a panic
+	_, err = calcVersion(&irma.Qr{ProtocolVersion: "2", ProtocolMaxVersion: ""})
+	require.Error(t, err)
+}
+
+// resumeHandler refuses permission, reporting the request on the permission channel.
+type resumeHandler struct {
+	TestHandler
+	permission chan irma.DisclosureRequest
+}
+
+func (h resumeHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName string, callback PermissionHandler) {
+	h.permission <- request
+	callback(false, nil)
+}
+
+func TestResumeSession(t *testing.T) {
+	client := parseStorage(t)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	// Server that reports the session status, and notices when the session is cancelled
+	status := make(chan string, 1)
+	deleted := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `"%s"`, <-status)
+		case http.MethodDelete:
+			deleted <- true
+		}
+	}))
+	defer server.Close()
+
+	bts, err := json.Marshal(getDisclosureJwt("testsp", id))
+	require.NoError(t, err)
+	original := &session{
+		ServerURL: server.URL + "/",
+		Action:    irma.ActionDisclosing,
+		Version:   irma.Version("2.2"),
+		client:    client,
+		info: &irma.SessionInfo{
+			Jwt:     "eyJhbGciOiJub25lIn0." + base64.RawStdEncoding.EncodeToString(bts) + ".",
+			Nonce:   big.NewInt(1),
+			Context: big.NewInt(1),
+			Keys:    map[irma.IssuerIdentifier]int{},
+		},
+	}
+	original.checkpoint()
+
+	// Resume the session in a new client instance
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	sessions, err := client.ResumableSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, original.checkpointID, sessions[0].ID)
+	require.Equal(t, "testsp", sessions[0].Requestor)
+	require.False(t, sessions[0].Permitted)
+	require.False(t, sessions[0].Expired)
+
+	handler := resumeHandler{
+		TestHandler: TestHandler{t: t, c: make(chan *irma.SessionError, 1), client: client},
+		permission:  make(chan irma.DisclosureRequest, 1),
+	}
+	status <- "CONNECTED"
+	client.ResumeSession(original.checkpointID, handler)
+	request := <-handler.permission
+	require.Equal(t, id, request.Content[0].Attributes[0])
+	require.Empty(t, (<-handler.c).ErrorType) // Cancelled
+	require.True(t, <-deleted)
+	sessions, err = client.ResumableSessions()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// If the chosen attributes are no longer present, permission is asked again
+	original.checkpointID = ""
+	original.choice = &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{{Type: id, CredentialHash: "removed"}}}
+	original.checkpoint()
+	status <- "CONNECTED"
+	client.ResumeSession(original.checkpointID, handler)
+	<-handler.permission
+	require.Empty(t, (<-handler.c).ErrorType)
+	<-deleted
+
+	// Sessions that were finished or that expired cannot be resumed
+	original.checkpointID = ""
+	original.checkpoint()
+	status <- "DONE"
+	client.ResumeSession(original.checkpointID, handler)
+	require.Equal(t, irma.ErrorSessionAnswered, (<-handler.c).ErrorType)
+
+	original.checkpointID = ""
+	original.checkpoint()
+	checkpoint, err := client.loadCheckpoint(original.checkpointID, false)
+	require.NoError(t, err)
+	require.NoError(t, client.removeCheckpoint(original.checkpointID))
+	checkpoint.Created = irma.Timestamp(time.Now().Add(-2 * sessionCheckpointLifetime))
+	require.NoError(t, client.storeCheckpoint(original.checkpointID, checkpoint))
+	sessions, err = client.ResumableSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.True(t, sessions[0].Expired)
+	client.ResumeSession(original.checkpointID, handler)
+	require.Equal(t, irma.ErrorSessionExpired, (<-handler.c).ErrorType)
+
+	client.ResumeSession("nonexisting", handler)
+	require.Equal(t, irma.ErrorSessionExpired, (<-handler.c).ErrorType)
+	sessions, err = client.ResumableSessions()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	logs, err := client.QueryLogs(&LogQuery{Outcomes: []LogOutcome{LogOutcomeFailure}})
+	require.NoError(t, err)
+	require.Len(t, logs.Entries, 2)
+
+	// Expired checkpoints that were never resumed are pruned on startup, and logged as expired
+	require.NoError(t, client.storeCheckpoint(newCheckpointID(), checkpoint))
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &IgnoringClientHandler{})
+	require.NoError(t, err)
+	checkpoints, err := client.storage.LoadSessionCheckpoints()
+	require.NoError(t, err)
+	require.Empty(t, checkpoints)
+	logs, err = client.QueryLogs(&LogQuery{Outcomes: []LogOutcome{LogOutcomeFailure}})
+	require.NoError(t, err)
+	require.Len(t, logs.Entries, 3)
+	require.Equal(t, irma.ErrorSessionExpired, logs.Entries[2].ErrorType)
+	jwt, err := logs.Entries[2].Jwt()
+	require.NoError(t, err)
+	require.Equal(t, "testsp", jwt.Requestor())
+
+	// As are those of other sessions, when checkpointing a session
+	require.NoError(t, client.storeCheckpoint(newCheckpointID(), checkpoint))
+	original.checkpointID = ""
+	original.checkpoint()
+	checkpoints, err = client.storage.LoadSessionCheckpoints()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 1)
+	require.Contains(t, checkpoints, original.checkpointID)
+
+	// Sessions that are still running are neither listed nor resumed
+	original.client = client
+	original.checkpointID = ""
+	original.checkpoint()
+	sessions, err = client.ResumableSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.NotEqual(t, original.checkpointID, sessions[0].ID)
+	client.ResumeSession(original.checkpointID, handler)
+	serr := <-handler.c
+	require.Empty(t, serr.ErrorType)
+	require.Error(t, serr.Err)
+	require.Error(t, client.DiscardSession(original.checkpointID))
+
+	// Once the session is finished, its checkpoint can be discarded
+	original.removeCheckpoint()
+	sessions, err = client.ResumableSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.NoError(t, client.DiscardSession(sessions[0].ID))
+
+	test.ClearTestStorage(t)
+}
@@ -2,7 +2,6 @@ package irmaclient
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"os"
 
 	"github.com/mhe/gabi"
@@ -10,13 +9,66 @@ import (
 	"github.com/privacybydesign/irmago/internal/fs"
 )
 
-// This file contains the storage struct and its methods,
+// This file contains the Storage interface and its default, file-based implementation,
 // and some general filesystem functions.
 
-// Storage provider for a Client
-type storage struct {
-	storagePath   string
-	Configuration *irma.Configuration
+// Storage is a storage provider for a Client, in which it persists its secret key,
+// credentials, keyshare server enrollments, logs, preferences, update history and
+// checkpoints of interrupted sessions.
+// The default implementation, used by New(), stores JSON files in a directory;
+// NewMemoryStorage() returns an implementation that keeps everything in memory.
+//
+// Load methods return the zero value (and no error) if nothing was stored yet,
+// except LoadPreferences which then returns the default preferences.
+// A Client never calls the methods of its Storage concurrently, so implementations
+// need not be safe for concurrent use. All values passed to the Store methods can be
+// persisted by marshaling them to JSON, as the default implementation does.
+type Storage interface {
+	// EnsureStorageExists initializes the storage, ensuring that it is in a usable state.
+	EnsureStorageExists() error
+
+	LoadSecretKey() (*SecretKey, error)
+	LoadAttributes() ([]*irma.AttributeList, error)
+	LoadSignature(attrs *irma.AttributeList) (*gabi.CLSignature, error)
+	LoadKeyshareServers() (map[irma.SchemeManagerIdentifier]*KeyshareServer, error)
+	LoadPaillierKeys() (*PaillierPrivateKey, error)
+	LoadUpdates() ([]Update, error)
+	LoadPreferences() (Preferences, error)
+	LoadSessionCheckpoints() (map[string]*SessionCheckpoint, error)
+	LoadIssuanceJournal() (*IssuanceJournal, error)
+
+	StoreSecretKey(sk *SecretKey) error
+	StoreAttributes(attributes []*irma.AttributeList) error
+	StoreSignature(attrs *irma.AttributeList, signature *gabi.CLSignature) error
+	DeleteSignature(attrs *irma.AttributeList) error
+	StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer) error
+	StorePaillierKeys(key *PaillierPrivateKey) error
+	StoreUpdates(updates []Update) error
+	StorePreferences(prefs Preferences) error
+	StoreSessionCheckpoints(checkpoints map[string]*SessionCheckpoint) error
+
+	// The issuance journal (see journal.go) must be stored in a single atomic write.
+	StoreIssuanceJournal(journal *IssuanceJournal) error
+	DeleteIssuanceJournal() error
+
+	// Log entries are stored append-only, in the order in which they are appended.
+	// AppendLog assigns the entry an ID, higher than those of the entries already present,
+	// unless it already has one. IterateLogs calls the handler for each entry in order,
+	// until it returns false. UpdateLogs calls update for each entry and stores the changes
+	// it makes to the entry.
+	AppendLog(entry *LogEntry) error
+	IterateLogs(handler func(entry *LogEntry) bool) error
+	UpdateLogs(update func(entry *LogEntry)) error
+	DeleteLogs(remove func(entry *LogEntry) bool) error
+}
+
+// fileStorage is a Storage that stores JSON files in a directory,
+// optionally encrypted (see encryption.go).
+type fileStorage struct {
+	storagePath string
+	key         []byte   // Key under which files are encrypted, nil if they are not
+	oldKeys     [][]byte // Keys with which files may also be decrypted; nil accepts plaintext files
+	nextLogID   uint64   // ID of the next log entry, 0 if not yet determined
 }
 
 // Filenames in which we store stuff
@@ -26,12 +78,21 @@ const (
 	kssFile         = "kss"
 	paillierFile    = "paillier"
 	updatesFile     = "updates"
-	logsFile        = "logs"
+	logsFile        = "logs" // Log entries as stored by earlier versions
+	logEntriesFile  = "logentries"
 	preferencesFile = "preferences"
+	sessionsFile    = "sessions"
+	journalFile     = "issuance"
 	signaturesDir   = "sigs"
 )
 
-func (s *storage) path(p string) string {
+// NewFileStorage returns a Storage that stores JSON files in the specified directory.
+// This is the storage used by New().
+func NewFileStorage(storagePath string) Storage {
+	return &fileStorage{storagePath: storagePath}
+}
+
+func (s *fileStorage) path(p string) string {
 	return s.storagePath + "/" + p
 }
 
@@ -40,34 +101,34 @@ func (s *storage) path(p string) string {
 // NOTE: we do not create the folder if it does not exist!
 // Setting it up in a properly protected location (e.g., with automatic
 // backups to iCloud/Google disabled) is the responsibility of the user.
-func (s *storage) EnsureStorageExists() error {
+func (s *fileStorage) EnsureStorageExists() error {
 	if err := fs.AssertPathExists(s.storagePath); err != nil {
 		return err
 	}
 	return fs.EnsureDirectoryExists(s.path(signaturesDir))
 }
 
-func (s *storage) load(dest interface{}, path string) (err error) {
+func (s *fileStorage) load(dest interface{}, path string) (err error) {
 	exists, err := fs.PathExists(s.path(path))
 	if err != nil || !exists {
 		return
 	}
-	bytes, err := ioutil.ReadFile(s.path(path))
+	bytes, err := s.readFile(path)
 	if err != nil {
 		return
 	}
 	return json.Unmarshal(bytes, dest)
 }
 
-func (s *storage) store(contents interface{}, file string) error {
+func (s *fileStorage) store(contents interface{}, file string) error {
 	bts, err := json.Marshal(contents)
 	if err != nil {
 		return err
 	}
-	return fs.SaveFile(s.path(file), bts)
+	return s.writeFile(file, bts)
 }
 
-func (s *storage) signatureFilename(attrs *irma.AttributeList) string {
+func (s *fileStorage) signatureFilename(attrs *irma.AttributeList) string {
 	// We take the SHA256 hash over all attributes as the filename for the signature.
 	// This means that the signatures of two credentials that have identical attributes
 	// will be written to the same file, one overwriting the other - but that doesn't
@@ -76,52 +137,59 @@ func (s *storage) signatureFilename(attrs *irma.AttributeList) string {
 	return signaturesDir + "/" + attrs.Hash()
 }
 
-func (s *storage) DeleteSignature(attrs *irma.AttributeList) error {
+func (s *fileStorage) DeleteSignature(attrs *irma.AttributeList) error {
 	return os.Remove(s.path(s.signatureFilename(attrs)))
 }
 
-func (s *storage) StoreSignature(cred *credential) error {
-	return s.store(cred.Signature, s.signatureFilename(cred.AttributeList()))
+func (s *fileStorage) StoreSignature(attrs *irma.AttributeList, signature *gabi.CLSignature) error {
+	return s.store(signature, s.signatureFilename(attrs))
 }
 
-func (s *storage) StoreSecretKey(sk *secretKey) error {
+func (s *fileStorage) StoreSecretKey(sk *SecretKey) error {
 	return s.store(sk, skFile)
 }
 
-func (s *storage) StoreAttributes(attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList) error {
-	temp := []*irma.AttributeList{}
-	for _, attrlistlist := range attributes {
-		for _, attrlist := range attrlistlist {
-			temp = append(temp, attrlist)
-		}
-	}
-
-	return s.store(temp, attributesFile)
+func (s *fileStorage) StoreAttributes(attributes []*irma.AttributeList) error {
+	// The attributes are stored as a list of instances of AttributeList
+	return s.store(attributes, attributesFile)
 }
 
-func (s *storage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error {
+func (s *fileStorage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*KeyshareServer) error {
 	return s.store(keyshareServers, kssFile)
 }
 
-func (s *storage) StorePaillierKeys(key *paillierPrivateKey) error {
+func (s *fileStorage) StorePaillierKeys(key *PaillierPrivateKey) error {
 	return s.store(key, paillierFile)
 }
 
-func (s *storage) StoreLogs(logs []*LogEntry) error {
-	return s.store(logs, logsFile)
+func (s *fileStorage) StorePreferences(prefs Preferences) error {
+	return s.store(prefs, preferencesFile)
 }
 
-func (s *storage) StorePreferences(prefs Preferences) error {
-	return s.store(prefs, preferencesFile)
+func (s *fileStorage) StoreSessionCheckpoints(checkpoints map[string]*SessionCheckpoint) error {
+	return s.store(checkpoints, sessionsFile)
 }
 
-func (s *storage) StoreUpdates(updates []update) (err error) {
+func (s *fileStorage) StoreIssuanceJournal(journal *IssuanceJournal) error {
+	return s.store(journal, journalFile)
+}
+
+func (s *fileStorage) DeleteIssuanceJournal() error {
+	err := os.Remove(s.path(journalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStorage) StoreUpdates(updates []Update) (err error) {
 	return s.store(updates, updatesFile)
 }
 
-func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSignature, err error) {
+func (s *fileStorage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSignature, err error) {
 	sigpath := s.signatureFilename(attrs)
-	if err := fs.AssertPathExists(s.path(sigpath)); err != nil {
+	exists, err := fs.PathExists(s.path(sigpath))
+	if err != nil || !exists {
 		return nil, err
 	}
 	signature = new(gabi.CLSignature)
@@ -131,61 +199,37 @@ func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSi
 	return signature, nil
 }
 
-// LoadSecretKey retrieves and returns the secret key from storage, or if no secret key
-// was found in storage, it generates, saves, and returns a new secret key.
-func (s *storage) LoadSecretKey() (*secretKey, error) {
-	var err error
-	sk := &secretKey{}
-	if err = s.load(sk, skFile); err != nil {
-		return nil, err
-	}
-	if sk.Key != nil {
-		return sk, nil
-	}
-
-	if sk, err = generateSecretKey(); err != nil {
+// LoadSecretKey retrieves and returns the secret key from storage, or nil if
+// no secret key was found in storage.
+func (s *fileStorage) LoadSecretKey() (*SecretKey, error) {
+	sk := &SecretKey{}
+	if err := s.load(sk, skFile); err != nil {
 		return nil, err
 	}
-	if err = s.StoreSecretKey(sk); err != nil {
-		return nil, err
+	if sk.Key == nil {
+		return nil, nil
 	}
 	return sk, nil
 }
 
-func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
-	// The attributes are stored as a list of instances of AttributeList
-	temp := []*irma.AttributeList{}
-	if err = s.load(&temp, attributesFile); err != nil {
-		return
-	}
-
-	list = make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList)
-	for _, attrlist := range temp {
-		attrlist.MetadataAttribute = irma.MetadataFromInt(attrlist.Ints[0], s.Configuration)
-		id := attrlist.CredentialType()
-		var ct irma.CredentialTypeIdentifier
-		if id != nil {
-			ct = id.Identifier()
-		}
-		if _, contains := list[ct]; !contains {
-			list[ct] = []*irma.AttributeList{}
-		}
-		list[ct] = append(list[ct], attrlist)
+func (s *fileStorage) LoadAttributes() (list []*irma.AttributeList, err error) {
+	list = []*irma.AttributeList{}
+	if err = s.load(&list, attributesFile); err != nil {
+		return nil, err
 	}
-
 	return list, nil
 }
 
-func (s *storage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]*keyshareServer, err error) {
-	ksses = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
+func (s *fileStorage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]*KeyshareServer, err error) {
+	ksses = make(map[irma.SchemeManagerIdentifier]*KeyshareServer)
 	if err := s.load(&ksses, kssFile); err != nil {
 		return nil, err
 	}
 	return ksses, nil
 }
 
-func (s *storage) LoadPaillierKeys() (key *paillierPrivateKey, err error) {
-	key = new(paillierPrivateKey)
+func (s *fileStorage) LoadPaillierKeys() (key *PaillierPrivateKey, err error) {
+	key = new(PaillierPrivateKey)
 	if err := s.load(key, paillierFile); err != nil {
 		return nil, err
 	}
@@ -195,23 +239,139 @@ func (s *storage) LoadPaillierKeys() (key *paillierPrivateKey, err error) {
 	return key, nil
 }
 
-func (s *storage) LoadLogs() (logs []*LogEntry, err error) {
-	logs = []*LogEntry{}
-	if err := s.load(&logs, logsFile); err != nil {
-		return nil, err
-	}
-	return logs, nil
-}
-
-func (s *storage) LoadUpdates() (updates []update, err error) {
-	updates = []update{}
+func (s *fileStorage) LoadUpdates() (updates []Update, err error) {
+	updates = []Update{}
 	if err := s.load(&updates, updatesFile); err != nil {
 		return nil, err
 	}
 	return updates, nil
 }
 
-func (s *storage) LoadPreferences() (Preferences, error) {
+func (s *fileStorage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	return config, s.load(&config, preferencesFile)
 }
+
+func (s *fileStorage) LoadIssuanceJournal() (*IssuanceJournal, error) {
+	exists, err := fs.PathExists(s.path(journalFile))
+	if err != nil || !exists {
+		return nil, err
+	}
+	journal := &IssuanceJournal{}
+	if err = s.load(journal, journalFile); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (s *fileStorage) LoadSessionCheckpoints() (checkpoints map[string]*SessionCheckpoint, err error) {
+	checkpoints = make(map[string]*SessionCheckpoint)
+	if err := s.load(&checkpoints, sessionsFile); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// MigrateStorage copies all contents of one Storage to another, e.g. when switching
+// from the default file-based storage to a different implementation. Contents already
+// present in the destination are overwritten. The source is not modified.
+func MigrateStorage(from, to Storage) error {
+	if err := to.EnsureStorageExists(); err != nil {
+		return err
+	}
+
+	sk, err := from.LoadSecretKey()
+	if err != nil {
+		return err
+	}
+	if sk != nil {
+		if err = to.StoreSecretKey(sk); err != nil {
+			return err
+		}
+	}
+
+	attrs, err := from.LoadAttributes()
+	if err != nil {
+		return err
+	}
+	for _, attrlist := range attrs {
+		sig, err := from.LoadSignature(attrlist)
+		if err != nil {
+			return err
+		}
+		if sig == nil {
+			continue
+		}
+		if err = to.StoreSignature(attrlist, sig); err != nil {
+			return err
+		}
+	}
+	if err = to.StoreAttributes(attrs); err != nil {
+		return err
+	}
+
+	ksses, err := from.LoadKeyshareServers()
+	if err != nil {
+		return err
+	}
+	if err = to.StoreKeyshareServers(ksses); err != nil {
+		return err
+	}
+
+	paillier, err := from.LoadPaillierKeys()
+	if err != nil {
+		return err
+	}
+	if paillier != nil {
+		if err = to.StorePaillierKeys(paillier); err != nil {
+			return err
+		}
+	}
+
+	if err = to.DeleteLogs(func(*LogEntry) bool { return true }); err != nil {
+		return err
+	}
+	var appendErr error
+	err = from.IterateLogs(func(entry *LogEntry) bool {
+		appendErr = to.AppendLog(entry)
+		return appendErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if appendErr != nil {
+		return appendErr
+	}
+
+	updates, err := from.LoadUpdates()
+	if err != nil {
+		return err
+	}
+	if err = to.StoreUpdates(updates); err != nil {
+		return err
+	}
+
+	checkpoints, err := from.LoadSessionCheckpoints()
+	if err != nil {
+		return err
+	}
+	if err = to.StoreSessionCheckpoints(checkpoints); err != nil {
+		return err
+	}
+
+	journal, err := from.LoadIssuanceJournal()
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		if err = to.StoreIssuanceJournal(journal); err != nil {
+			return err
+		}
+	}
+
+	prefs, err := from.LoadPreferences()
+	if err != nil {
+		return err
+	}
+	return to.StorePreferences(prefs)
+}
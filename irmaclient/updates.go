@@ -6,6 +6,7 @@ import (
 	"html"
 	"io/ioutil"
 	"math/big"
+	"os"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -17,11 +18,19 @@ import (
 // This file contains the update mechanism for Client
 // as well as updates themselves.
 
-type update struct {
+// Update records the result of applying one of the client updates to the storage.
+type Update struct {
 	When    irma.Timestamp
 	Number  int
 	Success bool
 	Error   *string
+	Warning *string `json:",omitempty"` // Set if the update succeeded but skipped part of its work
+}
+
+// updateWarning can be returned by a client update that succeeded, but skipped part of its work;
+// it is recorded in the Warning of the Update instead of failing it.
+type updateWarning struct {
+	error
 }
 
 var clientUpdates = []func(client *Client) error{
@@ -38,7 +47,12 @@ var clientUpdates = []func(client *Client) error{
 
 	// Rename config -> preferences
 	func(client *Client) (err error) {
-		exists, err := fs.PathExists(client.storage.path("config"))
+		// Only the file storage can contain the old config file
+		s, ok := client.storage.(*fileStorage)
+		if !ok {
+			return nil
+		}
+		exists, err := fs.PathExists(s.path("config"))
 		if !exists || err != nil {
 			return
 		}
@@ -46,7 +60,7 @@ var clientUpdates = []func(client *Client) error{
 			SendCrashReports bool
 		}{}
 		// Load old file, convert to new struct, and save
-		err = client.storage.load(oldStruct, "config")
+		err = s.load(oldStruct, "config")
 		if err != nil {
 			return err
 		}
@@ -70,6 +84,53 @@ var clientUpdates = []func(client *Client) error{
 		}
 		return client.storage.StoreKeyshareServers(keyshareServers)
 	},
+
+	// Encrypt existing plaintext storage, if the app supplied a storage key
+	func(client *Client) error {
+		s, ok := client.storage.(*fileStorage)
+		if !ok || s.key == nil || !s.acceptsPlaintext() {
+			return nil
+		}
+		return s.reencrypt(s.key)
+	},
+
+	// Move log entries from the logs file to the append-only log entries file
+	func(client *Client) error {
+		s, ok := client.storage.(*fileStorage)
+		if !ok {
+			return nil
+		}
+		exists, err := fs.PathExists(s.path(logsFile))
+		if err != nil || !exists {
+			return err
+		}
+		logs, err := s.loadOldLogs()
+		if err != nil {
+			return err
+		}
+		// Remove the entries of an earlier, interrupted run of this update
+		if err = s.DeleteLogs(func(*LogEntry) bool { return true }); err != nil {
+			return err
+		}
+		for _, entry := range logs {
+			if err = s.AppendLog(entry); err != nil {
+				return err
+			}
+		}
+		return os.Remove(s.path(logsFile))
+	},
+
+	// Key disclosed attributes in log entries by attribute type instead of by proof index
+	func(client *Client) error {
+		return client.storage.UpdateLogs(func(entry *LogEntry) {
+			entry.migrateDisclosed(client.Configuration)
+		})
+	},
+
+	// Convert the log entries of the old Android app, which were not converted along with its credentials
+	func(client *Client) error {
+		return client.parseAndroidLogs()
+	},
 }
 
 // update performs any function from clientUpdates that has not
@@ -88,11 +149,16 @@ func (client *Client) update() error {
 		if clientUpdates[i] != nil {
 			err = clientUpdates[i](client)
 		}
-		u := update{
-			When:    irma.Timestamp(time.Now()),
-			Number:  i,
-			Success: err == nil,
+		u := Update{
+			When:   irma.Timestamp(time.Now()),
+			Number: i,
 		}
+		if warning, ok := err.(updateWarning); ok {
+			str := warning.Error()
+			u.Warning = &str
+			err = nil
+		}
+		u.Success = err == nil
 		if err != nil {
 			str := err.Error()
 			u.Error = &str
@@ -110,13 +176,10 @@ func (client *Client) update() error {
 	return err
 }
 
-// ParseAndroidStorage parses an Android cardemu.xml shared preferences file
-// from the old Android IRMA app, parsing its credentials into the current instance,
-// and saving them to storage.
-// CAREFUL: this method overwrites any existing secret keys and attributes on storage.
-func (client *Client) ParseAndroidStorage() (present bool, err error) {
+// androidPreferences returns the string preferences in the cardemu.xml of the old Android app, if present.
+func (client *Client) androidPreferences() (prefs []androidPreference, present bool, err error) {
 	if client.androidStoragePath == "" {
-		return false, nil
+		return nil, false, nil
 	}
 
 	cardemuXML := client.androidStoragePath + "/shared_prefs/cardemu.xml"
@@ -124,21 +187,85 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 	if err != nil || !present {
 		return
 	}
-	present = true
 
 	bytes, err := ioutil.ReadFile(cardemuXML)
 	if err != nil {
 		return
 	}
 	parsedxml := struct {
-		Strings []struct {
-			Name    string `xml:"name,attr"`
-			Content string `xml:",chardata"`
-		} `xml:"string"`
+		Strings []androidPreference `xml:"string"`
 	}{}
 	if err = xml.Unmarshal(bytes, &parsedxml); err != nil {
 		return
 	}
+	return parsedxml.Strings, true, nil
+}
+
+type androidPreference struct {
+	Name    string `xml:"name,attr"`
+	Content string `xml:",chardata"`
+}
+
+// parseAndroidLogs converts the log entries of the old Android app to our own log entries.
+// Entries that cannot be parsed are skipped, and reported as an updateWarning.
+func (client *Client) parseAndroidLogs() error {
+	prefs, present, err := client.androidPreferences()
+	if err != nil || !present {
+		return err
+	}
+	var warning error
+	for _, pref := range prefs {
+		if pref.Name != "logs" {
+			continue
+		}
+		logs, err := irma.ParseAndroidLogs([]byte(html.UnescapeString(pref.Content)))
+		if skipped, ok := err.(*irma.AndroidLogsError); ok {
+			warning = updateWarning{skipped}
+		} else if err != nil {
+			return err
+		}
+		for _, log := range logs {
+			entry := &LogEntry{Type: log.Type, Time: log.Time}
+			switch log.Type {
+			case irma.ActionIssuing:
+				entry.Received = map[irma.CredentialTypeIdentifier][]irma.TranslatedString{log.Credential: {}}
+			case actionRemoval:
+				entry.Removed = map[irma.CredentialTypeIdentifier][]irma.TranslatedString{log.Credential: {}}
+			default:
+				// The Android app did not store the values of the disclosed attributes
+				disclosed := &DisclosedCredential{
+					Type:       log.Credential,
+					Attributes: map[irma.AttributeTypeIdentifier]*DisclosedAttribute{},
+				}
+				for _, id := range log.Disclosed {
+					disclosed.Attributes[id] = &DisclosedAttribute{}
+				}
+				if len(log.Disclosed) == 0 {
+					disclosed.Attributes[irma.NewAttributeTypeIdentifier(log.Credential.String())] = &DisclosedAttribute{}
+				}
+				entry.Disclosed = []*DisclosedCredential{disclosed}
+				if log.Type == irma.ActionSigning {
+					entry.SignedMessage = []byte(log.Message)
+					entry.SignedMessageType = "STRING"
+				}
+			}
+			if err = client.storage.AppendLog(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return warning
+}
+
+// ParseAndroidStorage parses an Android cardemu.xml shared preferences file
+// from the old Android IRMA app, parsing its credentials into the current instance,
+// and saving them to storage.
+// CAREFUL: this method overwrites any existing secret keys and attributes on storage.
+func (client *Client) ParseAndroidStorage() (present bool, err error) {
+	prefs, present, err := client.androidPreferences()
+	if err != nil || !present {
+		return
+	}
 
 	parsedjson := make(map[string][]*struct {
 		Signature    *gabi.CLSignature `json:"signature"`
@@ -146,8 +273,8 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 		Attributes   []*big.Int        `json:"attributes"`
 		SharedPoints []*big.Int        `json:"public_sks"`
 	})
-	client.keyshareServers = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
-	for _, xmltag := range parsedxml.Strings {
+	client.keyshareServers = make(map[irma.SchemeManagerIdentifier]*KeyshareServer)
+	for _, xmltag := range prefs {
 		if xmltag.Name == "credentials" {
 			jsontag := html.UnescapeString(xmltag.Content)
 			if err = json.Unmarshal([]byte(jsontag), &parsedjson); err != nil {
@@ -162,7 +289,7 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 		}
 		if xmltag.Name == "KeyshareKeypairs" {
 			jsontag := html.UnescapeString(xmltag.Content)
-			keys := make([]*paillierPrivateKey, 0, 3)
+			keys := make([]*PaillierPrivateKey, 0, 3)
 			if err = json.Unmarshal([]byte(jsontag), &keys); err != nil {
 				return
 			}
@@ -170,8 +297,9 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 		}
 	}
 
+	var creds []*credential
 	for _, list := range parsedjson {
-		client.secretkey = &secretKey{Key: list[0].Attributes[0]}
+		client.secretkey = &SecretKey{Key: list[0].Attributes[0]}
 		for _, oldcred := range list {
 			gabicred := &gabi.Credential{
 				Attributes: oldcred.Attributes,
@@ -189,17 +317,15 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 				return
 			}
 
-			if err = client.addCredential(cred, false); err != nil {
-				return
-			}
+			creds = append(creds, cred)
 		}
 	}
 
-	if len(client.credentials) > 0 {
-		if err = client.storage.StoreAttributes(client.attributes); err != nil {
+	if len(creds) > 0 {
+		if err = client.storage.StoreSecretKey(client.secretkey); err != nil {
 			return
 		}
-		if err = client.storage.StoreSecretKey(client.secretkey); err != nil {
+		if err = client.commitCredentials(creds); err != nil {
 			return
 		}
 	}
@@ -211,11 +337,8 @@ func (client *Client) ParseAndroidStorage() (present bool, err error) {
 	}
 	client.UnenrolledSchemeManagers = client.unenrolledSchemeManagers()
 
-	if err = client.storage.StorePaillierKeys(client.paillierKeyCache); err != nil {
-		return
-	}
-	if client.paillierKeyCache == nil {
-		client.paillierKey(false) // trigger calculating a new one
-	}
+	// If we have no Paillier key, a new one is generated when it is first needed
+	// (New() starts calculating one in the background)
+	err = client.storage.StorePaillierKeys(client.paillierKeyCache)
 	return
 }
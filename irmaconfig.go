@@ -22,12 +22,6 @@ import (
 
 	"encoding/hex"
 
-	"crypto/ecdsa"
-	"crypto/x509"
-	"encoding/asn1"
-	"encoding/pem"
-	"math/big"
-
 	"github.com/go-errors/errors"
 	"github.com/mhe/gabi"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -392,6 +386,29 @@ func (conf *Configuration) Contains(cred CredentialTypeIdentifier) bool {
 		conf.CredentialTypes[cred] != nil
 }
 
+// AttributeName returns the name of the specified attribute from the description of its
+// credential type, or the name of the credential type if the identifier refers to a credential.
+// If the credential type or attribute is unknown, the identifier itself is returned.
+func (conf *Configuration) AttributeName(id AttributeTypeIdentifier) TranslatedString {
+	unknown := TranslatedString{"en": id.String(), "nl": id.String()}
+	if id.IsCredential() {
+		credtype := conf.CredentialTypes[NewCredentialTypeIdentifier(id.String())]
+		if credtype == nil {
+			return unknown
+		}
+		return credtype.Name
+	}
+	credtype := conf.CredentialTypes[id.CredentialTypeIdentifier()]
+	if credtype == nil {
+		return unknown
+	}
+	index, err := credtype.IndexOf(id)
+	if err != nil {
+		return unknown
+	}
+	return credtype.Attributes[index].Name
+}
+
 func (conf *Configuration) readTimestamp(path string) (timestamp *time.Time, exists bool, err error) {
 	filename := filepath.Join(path, "timestamp")
 	exists, err = fs.PathExists(filename)
@@ -710,7 +727,10 @@ func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 		}
 	}
 
-	return nil
+	// Files that are present but not signed are not an error, as they are never read
+	// through ReadAuthenticatedFile; we do keep track of them so they can be reported
+	manager.UnsignedFiles, err = conf.UnsignedFiles(manager)
+	return err
 }
 
 // ReadAuthenticatedFile reads the file at the specified path
@@ -754,38 +774,28 @@ func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) (valid bo
 		return false, errors.New("Missing scheme manager index file, signature, or public key")
 	}
 
-	// Read and hash index file
+	// Read index file
 	indexbts, err := ioutil.ReadFile(dir + "/index")
 	if err != nil {
 		return false, err
 	}
-	indexhash := sha256.Sum256(indexbts)
 
-	// Read and parse scheme manager public key
+	// Read and parse scheme manager public keys
 	pkbts, err := ioutil.ReadFile(dir + "/pk.pem")
 	if err != nil {
 		return false, err
 	}
-	pkblk, _ := pem.Decode(pkbts)
-	genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
+	pks, err := ParseSchemeManagerPublicKeys(pkbts)
 	if err != nil {
 		return false, err
 	}
-	pk, ok := genericPk.(*ecdsa.PublicKey)
-	if !ok {
-		return false, errors.New("Invalid scheme manager public key")
-	}
 
-	// Read and parse signature
+	// Read and verify signatures
 	sig, err := ioutil.ReadFile(dir + "/index.sig")
 	if err != nil {
 		return false, err
 	}
-	ints := make([]*big.Int, 0, 2)
-	_, err = asn1.Unmarshal(sig, &ints)
-
-	// Verify signature
-	return ecdsa.Verify(pk, indexhash[:], ints[0], ints[1]), nil
+	return VerifySchemeManagerSignatures(indexbts, sig, pks)
 }
 
 func (hash ConfigurationFileHash) String() string {
@@ -1,9 +1,17 @@
 package irma
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/json"
 	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -238,3 +246,211 @@ func TestServiceProvider(t *testing.T) {
 
 	require.NotNil(t, spjwt.Request.Request.Content.Find(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
 }
+
+func TestParseQr(t *testing.T) {
+	qrjson := `{"u":"https://example.com/irma_api_server/api/v2/verification/abc","irmaqr":"disclosing","v":"2.0","vmax":"2.2"}`
+	qr, err := ParseQr(qrjson)
+	require.NoError(t, err)
+	require.Equal(t, ActionDisclosing, qr.Type)
+	require.Equal(t, "2.2", qr.ProtocolMaxVersion)
+
+	deeplink, err := qr.DeepLink()
+	require.NoError(t, err)
+	parsed, err := ParseQr(deeplink)
+	require.NoError(t, err)
+	require.Equal(t, qr, parsed)
+
+	universal, err := qr.UniversalLink("")
+	require.NoError(t, err)
+	require.Contains(t, universal, UniversalLinkPrefix)
+	parsed, err = ParseQr(universal)
+	require.NoError(t, err)
+	require.Equal(t, qr, parsed)
+
+	universal, err = qr.UniversalLink("https://example.com/start")
+	require.NoError(t, err)
+	parsed, err = ParseQr(universal)
+	require.NoError(t, err)
+	require.Equal(t, qr, parsed)
+	universal, err = qr.UniversalLink("https://example.com/start#")
+	require.NoError(t, err)
+	parsed, err = ParseQr(universal)
+	require.NoError(t, err)
+	require.Equal(t, qr, parsed)
+	_, err = qr.UniversalLink("https://example.com/start#section")
+	require.Error(t, err)
+
+	_, err = ParseQr(`{"u":"https://example.com","irmaqr":"disclosing","v":"2","vmax":"2.2"}`)
+	require.Error(t, err)
+	_, err = ParseQr(`{"u":"https://example.com","irmaqr":"disclosing","v":"2.0"}`)
+	require.Error(t, err)
+	_, err = ParseQr(`{"u":"https://example.com","irmaqr":"disclosing","v":"2.2","vmax":"2.0"}`)
+	require.Error(t, err)
+	_, err = ParseQr(`{"u":"https://example.com","irmaqr":"foo","v":"2.0","vmax":"2.2"}`)
+	require.Error(t, err)
+	qr, err = DecodeQr(`{"u":"https://example.com","irmaqr":"foo","v":"2.0","vmax":"2.2"}`)
+	require.NoError(t, err)
+	require.Error(t, qr.Validate())
+	_, err = ParseQr("https://example.com/nofragment")
+	require.Error(t, err)
+	_, err = ParseQr("foo")
+	require.Error(t, err)
+
+	qr, err = ParseQr(`{"u":"https://example.com/schememanager","irmaqr":"schememanager"}`)
+	require.NoError(t, err)
+	require.Equal(t, ActionSchemeManager, qr.Type)
+}
+
+func TestInstallSchemeManagerFromServer(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	handler, err := NewSchemeManagerServer(filepath.Join("testdata", "irma_configuration", "irma-demo"))
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Private keys and unknown scheme managers must not be served
+	for _, path := range []string{"/irma-demo/sk.pem", "/irma-demo/RU/PrivateKeys/0.xml", "/irma-demo/RU", "/other/description.xml"} {
+		res, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, res.StatusCode, path)
+	}
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	conf, err := NewConfiguration(path, "")
+	require.NoError(t, err)
+	manager, err := DownloadSchemeManager(handler.URL(server.URL, NewSchemeManagerIdentifier("irma-demo")))
+	require.NoError(t, err)
+	require.NoError(t, conf.InstallSchemeManager(manager))
+
+	require.True(t, conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].Valid)
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.NoError(t, fs.AssertPathExists(filepath.Join(path, "irma-demo", "RU", "PublicKeys", "2.xml")))
+	require.Error(t, fs.AssertPathExists(filepath.Join(path, "irma-demo", "RU", "PrivateKeys")))
+}
+
+func TestSchemeManagerSignatures(t *testing.T) {
+	index := []byte("0123 irma-demo/description.xml\n")
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signers := []crypto.Signer{p256, p384, other}
+
+	for _, signer := range signers {
+		bts, err := MarshalSchemeManagerPublicKeys(&SchemeManagerPublicKeys{Keys: []crypto.PublicKey{signer.Public()}})
+		require.NoError(t, err)
+		pks, err := ParseSchemeManagerPublicKeys(bts)
+		require.NoError(t, err)
+		require.Equal(t, 1, pks.Threshold)
+
+		sig, err := SignSchemeManagerIndex(index, signer)
+		require.NoError(t, err)
+		valid, err := VerifySchemeManagerSignatures(index, sig, pks)
+		require.NoError(t, err)
+		require.True(t, valid)
+		valid, err = VerifySchemeManagerSignatures(append(index, ' '), sig, pks)
+		require.NoError(t, err)
+		require.False(t, valid, "Signature over modified index accepted")
+	}
+
+	// 2-out-of-3 signing
+	pks := &SchemeManagerPublicKeys{Threshold: 2}
+	for _, signer := range signers {
+		pks.Keys = append(pks.Keys, signer.Public())
+	}
+	bts, err := MarshalSchemeManagerPublicKeys(pks)
+	require.NoError(t, err)
+	pks, err = ParseSchemeManagerPublicKeys(bts)
+	require.NoError(t, err)
+	require.Len(t, pks.Keys, 3)
+	require.Equal(t, 2, pks.Threshold)
+
+	sig1, err := SignSchemeManagerIndex(index, other)
+	require.NoError(t, err)
+	sig2, err := SignSchemeManagerIndex(index, p384)
+	require.NoError(t, err)
+	valid, err := VerifySchemeManagerSignatures(index, sig1, pks)
+	require.NoError(t, err)
+	require.False(t, valid, "Single signature accepted for 2-out-of-3 keys")
+	valid, err = VerifySchemeManagerSignatures(index, append(sig1, sig1...), pks)
+	require.NoError(t, err)
+	require.False(t, valid, "Duplicate signature counted twice")
+	valid, err = VerifySchemeManagerSignatures(index, append(sig1, sig2...), pks)
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+func TestSchemeManagerLegacySignature(t *testing.T) {
+	index := []byte("0123 irma-demo/description.xml\n")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pks := &SchemeManagerPublicKeys{Keys: []crypto.PublicKey{key.Public()}, Threshold: 1}
+
+	sig, err := SignSchemeManagerIndexLegacy(index, key)
+	require.NoError(t, err)
+	valid, err := VerifySchemeManagerSignatures(index, sig, pks)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySchemeManagerSignatures(append(index, ' '), sig, pks)
+	require.NoError(t, err)
+	require.False(t, valid, "Signature over modified index accepted")
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = SignSchemeManagerIndexLegacy(index, p384)
+	require.Error(t, err)
+
+	// Nor are legacy signatures accepted from a P-384 key
+	hash := sha256.Sum256(index)
+	r, s, err := ecdsa.Sign(rand.Reader, p384, hash[:])
+	require.NoError(t, err)
+	sig, err = asn1.Marshal([]*big.Int{r, s})
+	require.NoError(t, err)
+	pks = &SchemeManagerPublicKeys{Keys: []crypto.PublicKey{p384.Public()}, Threshold: 1}
+	_, err = VerifySchemeManagerSignatures(index, sig, pks)
+	require.Error(t, err)
+}
+
+func TestSchemeIgnore(t *testing.T) {
+	ignore := ParseSchemeIgnore(`
+# comment
+*.tmp
+drafts/
+/RU/notes.txt
+!keep.tmp
+`)
+	for path, ignored := range map[string]bool{
+		"index":                      true,
+		"index.sig":                  true,
+		"RU/index":                   false,
+		"RU/PrivateKeys/0.xml":       true,
+		"RU/PublicKeys/0.xml":        false,
+		".git/HEAD":                  true,
+		"description.xml":            false,
+		"RU/logo.svg":                false,
+		"RU/foo.tmp":                 true,
+		"RU/keep.tmp":                false,
+		"RU/drafts/description.xml":  true,
+		"RU/notes.txt":               true,
+		"MijnOverheid/notes.txt":     false,
+		"RU/Issues/card/metadata.js": false,
+	} {
+		require.Equal(t, ignored, ignore.Ignored(path, false), path)
+	}
+}
+
+func TestUnsignedFiles(t *testing.T) {
+	conf := parseConfiguration(t)
+	manager := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	require.Empty(t, manager.UnsignedFiles)
+
+	file := filepath.Join("testdata", "irma_configuration", "irma-demo", "RU", "unsigned.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte("{}"), 0600))
+	defer os.Remove(file)
+	require.NoError(t, conf.VerifySchemeManager(manager))
+	require.Equal(t, []string{"irma-demo/RU/unsigned.json"}, manager.UnsignedFiles)
+}
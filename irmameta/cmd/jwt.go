@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var jwtCmd = &cobra.Command{
+	Use:   "jwt jwt",
+	Short: "Decode a JWT",
+	Long:  `The jwt command decodes the header and body of the specified JWT. If it is a requestor JWT (i.e., its subject is verification_request, signature_request or issue_request), the session request it contains is printed as well. The signature of the JWT is not verified.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		parts := strings.Split(strings.TrimSpace(args[0]), ".")
+		if len(parts) != 3 {
+			return errors.New("Not a JWT")
+		}
+		header, err := jwtPart(parts[0])
+		if err != nil {
+			return errors.Errorf("Failed to decode JWT header: %s", err.Error())
+		}
+		body, err := jwtPart(parts[1])
+		if err != nil {
+			return errors.Errorf("Failed to decode JWT body: %s", err.Error())
+		}
+
+		var h, b map[string]interface{}
+		if err = json.Unmarshal(header, &h); err != nil {
+			return errors.Errorf("Failed to parse JWT header: %s", err.Error())
+		}
+		if err = json.Unmarshal(body, &b); err != nil {
+			return errors.Errorf("Failed to parse JWT body: %s", err.Error())
+		}
+		fmt.Println("Header   :", prettyprint(h))
+		fmt.Println("Body     :", prettyprint(b))
+		fmt.Println("Signature:", parts[2] != "")
+
+		var jwt irma.RequestorJwt
+		switch b["sub"] {
+		case "verification_request":
+			jwt = &irma.ServiceProviderJwt{}
+		case "signature_request":
+			jwt = &irma.SignatureRequestorJwt{}
+		case "issue_request":
+			jwt = &irma.IdentityProviderJwt{}
+		default:
+			return nil
+		}
+		if err = json.Unmarshal(body, jwt); err != nil {
+			return errors.Errorf("Failed to parse requestor JWT: %s", err.Error())
+		}
+		fmt.Println()
+		fmt.Println("Requestor:", jwt.Requestor())
+		fmt.Println("Request  :", prettyprint(jwt.IrmaSession()))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(jwtCmd)
+}
+
+// jwtPart decodes a part of a JWT, accepting both the URL-safe base64 encoding
+// that the JWT specification prescribes and the standard encoding.
+func jwtPart(part string) ([]byte, error) {
+	part = strings.TrimRight(part, "=")
+	if bts, err := base64.RawURLEncoding.DecodeString(part); err == nil {
+		return bts, nil
+	}
+	return base64.RawStdEncoding.DecodeString(part)
+}
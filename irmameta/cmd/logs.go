@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs path_to_storage path_to_irma_configuration",
+	Short: "Print the log entries of a client storage folder",
+	Long:  `The logs command prints the log entries in the specified irmaclient storage folder, including the decoded requestor JWT that started each session. With --responses, the response that the client sent to the requestor (the disclosure proofs or issuance commitments) is printed as well.`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		responses, err := cmd.Flags().GetBool("responses")
+		if err != nil {
+			return err
+		}
+		conf, err := parseConfiguration(args[1])
+		if err != nil {
+			return err
+		}
+		inspection, err := irmaclient.InspectStorage(args[0], conf)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Log entries (%d):\n", len(inspection.Logs))
+		for i, entry := range inspection.Logs {
+			fmt.Println()
+			printLogEntry(i, entry, conf, responses)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(logsCmd)
+	logsCmd.Flags().BoolP("responses", "r", false, "also print the responses sent to the requestor")
+}
+
+func printLogEntry(index int, entry *irmaclient.LogEntry, conf *irma.Configuration, responses bool) {
+	fmt.Printf("%d: %s at %s\n", index, entry.Type, time.Time(entry.Time).String())
+	if entry.Group != "" {
+		fmt.Println("  Group     :", entry.Group)
+	}
+	fmt.Println("  Outcome   :", entry.Outcome)
+	if entry.ErrorType != "" {
+		fmt.Println("  Error     :", entry.ErrorType)
+	}
+	if len(entry.Requested) > 0 {
+		fmt.Println("  Requested :", indent(prettyprint(entry.Requested), "  "))
+	}
+	if entry.SessionInfo != nil {
+		fmt.Println("  Nonce     :", entry.SessionInfo.Nonce)
+		fmt.Println("  Context   :", entry.SessionInfo.Context)
+		if entry.SessionInfo.Jwt != "" {
+			jwt, err := entry.Jwt()
+			if err != nil {
+				fmt.Println("  Jwt       : failed to parse:", err)
+			} else {
+				fmt.Println("  Requestor :", jwt.Requestor())
+				fmt.Println("  Jwt       :", indent(prettyprint(jwt), "  "))
+			}
+		}
+	}
+	for _, cred := range entry.Disclosed {
+		fmt.Println("  Credential:", cred.Type, cred.CredentialHash)
+		for id, attr := range cred.Attributes {
+			fmt.Printf("  Disclosed : %s (%s): %s\n", conf.AttributeName(id)["en"], id, attr.Value)
+			if attr.Label != "" {
+				fmt.Println("    Requested as:", attr.Label)
+			}
+		}
+	}
+	if len(entry.Received) > 0 {
+		fmt.Println("  Received  :", indent(prettyprint(entry.Received), "  "))
+	}
+	if len(entry.Removed) > 0 {
+		fmt.Println("  Removed   :", indent(prettyprint(entry.Removed), "  "))
+	}
+	if len(entry.SignedMessage) > 0 {
+		fmt.Printf("  Signed    : %s (%s)\n", string(entry.SignedMessage), entry.SignedMessageType)
+	}
+
+	if !responses {
+		return
+	}
+	response, err := entry.GetResponse()
+	if err != nil {
+		fmt.Println("  Response  : failed to parse:", err)
+	} else if response != nil {
+		fmt.Println("  Response  :", indent(prettyprint(response), "  "))
+	}
+}
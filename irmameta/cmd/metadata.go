@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var metadataCmd = &cobra.Command{
+	Use:   "metadata metadata_attribute path_to_irma_configuration",
+	Short: "Decode a metadata attribute",
+	Long: `The metadata command decodes the specified metadata attribute, and prints the credential type, signing and expiry dates, and public key it refers to.
+
+The metadata attribute may be specified in decimal, in hex (optionally prefixed with 0x) or in base64. By default the encoding is detected from the characters used, trying decimal, hex and base64 in that order; use --encoding to override.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		encoding, err := cmd.Flags().GetString("encoding")
+		if err != nil {
+			return err
+		}
+		metaint, err := parseMetadataInt(args[0], encoding)
+		if err != nil {
+			return err
+		}
+		conf, err := parseConfiguration(args[1])
+		if err != nil {
+			return err
+		}
+
+		meta := irma.MetadataFromInt(metaint, conf)
+		printMetadata(meta, "")
+		fmt.Println()
+		fmt.Println("CredentialType  :", prettyprint(meta.CredentialType()))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(metadataCmd)
+	metadataCmd.Flags().StringP("encoding", "e", "auto", "encoding of the metadata attribute (auto, decimal, hex or base64)")
+}
+
+var (
+	decimalRegexp = regexp.MustCompile("^[0-9]+$")
+	hexRegexp     = regexp.MustCompile("^(0x)?[0-9a-fA-F]+$")
+)
+
+// parseMetadataInt parses a metadata attribute in the specified encoding.
+func parseMetadataInt(s, encoding string) (*big.Int, error) {
+	s = strings.TrimSpace(s)
+	if encoding == "auto" {
+		switch {
+		case decimalRegexp.MatchString(s):
+			encoding = "decimal"
+		case hexRegexp.MatchString(s):
+			encoding = "hex"
+		default:
+			encoding = "base64"
+		}
+	}
+
+	switch encoding {
+	case "decimal":
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return nil, errors.New("Could not parse metadata attribute as decimal integer")
+		}
+		return i, nil
+	case "hex":
+		s = strings.TrimPrefix(s, "0x")
+		if len(s)%2 == 1 {
+			s = "0" + s
+		}
+		bts, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, errors.Errorf("Could not parse metadata attribute as hex: %s", err.Error())
+		}
+		return new(big.Int).SetBytes(bts), nil
+	case "base64":
+		bts, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			bts, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		}
+		if err != nil {
+			return nil, errors.Errorf("Could not parse metadata attribute as base64: %s", err.Error())
+		}
+		return new(big.Int).SetBytes(bts), nil
+	default:
+		return nil, errors.Errorf("Unsupported encoding %s", encoding)
+	}
+}
+
+// printMetadata prints the contents of the metadata attribute, each line starting with indent.
+func printMetadata(meta *irma.MetadataAttribute, indent string) {
+	typ := meta.CredentialType()
+	var key *gabi.PublicKey
+	var err error
+
+	if typ == nil {
+		fmt.Println(indent+"Unknown credential type, hash:", base64.StdEncoding.EncodeToString(meta.CredentialTypeHash()))
+	} else {
+		fmt.Println(indent+"Identifier      :", typ.Identifier())
+		key, err = meta.PublicKey()
+		if err != nil {
+			fmt.Println(indent+"Failed to parse public key", err)
+		}
+	}
+	fmt.Println(indent+"Signed          :", meta.SigningDate().String())
+	fmt.Println(indent+"Expires         :", meta.Expiry().String())
+	fmt.Println(indent+"IsValid()       :", meta.IsValid())
+	fmt.Println(indent+"KeyCounter      :", meta.KeyCounter())
+	if key != nil {
+		fmt.Println(indent+"KeyExpires      :", time.Unix(key.ExpiryDate, 0))
+		fmt.Println(indent+"KeyModulusBitlen:", key.N.BitLen())
+	}
+}
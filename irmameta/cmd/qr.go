@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var qrCmd = &cobra.Command{
+	Use:   "qr qr_payload",
+	Short: "Decode a session QR",
+	Long:  `The qr command decodes the specified session QR payload, which may be the JSON contents of a QR, a deep link or a universal link, and checks that it is valid.`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		qr, err := irma.DecodeQr(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		fmt.Println("Type     :", qr.Type)
+		fmt.Println("URL      :", qr.URL)
+		fmt.Println("Contents :", prettyprint(qr))
+		if err = qr.Validate(); err != nil {
+			fmt.Println("Invalid  :", err)
+		} else {
+			fmt.Println("Valid    : true")
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(qrCmd)
+}
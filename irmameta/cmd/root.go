@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+// RootCmd represents the base command when called without any subcommands
+var RootCmd = &cobra.Command{
+	Use:   "irmameta",
+	Short: "IRMA inspection tool",
+	Long: `Irmameta is a tool for inspecting IRMA data: metadata attributes, client storage folders, log entries, requestor JWTs and session QRs.
+
+For backwards compatibility, "irmameta metadata_attribute path_to_irma_configuration" is equivalent to the metadata command.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		return metadataCmd.RunE(metadataCmd, args)
+	},
+}
+
+// Execute adds all child commands to the root command sets flags appropriately.
+// This is called by main.main(). It only needs to happen once to the rootCmd.
+func Execute() {
+	if err := RootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+}
+
+func parseConfiguration(path string) (*irma.Configuration, error) {
+	conf, err := irma.NewConfiguration(path, "")
+	if err != nil {
+		return nil, errors.Errorf("Failed to parse irma_configuration: %s", err.Error())
+	}
+	if err = conf.ParseFolder(); err != nil {
+		return nil, errors.Errorf("Failed to parse irma_configuration: %s", err.Error())
+	}
+	return conf, nil
+}
+
+func prettyprint(ob interface{}) string {
+	b, err := json.MarshalIndent(ob, "", "  ")
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return string(b)
+}
+
+// indent indents all but the first line of s with the specified prefix.
+func indent(s, prefix string) string {
+	return strings.Replace(s, "\n", "\n"+prefix, -1)
+}
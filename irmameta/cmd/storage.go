@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var storageCmd = &cobra.Command{
+	Use:   "storage path_to_storage path_to_irma_configuration",
+	Short: "Print the contents of a client storage folder",
+	Long:  `The storage command prints the contents of the specified irmaclient storage folder: the credentials with their attributes and metadata, whether their signatures are present and their public keys are valid, the keyshare servers at which the client is enrolled, and the updates that were applied. The storage folder is not modified. Use the logs command to inspect the log entries.`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := parseConfiguration(args[1])
+		if err != nil {
+			return err
+		}
+		inspection, err := irmaclient.InspectStorage(args[0], conf)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Secret key      :", inspection.SecretKey)
+		fmt.Println("Paillier keys   :", inspection.PaillierKeys)
+		fmt.Println("Log entries     :", len(inspection.Logs))
+
+		fmt.Println()
+		fmt.Printf("Keyshare servers (%d):\n", len(inspection.KeyshareServers))
+		for id, kss := range inspection.KeyshareServers {
+			fmt.Printf("  %s: %s at %s\n", id, kss.Username, kss.URL)
+		}
+
+		fmt.Println()
+		fmt.Printf("Credentials (%d):\n", len(inspection.Credentials))
+		for _, cred := range inspection.Credentials {
+			printCredential(cred)
+		}
+
+		fmt.Println()
+		fmt.Printf("Updates (%d):\n", len(inspection.Updates))
+		for _, update := range inspection.Updates {
+			status := "success"
+			if !update.Success {
+				status = "failed"
+				if update.Error != nil {
+					status += ": " + *update.Error
+				}
+			} else if update.Warning != nil {
+				status += " (" + *update.Warning + ")"
+			}
+			fmt.Printf("  %d at %s: %s\n", update.Number, time.Time(update.When).String(), status)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(storageCmd)
+}
+
+func printCredential(cred *irmaclient.CredentialInspection) {
+	fmt.Println()
+	printMetadata(cred.Attributes.MetadataAttribute, "  ")
+	fmt.Println("  Signature       :", cred.Signature)
+	if cred.KeyError == "" {
+		fmt.Println("  Public key      : valid")
+	} else {
+		fmt.Println("  Public key      :", cred.KeyError)
+	}
+
+	fmt.Println("  Attributes      :")
+	if typ := cred.Attributes.CredentialType(); typ != nil {
+		for i, attr := range cred.Attributes.Strings() {
+			name := fmt.Sprintf("%d", i)
+			if i < len(typ.Attributes) {
+				name = typ.Attributes[i].ID
+			}
+			fmt.Printf("    %s: %s\n", name, attr["en"])
+		}
+	} else {
+		for i, attr := range cred.Attributes.Ints[1:] {
+			fmt.Printf("    %d: %s\n", i, attr.String())
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/privacybydesign/irmago/irmameta/cmd"
+
+func main() {
+	cmd.Execute()
+}
@@ -0,0 +1,151 @@
+package irmarequestor
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains functions for signing requestor JWTs and for verifying
+// the JWTs that the IRMA API server returns.
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+const (
+	jwtAlgorithmRS256 = "RS256"
+	jwtAlgorithmNone  = "none"
+)
+
+// signJwt serializes the contents into a JWT, signed with RS256 using the specified key,
+// or unsigned if key is nil.
+func signJwt(contents interface{}, key *rsa.PrivateKey, keyID string) (string, error) {
+	header := jwtHeader{Algorithm: jwtAlgorithmRS256, Type: "JWT", KeyID: keyID}
+	if key == nil {
+		header.Algorithm = jwtAlgorithmNone
+	}
+	headerbytes, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	bodybytes, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(headerbytes) + "." +
+		base64.RawURLEncoding.EncodeToString(bodybytes)
+	if key == nil {
+		return unsigned + ".", nil
+	}
+
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyJwt verifies the RS256 signature of the specified JWT using pk, and parses its body into dest.
+func verifyJwt(jwt string, pk *rsa.PublicKey, dest interface{}) error {
+	if pk == nil {
+		return errors.New("No public key to verify JWT with")
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("Not a JWT")
+	}
+
+	headerbytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	header := &jwtHeader{}
+	if err = json.Unmarshal(headerbytes, header); err != nil {
+		return err
+	}
+	if header.Algorithm != jwtAlgorithmRS256 {
+		return errors.Errorf("Unsupported JWT algorithm %s", header.Algorithm)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(pk, crypto.SHA256, hash[:], sig); err != nil {
+		return errors.New("Invalid JWT signature")
+	}
+
+	return parseJwt(jwt, dest)
+}
+
+// parseJwt parses the body of the specified JWT into dest, without verifying its signature.
+func parseJwt(jwt string, dest interface{}) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("Not a JWT")
+	}
+	bodybytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bodybytes, dest)
+}
+
+// ReadPrivateKey reads a PEM-encoded RSA private key (in PKCS#1 or PKCS#8 form) from the specified file.
+func ReadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsakey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Not an RSA private key")
+	}
+	return rsakey, nil
+}
+
+// ReadPublicKey reads a PEM-encoded RSA public key from the specified file.
+func ReadPublicKey(path string) (*rsa.PublicKey, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsakey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Not an RSA public key")
+	}
+	return rsakey, nil
+}
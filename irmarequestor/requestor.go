@@ -0,0 +1,283 @@
+// Package irmarequestor is a client for the requestor side of the IRMA protocol: it starts
+// disclosure, signature and issuance sessions at an IRMA API server, and retrieves their
+// status and results.
+package irmarequestor
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// Client starts sessions at an IRMA API server on behalf of a requestor.
+type Client struct {
+	// URL of the API server, e.g. https://example.com/irma_api_server/api/v2/
+	URL string
+	// Name of the requestor, included in the JWTs and used as their key ID
+	Name string
+	// Key with which the requestor JWTs are signed; if nil, JWTs are sent unsigned
+	// (which only works if the API server allows it)
+	Key *rsa.PrivateKey
+	// Public key of the API server, with which session results are verified.
+	// Results cannot be retrieved without it, unless InsecureSkipVerify is set.
+	ServerPublicKey *rsa.PublicKey
+	// If true and ServerPublicKey is nil, results are accepted without verifying them.
+	// Anyone who can tamper with the connection to the API server can then forge results,
+	// so this should only be used for testing.
+	InsecureSkipVerify bool
+	// Interval at which the session status is polled by Await
+	PollInterval time.Duration
+}
+
+// Session is a session started at the API server.
+type Session struct {
+	// Qr should be shown to the user to let the IRMA app perform the session
+	Qr     *irma.Qr
+	Token  string
+	Action irma.Action
+
+	client    *Client
+	transport *irma.HTTPTransport
+}
+
+// Status is the status of a session at the API server.
+type Status string
+
+// Result contains the verified result of a disclosure or signature session.
+type Result struct {
+	Status     ProofStatus                             `json:"status"`
+	Attributes map[irma.AttributeTypeIdentifier]string `json:"attributes"`
+	Token      string                                  `json:"jti"`
+	IssuedAt   *irma.Timestamp                         `json:"iat,omitempty"`
+	Expiry     *irma.Timestamp                         `json:"exp,omitempty"`
+
+	// In case of signature sessions, the signature as returned by the API server
+	Signature json.RawMessage `json:"-"`
+}
+
+// ProofStatus is the status of the proofs that the API server received from the user.
+type ProofStatus string
+
+// Session statuses
+const (
+	StatusInitialized = Status("INITIALIZED")
+	StatusConnected   = Status("CONNECTED")
+	StatusCancelled   = Status("CANCELLED")
+	StatusDone        = Status("DONE")
+	StatusNotFound    = Status("NOT_FOUND")
+)
+
+// Proof statuses
+const (
+	ProofStatusValid             = ProofStatus("VALID")
+	ProofStatusInvalid           = ProofStatus("INVALID")
+	ProofStatusExpired           = ProofStatus("EXPIRED")
+	ProofStatusMissingAttributes = ProofStatus("MISSING_ATTRIBUTES")
+	ProofStatusWaiting           = ProofStatus("WAITING")
+)
+
+// Requestor errors
+const (
+	// The session is not known to the API server (anymore)
+	ErrorSessionNotFound = irma.ErrorType("sessionNotFound")
+	// The user cancelled the session
+	ErrorSessionCancelled = irma.ErrorType("sessionCancelled")
+	// The session did not finish within the specified time
+	ErrorSessionTimeout = irma.ErrorType("sessionTimeout")
+	// The result JWT of the API server could not be parsed or verified
+	ErrorInvalidResult = irma.ErrorType("invalidResult")
+	// The proofs of the user were not valid
+	ErrorInvalidProofs = irma.ErrorType("invalidProofs")
+)
+
+const defaultPollInterval = time.Second
+
+// New returns a new Client for the API server at the specified URL.
+func New(url, name string, key *rsa.PrivateKey) *Client {
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &Client{
+		URL:          url,
+		Name:         name,
+		Key:          key,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// StartDisclosure starts a disclosure session.
+func (client *Client) StartDisclosure(request *irma.DisclosureRequest) (*Session, error) {
+	return client.start(irma.ActionDisclosing, irma.NewServiceProviderJwt(client.Name, request))
+}
+
+// StartSignature starts a signature session.
+func (client *Client) StartSignature(request *irma.SignatureRequest) (*Session, error) {
+	return client.start(irma.ActionSigning, irma.NewSignatureRequestorJwt(client.Name, request))
+}
+
+// StartIssuance starts an issuance session.
+func (client *Client) StartIssuance(request *irma.IssuanceRequest) (*Session, error) {
+	return client.start(irma.ActionIssuing, irma.NewIdentityProviderJwt(client.Name, request))
+}
+
+func endpoint(action irma.Action) string {
+	switch action {
+	case irma.ActionDisclosing:
+		return "verification/"
+	case irma.ActionSigning:
+		return "signature/"
+	case irma.ActionIssuing:
+		return "issue/"
+	default:
+		return ""
+	}
+}
+
+func (client *Client) start(action irma.Action, contents interface{}) (*Session, error) {
+	jwt, err := signJwt(contents, client.Key, client.Name)
+	if err != nil {
+		return nil, &irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err}
+	}
+
+	url := client.URL + endpoint(action)
+	qr := &irma.Qr{}
+	if err = irma.NewHTTPTransport(url).Post("", qr, jwt); err != nil {
+		return nil, err
+	}
+	if qr.URL == "" {
+		return nil, &irma.SessionError{ErrorType: irma.ErrorServerResponse, Info: "No session token received"}
+	}
+
+	// The API server returns just the session token; the IRMA app needs the full URL
+	token := qr.URL
+	qr.URL = url + token
+	if qr.Type == "" {
+		qr.Type = action
+	}
+
+	return &Session{
+		Qr:        qr,
+		Token:     token,
+		Action:    action,
+		client:    client,
+		transport: irma.NewHTTPTransport(qr.URL),
+	}, nil
+}
+
+// Status retrieves the current status of the session.
+func (session *Session) Status() (Status, error) {
+	var status Status
+	if err := session.transport.Get("status", &status); err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// Await polls the status of the session until it is done, returning an error
+// if it is cancelled, not found, or not done within the specified timeout
+// (a zero timeout means waiting indefinitely).
+func (session *Session) Await(timeout time.Duration) error {
+	interval := session.client.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		status, err := session.Status()
+		if err != nil {
+			return err
+		}
+		switch status {
+		case StatusDone:
+			return nil
+		case StatusCancelled:
+			return &irma.SessionError{ErrorType: ErrorSessionCancelled}
+		case StatusNotFound:
+			return &irma.SessionError{ErrorType: ErrorSessionNotFound, Info: session.Token}
+		}
+		if !deadline.IsZero() && time.Now().Add(interval).After(deadline) {
+			return &irma.SessionError{ErrorType: ErrorSessionTimeout, Info: string(status)}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Result retrieves and verifies the result of a finished disclosure or signature session.
+// An error of type ErrorInvalidProofs is returned (along with the result) if the proofs
+// of the user were not valid.
+func (session *Session) Result() (*Result, error) {
+	if session.Action == irma.ActionIssuing {
+		return nil, errors.New("Issuance sessions have no result")
+	}
+
+	var jwt string
+	if err := session.transport.Get("getproof", &jwt); err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	jwt = strings.Trim(strings.TrimSpace(jwt), "\"")
+	var err error
+	if session.client.ServerPublicKey == nil && session.client.InsecureSkipVerify {
+		err = parseJwt(jwt, result)
+	} else {
+		err = verifyJwt(jwt, session.client.ServerPublicKey, result)
+	}
+	if err == nil {
+		err = result.checkTimes(time.Now())
+	}
+	if err != nil {
+		return nil, &irma.SessionError{ErrorType: ErrorInvalidResult, Err: err}
+	}
+
+	if session.Action == irma.ActionSigning {
+		var signature string
+		if err := session.transport.Get("getsignature", &signature); err != nil {
+			return nil, err
+		}
+		result.Signature = json.RawMessage(signature)
+	}
+
+	if result.Status != ProofStatusValid {
+		return result, &irma.SessionError{ErrorType: ErrorInvalidProofs, Info: string(result.Status)}
+	}
+	return result, nil
+}
+
+// maxClockSkew is how far in the future the issuance time of a result may lie,
+// to allow for the clocks of the API server and of ours not being in sync.
+const maxClockSkew = time.Minute
+
+// checkTimes returns an error if the result has expired or was issued in the future.
+func (result *Result) checkTimes(now time.Time) error {
+	if result.Expiry != nil && now.After(time.Time(*result.Expiry)) {
+		return errors.New("Result JWT has expired")
+	}
+	if result.IssuedAt != nil && time.Time(*result.IssuedAt).After(now.Add(maxClockSkew)) {
+		return errors.New("Result JWT was issued in the future")
+	}
+	return nil
+}
+
+// AwaitResult waits for the session to finish, and returns its result (nil for issuance sessions).
+func (session *Session) AwaitResult(timeout time.Duration) (*Result, error) {
+	if err := session.Await(timeout); err != nil {
+		return nil, err
+	}
+	if session.Action == irma.ActionIssuing {
+		return nil, nil
+	}
+	return session.Result()
+}
+
+// Cancel cancels the session at the API server.
+func (session *Session) Cancel() {
+	session.transport.Delete()
+}
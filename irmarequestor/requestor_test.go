@@ -0,0 +1,166 @@
+package irmarequestor
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeApiServer mimics the requestor endpoints of the IRMA API server for a single session.
+type fakeApiServer struct {
+	t          *testing.T
+	key        *rsa.PrivateKey
+	requestor  *rsa.PublicKey
+	statuses   []Status
+	result     *Result
+	cancelled  bool
+	jwtPayload map[string]interface{}
+}
+
+func (s *fakeApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/")
+	switch {
+	case r.Method == http.MethodPost && path == "verification/":
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(s.t, err)
+		s.jwtPayload = map[string]interface{}{}
+		require.NoError(s.t, verifyJwt(string(body), s.requestor, &s.jwtPayload))
+		w.Write([]byte(`{"u":"token","v":"2.0","vmax":"2.3","irmaqr":"disclosing"}`))
+	case r.Method == http.MethodGet && path == "verification/token/status":
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		bts, _ := json.Marshal(status)
+		w.Write(bts)
+	case r.Method == http.MethodGet && path == "verification/token/getproof":
+		jwt, err := signJwt(s.result, s.key, "")
+		require.NoError(s.t, err)
+		w.Write([]byte(jwt))
+	case r.Method == http.MethodDelete && path == "verification/token/":
+		s.cancelled = true
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFakeApiServer(t *testing.T) (*fakeApiServer, *Client, func()) {
+	serverkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	requestorkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	fake := &fakeApiServer{t: t, key: serverkey, requestor: &requestorkey.PublicKey}
+	server := httptest.NewServer(fake)
+
+	client := New(server.URL+"/api/v2", "testrequestor", requestorkey)
+	client.ServerPublicKey = &serverkey.PublicKey
+	client.PollInterval = 10 * time.Millisecond
+	return fake, client, server.Close
+}
+
+func disclosureRequest() *irma.DisclosureRequest {
+	return &irma.DisclosureRequest{
+		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}}),
+	}
+}
+
+func TestJwtRoundtrip(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	jwt, err := signJwt(map[string]string{"foo": "bar"}, key, "kid")
+	require.NoError(t, err)
+
+	var dest map[string]string
+	require.NoError(t, verifyJwt(jwt, &key.PublicKey, &dest))
+	require.Equal(t, "bar", dest["foo"])
+	require.Error(t, verifyJwt(jwt, &other.PublicKey, &dest))
+
+	unsigned, err := signJwt(map[string]string{"foo": "bar"}, nil, "kid")
+	require.NoError(t, err)
+	require.NoError(t, parseJwt(unsigned, &dest))
+	require.Error(t, verifyJwt(unsigned, nil, &dest), "Unsigned JWT accepted without key")
+	require.Error(t, verifyJwt(unsigned, &key.PublicKey, &dest), "Unsigned JWT accepted")
+}
+
+func TestDisclosureSession(t *testing.T) {
+	fake, client, stop := newFakeApiServer(t)
+	defer stop()
+	attr := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	fake.statuses = []Status{StatusInitialized, StatusConnected, StatusDone}
+	fake.result = &Result{
+		Status:     ProofStatusValid,
+		Attributes: map[irma.AttributeTypeIdentifier]string{attr: "456"},
+	}
+
+	session, err := client.StartDisclosure(disclosureRequest())
+	require.NoError(t, err)
+	require.Equal(t, "testrequestor", fake.jwtPayload["iss"])
+	require.Equal(t, irma.ActionDisclosing, session.Qr.Type)
+	require.Equal(t, client.URL+"verification/token", session.Qr.URL)
+	require.NoError(t, session.Qr.Validate())
+
+	result, err := session.AwaitResult(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "456", result.Attributes[attr])
+}
+
+func TestSessionErrors(t *testing.T) {
+	fake, client, stop := newFakeApiServer(t)
+	defer stop()
+
+	session, err := client.StartDisclosure(disclosureRequest())
+	require.NoError(t, err)
+
+	fake.statuses = []Status{StatusConnected}
+	err = session.Await(50 * time.Millisecond)
+	require.IsType(t, &irma.SessionError{}, err)
+	require.Equal(t, ErrorSessionTimeout, err.(*irma.SessionError).ErrorType)
+
+	fake.statuses = []Status{StatusCancelled}
+	err = session.Await(0)
+	require.Equal(t, ErrorSessionCancelled, err.(*irma.SessionError).ErrorType)
+
+	fake.result = &Result{Status: ProofStatusExpired}
+	result, err := session.Result()
+	require.Equal(t, ErrorInvalidProofs, err.(*irma.SessionError).ErrorType)
+	require.Equal(t, ProofStatusExpired, result.Status)
+
+	// A result signed by another key must be rejected
+	fake.key, err = rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = session.Result()
+	require.Equal(t, ErrorInvalidResult, err.(*irma.SessionError).ErrorType)
+
+	// Without the server public key, results are only accepted when explicitly allowed
+	client.ServerPublicKey = nil
+	_, err = session.Result()
+	require.Equal(t, ErrorInvalidResult, err.(*irma.SessionError).ErrorType)
+	client.InsecureSkipVerify = true
+	_, err = session.Result()
+	require.Equal(t, ErrorInvalidProofs, err.(*irma.SessionError).ErrorType)
+
+	// Expired results must be rejected
+	expired := irma.Timestamp(time.Now().Add(-time.Minute))
+	fake.result = &Result{Status: ProofStatusValid, Expiry: &expired}
+	_, err = session.Result()
+	require.Equal(t, ErrorInvalidResult, err.(*irma.SessionError).ErrorType)
+
+	session.Cancel()
+	require.True(t, fake.cancelled)
+}
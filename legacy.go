@@ -2,8 +2,9 @@ package irma
 
 import (
 	"encoding/json"
+	"fmt"
 	"math/big"
-
+	"sort"
 	"strings"
 	"time"
 
@@ -78,7 +79,7 @@ func (env *androidLogEnvelope) Parse() (interface{}, error) {
 		val := &androidLogRemoval{}
 		return val, json.Unmarshal(env.Value, val)
 	default:
-		return nil, errors.New("Invalid Android log type")
+		return nil, errors.Errorf("Invalid Android log type %s", env.Type)
 	}
 }
 
@@ -89,15 +90,18 @@ type androidLogEntry struct {
 	} `json:"credential"`
 }
 
-func (entry *androidLogEntry) GetTime() Timestamp {
+func (entry *androidLogEntry) GetTime() (Timestamp, error) {
 	// An example date directly from cardemu.xml: September 29, 2017 11:12:57 AM GMT+02:00
 	// Unfortunately, the seemingly appropriate format parameter for time.Parse, with
 	// "MST-07:00" at the end, makes time.Parse emit an error: "GMT+02" gets to be
 	// interpreted as the timezone, i.e. as MST, and then nothing gets mapped onto "-07".
 	// So, we put a space between "GMT" and "+02:00".
 	fixed := strings.Replace(entry.Time, "+", " +", 1)
-	parsed, _ := time.Parse(androidLogTimeFormat, fixed)
-	return Timestamp(parsed)
+	parsed, err := time.Parse(androidLogTimeFormat, fixed)
+	if err != nil {
+		return Timestamp{}, errors.WrapPrefix(err, "Invalid Android log timestamp", 0)
+	}
+	return Timestamp(parsed), nil
 }
 
 type androidLogIssuance struct {
@@ -117,3 +121,105 @@ type androidLogSignature struct {
 	androidLogVerification
 	Message string `json:"message"`
 }
+
+// AndroidLogEntry is a log entry of the old Android app, converted by ParseAndroidLogs.
+type AndroidLogEntry struct {
+	Type       Action // ActionIssuing, ActionDisclosing, ActionSigning, or "removal"
+	Time       Timestamp
+	Credential CredentialTypeIdentifier
+	Disclosed  []AttributeTypeIdentifier // In case of verification and signature entries
+	Message    string                    // In case of signature entries
+}
+
+// AndroidLogsError is returned by ParseAndroidLogs when some of the log entries could not
+// be parsed. These entries are skipped; the others are returned along with this error.
+type AndroidLogsError struct {
+	Skipped []error // Why each skipped entry could not be parsed
+}
+
+func (e *AndroidLogsError) Error() string {
+	msgs := make([]string, 0, len(e.Skipped))
+	for _, err := range e.Skipped {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("skipped %d Android log entries: %s", len(e.Skipped), strings.Join(msgs, "; "))
+}
+
+// ParseAndroidLogs parses the log entries that the old Android app stored as JSON in its cardemu.xml.
+// Entries that cannot be parsed, e.g. because of an unknown type or timestamp, are skipped
+// and reported in an *AndroidLogsError, which is returned along with the other entries.
+func ParseAndroidLogs(bts []byte) ([]*AndroidLogEntry, error) {
+	var envelopes []*androidLogEnvelope
+	if err := json.Unmarshal(bts, &envelopes); err != nil {
+		return nil, err
+	}
+
+	logs := make([]*AndroidLogEntry, 0, len(envelopes))
+	var skipped []error
+	for i, env := range envelopes {
+		entry, err := env.convert()
+		if err != nil {
+			skipped = append(skipped, errors.Errorf("entry %d: %s", i, err.Error()))
+			continue
+		}
+		logs = append(logs, entry)
+	}
+	if len(skipped) > 0 {
+		return logs, &AndroidLogsError{Skipped: skipped}
+	}
+	return logs, nil
+}
+
+func (env *androidLogEnvelope) convert() (*AndroidLogEntry, error) {
+	parsed, err := env.Parse()
+	if err != nil {
+		return nil, err
+	}
+	var entry *AndroidLogEntry
+	switch val := parsed.(type) {
+	case *androidLogIssuance:
+		entry, err = val.convert(ActionIssuing)
+	case *androidLogRemoval:
+		entry, err = val.convert(Action("removal"))
+	case *androidLogVerification:
+		if entry, err = val.convert(ActionDisclosing); err == nil {
+			entry.Disclosed = val.disclosed()
+		}
+	case *androidLogSignature:
+		if entry, err = val.convert(ActionSigning); err == nil {
+			entry.Disclosed = val.disclosed()
+			entry.Message = val.Message
+		}
+	}
+	return entry, err
+}
+
+func (entry *androidLogEntry) convert(action Action) (*AndroidLogEntry, error) {
+	t, err := entry.GetTime()
+	if err != nil {
+		return nil, err
+	}
+	return &AndroidLogEntry{
+		Type:       action,
+		Time:       t,
+		Credential: entry.Credential.Identifier,
+	}, nil
+}
+
+// disclosed returns the identifiers of the disclosed attributes, which the Android app
+// stored by their name within the credential type.
+func (entry *androidLogVerification) disclosed() []AttributeTypeIdentifier {
+	var attrs []AttributeTypeIdentifier
+	for name, disclosed := range entry.Disclosed {
+		if !disclosed {
+			continue
+		}
+		if strings.Contains(name, ".") {
+			attrs = append(attrs, NewAttributeTypeIdentifier(name))
+		} else {
+			attrs = append(attrs, NewAttributeTypeIdentifier(entry.Credential.Identifier.String()+"."+name))
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].String() < attrs[j].String() })
+	return attrs
+}
@@ -53,7 +53,7 @@ func (err *ApiError) Error() string {
 }
 
 // Qr contains the data of an IRMA session QR (as generated by irma_js),
-// suitable for NewSession().
+// suitable for NewSession(). Use ParseQr() to obtain one from a QR, deep link or universal link.
 type Qr struct {
 	// Server with which to perform the session
 	URL string `json:"u"`
@@ -120,6 +120,12 @@ const (
 	ErrorInvalidSchemeManager = ErrorType("invalidSchemeManager")
 	// Recovered panic
 	ErrorPanic = ErrorType("panic")
+	// Session to be resumed has expired, or is unknown to the server
+	ErrorSessionExpired = ErrorType("sessionExpired")
+	// Session to be resumed was already finished
+	ErrorSessionAnswered = ErrorType("sessionAnswered")
+	// Attributes chosen for disclosure are not among the candidates, e.g. as a policy denies disclosing them
+	ErrorInvalidChoice = ErrorType("invalidChoice")
 )
 
 func (e *SessionError) Error() string {
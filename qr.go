@@ -0,0 +1,158 @@
+package irma
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains functions for parsing and generating the various forms in which
+// an IRMA session can be started: raw QR JSON (as generated by irma_js), deep links
+// that open the IRMA app directly, and https universal links that embed the QR.
+
+const (
+	// DeepLinkPrefix is the prefix of deep links that start an IRMA session,
+	// followed by the URL-encoded QR JSON.
+	DeepLinkPrefix = "irma://qr/json/"
+	// UniversalLinkPrefix is the default prefix of universal links that start an IRMA session,
+	// followed by the URL-encoded QR JSON.
+	UniversalLinkPrefix = "https://irma.app/-/session#"
+)
+
+var protocolVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)$`)
+
+// ParseProtocolVersion parses a protocol version of the form "major.minor" (e.g. "2.1").
+func ParseProtocolVersion(version string) (major, minor int, err error) {
+	matches := protocolVersionPattern.FindStringSubmatch(version)
+	if len(matches) != 3 {
+		return 0, 0, errors.Errorf("Invalid protocol version '%s'", version)
+	}
+	if major, err = strconv.Atoi(matches[1]); err != nil {
+		return 0, 0, err
+	}
+	if minor, err = strconv.Atoi(matches[2]); err != nil {
+		return 0, 0, err
+	}
+	return
+}
+
+// ParseQr parses the specified string into a Qr, accepting raw QR JSON,
+// deep links (irma://qr/json/...) and https universal links having the (URL-encoded)
+// QR JSON as fragment. The resulting Qr is validated before it is returned.
+func ParseQr(s string) (*Qr, error) {
+	qr, err := DecodeQr(s)
+	if err != nil {
+		return nil, err
+	}
+	if err = qr.Validate(); err != nil {
+		return nil, err
+	}
+	return qr, nil
+}
+
+// DecodeQr is like ParseQr, but does not validate the resulting Qr.
+func DecodeQr(s string) (*Qr, error) {
+	s = strings.TrimSpace(s)
+	var qrjson string
+
+	switch {
+	case strings.HasPrefix(s, "{"):
+		qrjson = s
+	case strings.HasPrefix(s, DeepLinkPrefix):
+		var err error
+		if qrjson, err = url.PathUnescape(s[len(DeepLinkPrefix):]); err != nil {
+			return nil, errors.Errorf("Invalid deep link: %s", err.Error())
+		}
+	case strings.HasPrefix(s, "https://"):
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, errors.Errorf("Invalid universal link: %s", err.Error())
+		}
+		if u.Fragment == "" {
+			return nil, errors.New("Universal link does not contain a session QR")
+		}
+		qrjson = u.Fragment
+	default:
+		return nil, errors.New("Unrecognized session QR format")
+	}
+
+	qr := &Qr{}
+	if err := json.Unmarshal([]byte(qrjson), qr); err != nil {
+		return nil, errors.Errorf("Failed to parse session QR: %s", err.Error())
+	}
+	return qr, nil
+}
+
+// Validate checks that this Qr contains all fields necessary to start a session of its type,
+// and that its protocol versions are well-formed.
+func (qr *Qr) Validate() error {
+	if qr.URL == "" {
+		return errors.New("Session QR does not contain a server URL")
+	}
+
+	switch qr.Type {
+	case ActionSchemeManager:
+		return nil // This type does not involve the IRMA protocol, so no versions
+	case ActionDisclosing, ActionSigning, ActionIssuing: // nop
+	default:
+		return errors.Errorf("Session QR has unknown session type '%s'", qr.Type)
+	}
+
+	minmajor, minminor, err := ParseProtocolVersion(qr.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+	maxmajor, maxminor, err := ParseProtocolVersion(qr.ProtocolMaxVersion)
+	if err != nil {
+		return err
+	}
+	if maxmajor < minmajor || (maxmajor == minmajor && maxminor < minminor) {
+		return errors.Errorf("Session QR maximum protocol version %s is below minimum %s",
+			qr.ProtocolMaxVersion, qr.ProtocolVersion)
+	}
+	return nil
+}
+
+// JSON returns the JSON representation of this Qr, suitable for rendering as a QR code.
+func (qr *Qr) JSON() (string, error) {
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// DeepLink returns a deep link that starts the session of this Qr in the IRMA app.
+func (qr *Qr) DeepLink() (string, error) {
+	qrjson, err := qr.JSON()
+	if err != nil {
+		return "", err
+	}
+	return DeepLinkPrefix + url.PathEscape(qrjson), nil
+}
+
+// UniversalLink returns an https universal link that starts the session of this Qr.
+// If prefix is empty, UniversalLinkPrefix is used. As the Qr is put in the fragment of
+// the link, the prefix may not contain a fragment of its own (other than an empty one).
+func (qr *Qr) UniversalLink(prefix string) (string, error) {
+	if prefix == "" {
+		prefix = UniversalLinkPrefix
+	}
+	if !strings.HasPrefix(prefix, "https://") {
+		return "", errors.New("Universal link prefix must be an https URL")
+	}
+	prefix = strings.TrimSuffix(prefix, "#")
+	if strings.Contains(prefix, "#") {
+		return "", errors.New("Universal link prefix may not contain a fragment")
+	}
+	prefix += "#"
+	qrjson, err := qr.JSON()
+	if err != nil {
+		return "", err
+	}
+	return prefix + url.PathEscape(qrjson), nil
+}
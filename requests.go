@@ -40,6 +40,9 @@ func (sr *SessionRequest) SetDisclosureChoice(choice *DisclosureChoice) {
 type DisclosureRequest struct {
 	SessionRequest
 	Content AttributeDisjunctionList `json:"content"`
+	// Next optionally announces the issuance session that the server will start as a follow-up
+	// to this session, so that it can be approved along with this session.
+	Next *IssuanceRequest `json:"next,omitempty"`
 }
 
 // A SignatureRequest is a a request to sign a message with certain attributes.
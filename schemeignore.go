@@ -0,0 +1,183 @@
+package irma
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// SchemeIgnoreFile is the name of the file within a scheme manager folder that specifies,
+// one pattern per line, which files should not be signed. The syntax is a subset of that
+// of .gitignore files:
+//   - empty lines and lines starting with # are ignored;
+//   - a pattern ending with / only matches directories (and thereby everything under them);
+//   - a pattern containing a / is matched against the path relative to the scheme manager folder,
+//     other patterns are matched against the name of the file or of any directory above it;
+//   - patterns use the syntax of path.Match;
+//   - a pattern starting with ! includes files that an earlier pattern excluded.
+//
+// Later patterns take precedence over earlier ones.
+const SchemeIgnoreFile = ".schemeignore"
+
+// defaultSchemeIgnore contains the files that are never signed: the index and its signature
+// themselves, the scheme manager keys, the issuer private keys, and version control files.
+var defaultSchemeIgnore = []string{
+	"/index",
+	"/index.sig",
+	"/pk.pem",
+	"/sk.pem",
+	"PrivateKeys/",
+	".git/",
+}
+
+type schemeIgnoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// SchemeIgnore determines which files of a scheme manager folder are not signed.
+type SchemeIgnore struct {
+	rules []schemeIgnoreRule
+}
+
+// NewSchemeIgnore returns the rules for the specified scheme manager folder: the defaults,
+// followed by the rules from its .schemeignore file if present.
+func NewSchemeIgnore(dir string) (*SchemeIgnore, error) {
+	contents := ""
+	exists, err := fs.PathExists(filepath.Join(dir, SchemeIgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		bts, err := ioutil.ReadFile(filepath.Join(dir, SchemeIgnoreFile))
+		if err != nil {
+			return nil, err
+		}
+		contents = string(bts)
+	}
+	return ParseSchemeIgnore(contents), nil
+}
+
+// ParseSchemeIgnore returns the default rules followed by the rules in the specified
+// .schemeignore contents.
+func ParseSchemeIgnore(contents string) *SchemeIgnore {
+	ignore := &SchemeIgnore{}
+	lines := append(append([]string{}, defaultSchemeIgnore...), strings.Split(contents, "\n")...)
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := schemeIgnoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		ignore.rules = append(ignore.rules, rule)
+	}
+	return ignore
+}
+
+// matches checks if the rule matches the specified slash-separated relative path
+// of a file (or of a directory, if isDir).
+func (rule schemeIgnoreRule) matches(relative string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	var match bool
+	if rule.anchored {
+		match, _ = path.Match(rule.pattern, relative)
+	} else {
+		match, _ = path.Match(rule.pattern, path.Base(relative))
+	}
+	return match
+}
+
+// Ignored returns whether the file (or directory, if isDir) at the specified path relative
+// to the scheme manager folder should not be signed. A file is also ignored if any of the
+// directories above it is.
+func (ignore *SchemeIgnore) Ignored(relative string, isDir bool) bool {
+	relative = strings.Trim(filepath.ToSlash(relative), "/")
+	parts := strings.Split(relative, "/")
+	for i := 1; i < len(parts); i++ {
+		if ignore.ignored(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return ignore.ignored(relative, isDir)
+}
+
+func (ignore *SchemeIgnore) ignored(relative string, isDir bool) bool {
+	ignored := false
+	for _, rule := range ignore.rules {
+		if rule.matches(relative, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// WalkSchemeManagerFiles calls the handler for each file within the specified scheme manager folder
+// that is not ignored according to its .schemeignore file, passing the path relative to the folder.
+func WalkSchemeManagerFiles(dir string, handler func(relative string) error) error {
+	ignore, err := NewSchemeIgnore(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if relative == "." {
+			return nil
+		}
+		if ignore.Ignored(relative, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return handler(filepath.ToSlash(relative))
+	})
+}
+
+// UnsignedFiles returns the files present in the folder of the specified scheme manager
+// that are not ignored, but also not included in its index, relative to the Configuration path.
+func (conf *Configuration) UnsignedFiles(manager *SchemeManager) ([]string, error) {
+	var unsigned []string
+	err := WalkSchemeManagerFiles(filepath.Join(conf.Path, manager.ID), func(relative string) error {
+		file := manager.ID + "/" + relative
+		if _, signed := manager.index[file]; !signed {
+			unsigned = append(unsigned, file)
+		}
+		return nil
+	})
+	sort.Strings(unsigned)
+	return unsigned, err
+}
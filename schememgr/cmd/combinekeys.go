@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// combineKeysCmd represents the combine-keys command
+var combineKeysCmd = &cobra.Command{
+	Use:   "combine-keys pk.pem [pk.pem...]",
+	Short: "Combine public keys for co-signing a scheme manager",
+	Long: `The combine-keys command combines the specified public keys into a single pk.pem file, so that the scheme manager is only considered valid if its index is signed by at least the threshold number of these keys.
+
+Each maintainer then signs the scheme manager in turn using sign --cosign.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		threshold, err := cmd.Flags().GetInt("threshold")
+		if err != nil {
+			return err
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		// For safety we enforce that we never overwrite a file
+		if err = fs.AssertPathNotExists(output); err != nil {
+			return errors.Errorf("File %s already exists, not overwriting", output)
+		}
+
+		combined := &irma.SchemeManagerPublicKeys{Threshold: threshold}
+		seen := map[string]bool{}
+		for _, path := range args {
+			bts, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			pks, err := irma.ParseSchemeManagerPublicKeys(bts)
+			if err != nil {
+				return errors.Errorf("Failed to parse %s: %s", path, err)
+			}
+			for _, pk := range pks.Keys {
+				if err = addPublicKey(combined, seen, pk); err != nil {
+					return err
+				}
+			}
+		}
+
+		if threshold == 0 {
+			combined.Threshold = len(combined.Keys)
+		}
+		if combined.Threshold < 1 || combined.Threshold > len(combined.Keys) {
+			return errors.Errorf("Invalid threshold %d for %d keys", combined.Threshold, len(combined.Keys))
+		}
+		bts, err := irma.MarshalSchemeManagerPublicKeys(combined)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(output, bts, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("%d public keys written at %s, of which %d must sign\n", len(combined.Keys), output, combined.Threshold)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(combineKeysCmd)
+	combineKeysCmd.Flags().IntP("threshold", "t", 0, "number of keys that must sign (default all)")
+	combineKeysCmd.Flags().StringP("output", "o", "pk.pem", "filename for the combined public keys")
+}
+
+func addPublicKey(pks *irma.SchemeManagerPublicKeys, seen map[string]bool, pk crypto.PublicKey) error {
+	id, err := irma.PublicKeyID(pk)
+	if err != nil {
+		return err
+	}
+	if seen[id] {
+		return nil
+	}
+	seen[id] = true
+	pks.Keys = append(pks.Keys, pk)
+	return nil
+}
@@ -0,0 +1,438 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff old new",
+	Short: "Show the differences between two versions of a scheme manager",
+	Long: `The diff command compares two versions of a scheme manager, and reports the issuers, credential types, attributes and public keys that were added, removed or modified.
+
+Changes that break credentials that were issued using the old version, such as removed credential types, removed or reordered attributes, or removed or modified public keys, are flagged with a '!'.
+
+The arguments may also be two index files, in which case only the files that changed are reported.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		changes, err := RunDiff(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			fmt.Println("No changes")
+			return nil
+		}
+		breaking := 0
+		for _, change := range changes {
+			fmt.Println(change.String())
+			if change.Breaking {
+				breaking++
+			}
+		}
+		if breaking > 0 {
+			fmt.Printf("\n%d breaking changes\n", breaking)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+}
+
+// ChangeKind indicates whether something was added, removed or modified.
+type ChangeKind string
+
+const (
+	ChangeAdded    = ChangeKind("+")
+	ChangeRemoved  = ChangeKind("-")
+	ChangeModified = ChangeKind("~")
+)
+
+// Change is a difference between two versions of a scheme manager.
+type Change struct {
+	Kind    ChangeKind
+	Subject string
+	Detail  string
+	// Breaking indicates that credentials issued under the old version may be unusable under the new one
+	Breaking bool
+}
+
+func (c Change) String() string {
+	s := string(c.Kind) + " " + c.Subject
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	if c.Breaking {
+		s = "! " + s
+	} else {
+		s = "  " + s
+	}
+	return s
+}
+
+// schemeSnapshot contains the parsed contents of a scheme manager folder.
+type schemeSnapshot struct {
+	manager         *irma.SchemeManager
+	issuers         map[string]*irma.Issuer
+	credentialTypes map[string]*irma.CredentialType
+	// hashes of the public keys per issuer and counter
+	publicKeys map[string]map[int][]byte
+}
+
+// RunDiff compares the two specified scheme manager folders or index files.
+func RunDiff(oldpath, newpath string) ([]Change, error) {
+	oldinfo, err := os.Stat(oldpath)
+	if err != nil {
+		return nil, err
+	}
+	newinfo, err := os.Stat(newpath)
+	if err != nil {
+		return nil, err
+	}
+	if oldinfo.IsDir() != newinfo.IsDir() {
+		return nil, errors.New("Specify either two scheme manager folders or two index files")
+	}
+
+	if !oldinfo.IsDir() {
+		oldindex, err := readIndex(oldpath)
+		if err != nil {
+			return nil, err
+		}
+		newindex, err := readIndex(newpath)
+		if err != nil {
+			return nil, err
+		}
+		return diffIndices(oldindex, newindex), nil
+	}
+
+	oldscheme, err := readSchemeSnapshot(oldpath)
+	if err != nil {
+		return nil, err
+	}
+	newscheme, err := readSchemeSnapshot(newpath)
+	if err != nil {
+		return nil, err
+	}
+	return diffSchemes(oldscheme, newscheme), nil
+}
+
+func readIndex(path string) (irma.SchemeManagerIndex, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := irma.SchemeManagerIndex(make(map[string]irma.ConfigurationFileHash))
+	return index, index.FromString(string(bts))
+}
+
+func readXML(path string, dest interface{}) error {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal(bts, dest); err != nil {
+		return errors.Errorf("Failed to parse %s: %s", path, err)
+	}
+	return nil
+}
+
+func readSchemeSnapshot(dir string) (*schemeSnapshot, error) {
+	scheme := &schemeSnapshot{
+		manager:         &irma.SchemeManager{},
+		issuers:         map[string]*irma.Issuer{},
+		credentialTypes: map[string]*irma.CredentialType{},
+		publicKeys:      map[string]map[int][]byte{},
+	}
+	if err := readXML(filepath.Join(dir, "description.xml"), scheme.manager); err != nil {
+		return nil, err
+	}
+
+	issuerdirs, err := subdirectories(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, issuerdir := range issuerdirs {
+		issuer := &irma.Issuer{}
+		if err = readXML(filepath.Join(issuerdir, "description.xml"), issuer); err != nil {
+			return nil, err
+		}
+		issuerid := scheme.manager.ID + "." + issuer.ID
+		scheme.issuers[issuerid] = issuer
+
+		scheme.publicKeys[issuerid] = map[int][]byte{}
+		files, err := filepath.Glob(filepath.Join(issuerdir, "PublicKeys", "*.xml"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			counter, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".xml"))
+			if err != nil {
+				continue
+			}
+			bts, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			hash := sha256.Sum256(bts)
+			scheme.publicKeys[issuerid][counter] = hash[:]
+		}
+
+		credtypedirs, err := subdirectories(filepath.Join(issuerdir, "Issues"))
+		if err != nil {
+			return nil, err
+		}
+		for _, credtypedir := range credtypedirs {
+			credtype := &irma.CredentialType{}
+			if err = readXML(filepath.Join(credtypedir, "description.xml"), credtype); err != nil {
+				return nil, err
+			}
+			scheme.credentialTypes[issuerid+"."+credtype.ID] = credtype
+		}
+	}
+
+	return scheme, nil
+}
+
+// sortedUnion returns the sorted union of the specified lists of strings.
+func sortedUnion(lists ...[]string) []string {
+	set := map[string]struct{}{}
+	for _, list := range lists {
+		for _, str := range list {
+			set[str] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func translationKeys(str irma.TranslatedString) []string {
+	keys := make([]string, 0, len(str))
+	for key := range str {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func issuerKeys(issuers map[string]*irma.Issuer) []string {
+	keys := make([]string, 0, len(issuers))
+	for key := range issuers {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func credentialTypeKeys(credtypes map[string]*irma.CredentialType) []string {
+	keys := make([]string, 0, len(credtypes))
+	for key := range credtypes {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func indexKeys(index irma.SchemeManagerIndex) []string {
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// diffTranslations returns descriptions of the differences between the two translated strings.
+func diffTranslations(field string, old, updated irma.TranslatedString) []string {
+	var diffs []string
+	for _, lang := range sortedUnion(translationKeys(old), translationKeys(updated)) {
+		oldval, oldok := old[lang]
+		newval, newok := updated[lang]
+		switch {
+		case !oldok:
+			diffs = append(diffs, fmt.Sprintf("%s[%s] added: %q", field, lang, newval))
+		case !newok:
+			diffs = append(diffs, fmt.Sprintf("%s[%s] removed", field, lang))
+		case oldval != newval:
+			diffs = append(diffs, fmt.Sprintf("%s[%s] changed: %q -> %q", field, lang, oldval, newval))
+		}
+	}
+	return diffs
+}
+
+func diffStrings(field, old, updated string) []string {
+	if old == updated {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s changed: %q -> %q", field, old, updated)}
+}
+
+func modifications(subject string, breaking bool, diffs ...[]string) []Change {
+	var changes []Change
+	for _, list := range diffs {
+		for _, diff := range list {
+			changes = append(changes, Change{Kind: ChangeModified, Subject: subject, Detail: diff, Breaking: breaking})
+		}
+	}
+	return changes
+}
+
+func diffSchemes(old, updated *schemeSnapshot) []Change {
+	subject := "scheme manager " + updated.manager.ID
+	changes := modifications(subject, false,
+		diffStrings("Id", old.manager.ID, updated.manager.ID),
+		diffStrings("Url", old.manager.URL, updated.manager.URL),
+		diffTranslations("Name", old.manager.Name, updated.manager.Name),
+		diffTranslations("Description", old.manager.Description, updated.manager.Description),
+	)
+	changes = append(changes, modifications(subject, true,
+		diffStrings("KeyshareServer", old.manager.KeyshareServer, updated.manager.KeyshareServer),
+		diffStrings("KeyshareAttribute", old.manager.KeyshareAttribute, updated.manager.KeyshareAttribute),
+	)...)
+
+	for _, id := range sortedUnion(issuerKeys(old.issuers), issuerKeys(updated.issuers)) {
+		changes = append(changes, diffIssuer(id, old.issuers[id], updated.issuers[id])...)
+		changes = append(changes, diffPublicKeys(id, old.publicKeys[id], updated.publicKeys[id])...)
+	}
+	for _, id := range sortedUnion(credentialTypeKeys(old.credentialTypes), credentialTypeKeys(updated.credentialTypes)) {
+		changes = append(changes, diffCredentialType(id, old.credentialTypes[id], updated.credentialTypes[id])...)
+	}
+	return changes
+}
+
+func diffIssuer(id string, old, updated *irma.Issuer) []Change {
+	subject := "issuer " + id
+	switch {
+	case old == nil:
+		return []Change{{Kind: ChangeAdded, Subject: subject}}
+	case updated == nil:
+		return []Change{{Kind: ChangeRemoved, Subject: subject, Breaking: true}}
+	}
+	return modifications(subject, false,
+		diffTranslations("Name", old.Name, updated.Name),
+		diffTranslations("ShortName", old.ShortName, updated.ShortName),
+		diffStrings("ContactAddress", old.ContactAddress, updated.ContactAddress),
+		diffStrings("ContactEMail", old.ContactEMail, updated.ContactEMail),
+		diffStrings("baseURL", old.URL, updated.URL),
+	)
+}
+
+func diffPublicKeys(issuer string, old, updated map[int][]byte) []Change {
+	counters := map[int]struct{}{}
+	for counter := range old {
+		counters[counter] = struct{}{}
+	}
+	for counter := range updated {
+		counters[counter] = struct{}{}
+	}
+	sorted := make([]int, 0, len(counters))
+	for counter := range counters {
+		sorted = append(sorted, counter)
+	}
+	sort.Ints(sorted)
+
+	var changes []Change
+	for _, counter := range sorted {
+		subject := fmt.Sprintf("public key %d of issuer %s", counter, issuer)
+		oldhash, oldok := old[counter]
+		newhash, newok := updated[counter]
+		switch {
+		case !oldok:
+			changes = append(changes, Change{Kind: ChangeAdded, Subject: subject})
+		case !newok:
+			changes = append(changes, Change{Kind: ChangeRemoved, Subject: subject, Breaking: true})
+		case !bytes.Equal(oldhash, newhash):
+			changes = append(changes, Change{Kind: ChangeModified, Subject: subject, Breaking: true})
+		}
+	}
+	return changes
+}
+
+func diffCredentialType(id string, old, updated *irma.CredentialType) []Change {
+	subject := "credential type " + id
+	switch {
+	case old == nil:
+		return []Change{{Kind: ChangeAdded, Subject: subject}}
+	case updated == nil:
+		return []Change{{Kind: ChangeRemoved, Subject: subject, Breaking: true}}
+	}
+
+	changes := modifications(subject, false,
+		diffTranslations("Name", old.Name, updated.Name),
+		diffTranslations("ShortName", old.ShortName, updated.ShortName),
+		diffTranslations("Description", old.Description, updated.Description),
+	)
+	if old.IsSingleton != updated.IsSingleton {
+		changes = append(changes, Change{Kind: ChangeModified, Subject: subject,
+			Detail: fmt.Sprintf("ShouldBeSingleton changed: %t -> %t", old.IsSingleton, updated.IsSingleton)})
+	}
+
+	oldattrs := map[string]int{}
+	for i, attr := range old.Attributes {
+		oldattrs[attr.ID] = i
+	}
+	newattrs := map[string]int{}
+	for i, attr := range updated.Attributes {
+		newattrs[attr.ID] = i
+	}
+
+	// Credentials store their attributes by position, so adding, removing or reordering
+	// attributes breaks existing credentials of this type
+	for _, attr := range old.Attributes {
+		attrsubject := "attribute " + id + "." + attr.ID
+		j, ok := newattrs[attr.ID]
+		if !ok {
+			changes = append(changes, Change{Kind: ChangeRemoved, Subject: attrsubject, Breaking: true})
+			continue
+		}
+		if i := oldattrs[attr.ID]; i != j {
+			changes = append(changes, Change{Kind: ChangeModified, Subject: attrsubject,
+				Detail: fmt.Sprintf("position changed: %d -> %d", i, j), Breaking: true})
+		}
+		changes = append(changes, modifications(attrsubject, false,
+			diffTranslations("Name", attr.Name, updated.Attributes[j].Name),
+			diffTranslations("Description", attr.Description, updated.Attributes[j].Description),
+		)...)
+	}
+	for _, attr := range updated.Attributes {
+		if _, ok := oldattrs[attr.ID]; !ok {
+			changes = append(changes, Change{Kind: ChangeAdded, Subject: "attribute " + id + "." + attr.ID, Breaking: true})
+		}
+	}
+
+	return changes
+}
+
+// diffIndices reports the files that were added, removed or modified between the two indices.
+func diffIndices(old, updated irma.SchemeManagerIndex) []Change {
+	var changes []Change
+	for _, path := range sortedUnion(indexKeys(old), indexKeys(updated)) {
+		oldhash, oldok := old[path]
+		newhash, newok := updated[path]
+		subject := "file " + path
+		breaking := strings.Contains(path, "/PublicKeys/")
+		switch {
+		case !oldok:
+			changes = append(changes, Change{Kind: ChangeAdded, Subject: subject})
+		case !newok:
+			changes = append(changes, Change{Kind: ChangeRemoved, Subject: subject, Breaking: breaking})
+		case !bytes.Equal(oldhash, newhash):
+			changes = append(changes, Change{Kind: ChangeModified, Subject: subject, Breaking: breaking})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/stretchr/testify/require"
+)
+
+func changeStrings(changes []Change) []string {
+	strs := make([]string, 0, len(changes))
+	for _, change := range changes {
+		strs = append(strs, change.String())
+	}
+	return strs
+}
+
+func TestDiff(t *testing.T) {
+	old := "../../testdata/irma_configuration/irma-demo"
+	changes, err := RunDiff(old, old)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	dir, err := ioutil.TempDir("", "diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	updated := filepath.Join(dir, "irma-demo")
+	require.NoError(t, fs.CopyDirectory(old, updated))
+
+	credtypefile := filepath.Join(updated, "RU", "Issues", "studentCard", "description.xml")
+	bts, err := ioutil.ReadFile(credtypefile)
+	require.NoError(t, err)
+	description := strings.Replace(string(bts), "<en>Student Card</en>", "<en>Student ID</en>", 1)
+	description = strings.Replace(description, `<Attribute id="university">`, `<Attribute id="institute">`, 1)
+	require.NoError(t, ioutil.WriteFile(credtypefile, []byte(description), 0600))
+	require.NoError(t, os.Remove(filepath.Join(updated, "RU", "PublicKeys", "2.xml")))
+
+	changes, err = RunDiff(old, updated)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"! - public key 2 of issuer irma-demo.RU",
+		`  ~ credential type irma-demo.RU.studentCard: Name[en] changed: "Student Card" -> "Student ID"`,
+		"! - attribute irma-demo.RU.studentCard.university",
+		"! + attribute irma-demo.RU.studentCard.institute",
+	}, changeStrings(changes))
+
+	_, err = RunDiff(old, filepath.Join(old, "description.xml"))
+	require.Error(t, err)
+}
+
+func TestDiffIndices(t *testing.T) {
+	old := irma.SchemeManagerIndex{
+		"irma-demo/description.xml":         irma.ConfigurationFileHash{1},
+		"irma-demo/RU/PublicKeys/0.xml":     irma.ConfigurationFileHash{2},
+		"irma-demo/RU/description.xml":      irma.ConfigurationFileHash{3},
+		"irma-demo/MijnOverheid/logo.png":   irma.ConfigurationFileHash{4},
+		"irma-demo/RU/PublicKeys/1.xml":     irma.ConfigurationFileHash{5},
+		"irma-demo/MijnOverheid/PublicKeys": irma.ConfigurationFileHash{6},
+	}
+	updated := irma.SchemeManagerIndex{
+		"irma-demo/description.xml":         irma.ConfigurationFileHash{1},
+		"irma-demo/RU/PublicKeys/0.xml":     irma.ConfigurationFileHash{7},
+		"irma-demo/RU/description.xml":      irma.ConfigurationFileHash{8},
+		"irma-demo/RU/logo.png":             irma.ConfigurationFileHash{9},
+		"irma-demo/MijnOverheid/PublicKeys": irma.ConfigurationFileHash{6},
+	}
+	require.Equal(t, []string{
+		"  - file irma-demo/MijnOverheid/logo.png",
+		"! ~ file irma-demo/RU/PublicKeys/0.xml",
+		"! - file irma-demo/RU/PublicKeys/1.xml",
+		"  ~ file irma-demo/RU/description.xml",
+		"  + file irma-demo/RU/logo.png",
+	}, changeStrings(diffIndices(old, updated)))
+}
@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// issuerCmd groups the commands for managing issuers
+var issuerCmd = &cobra.Command{
+	Use:   "issuer",
+	Short: "Manage issuers and their keys",
+	Long:  `The issuer command groups subcommands for managing the issuers of a scheme manager and their keys.`,
+}
+
+var issuerKeygenCmd = &cobra.Command{
+	Use:   "keygen path_to_issuer",
+	Short: "Generate a new issuer private/public keypair",
+	Long: `The keygen command generates a new IRMA issuer private/public keypair, and writes them to PrivateKeys/N.xml and PublicKeys/N.xml in the specified issuer directory, where N is the next available key counter.
+
+Key generation may take a while, especially for larger key lengths.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keylength, err := cmd.Flags().GetInt("keylength")
+		if err != nil {
+			return err
+		}
+		numAttributes, err := cmd.Flags().GetInt("numattributes")
+		if err != nil {
+			return err
+		}
+		expiryFlag, err := cmd.Flags().GetString("expirydate")
+		if err != nil {
+			return err
+		}
+
+		if numAttributes < 1 {
+			return errors.New("Number of attributes must be positive")
+		}
+		expiry := time.Now().AddDate(1, 0, 0)
+		if expiryFlag != "" {
+			if expiry, err = time.Parse("2006-01-02", expiryFlag); err != nil {
+				return errors.Errorf("Invalid expiry date %s (use YYYY-MM-DD)", expiryFlag)
+			}
+		}
+		if expiry.Before(time.Now()) {
+			return errors.New("Expiry date lies in the past")
+		}
+
+		path, err := issuerPath(args[0])
+		if err != nil {
+			return err
+		}
+		return generateIssuerKeypair(path, keylength, numAttributes, expiry)
+	},
+}
+
+var issuerKeysCmd = &cobra.Command{
+	Use:   "keys path_to_issuer",
+	Short: "List the keys of an issuer",
+	Long:  `The keys command lists the public keys of the specified issuer directory, along with their counter and expiry date, and whether or not the corresponding private key is present.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := issuerPath(args[0])
+		if err != nil {
+			return err
+		}
+		counters, err := issuerKeyCounters(path)
+		if err != nil {
+			return err
+		}
+		if len(counters) == 0 {
+			fmt.Println("No keys found")
+			return nil
+		}
+
+		for _, counter := range counters {
+			filename := strconv.Itoa(counter) + ".xml"
+			pkfile := filepath.Join(path, "PublicKeys", filename)
+			skfile := filepath.Join(path, "PrivateKeys", filename)
+
+			line := fmt.Sprintf("%d:", counter)
+			if fs.AssertPathExists(pkfile) != nil {
+				line += " public key missing"
+			} else if pk, err := gabi.NewPublicKeyFromFile(pkfile); err != nil || pk == nil {
+				line += fmt.Sprintf(" invalid public key (%v)", err)
+			} else {
+				expiry := time.Unix(pk.ExpiryDate, 0)
+				line += fmt.Sprintf(" %d attributes, expires %s", len(pk.R), expiry.Format("2006-01-02"))
+				if expiry.Before(time.Now()) {
+					line += " (expired)"
+				}
+				if pk.Counter != uint(counter) {
+					line += fmt.Sprintf(", warning: key contains counter %d", pk.Counter)
+				}
+			}
+			if fs.AssertPathExists(skfile) == nil {
+				line += ", private key present"
+			}
+			fmt.Println(line)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(issuerCmd)
+	issuerCmd.AddCommand(issuerKeygenCmd)
+	issuerCmd.AddCommand(issuerKeysCmd)
+
+	issuerKeygenCmd.Flags().IntP("keylength", "l", 2048, "key length in bits (1024, 2048 or 4096)")
+	issuerKeygenCmd.Flags().IntP("numattributes", "a", 6, "maximum number of attributes, including the secret key and metadata attribute")
+	issuerKeygenCmd.Flags().StringP("expirydate", "e", "", "expiry date of the key as YYYY-MM-DD (default one year from now)")
+}
+
+// generateIssuerKeypair generates an issuer keypair with the next available counter, and writes it
+// to the PrivateKeys and PublicKeys folders of the specified issuer directory.
+func generateIssuerKeypair(path string, keylength, numAttributes int, expiry time.Time) error {
+	params, ok := gabi.DefaultSystemParameters[keylength]
+	if !ok {
+		return errors.Errorf("Unsupported key length %d (use 1024, 2048 or 4096)", keylength)
+	}
+
+	counter, err := nextIssuerKeyCounter(path)
+	if err != nil {
+		return err
+	}
+	skfile, pkfile, err := newIssuerKeyFiles(path, counter)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{filepath.Dir(skfile), filepath.Dir(pkfile)} {
+		if err = fs.EnsureDirectoryExists(dir); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Generating %d-bit key with counter %d for %d attributes, expiring at %s\n",
+		keylength, counter, numAttributes, expiry.Format("2006-01-02"))
+	sk, pk, err := gabi.GenerateKeyPair(params, numAttributes, uint(counter), expiry)
+	if err != nil {
+		return err
+	}
+
+	if _, err = sk.WriteToFile(skfile, false); err != nil {
+		return err
+	}
+	fmt.Println("Private key written at", skfile)
+	if _, err = pk.WriteToFile(pkfile, false); err != nil {
+		return err
+	}
+	fmt.Println("Public key written at", pkfile)
+	return nil
+}
+
+// nextIssuerKeyCounter returns the counter following the highest counter of the keys
+// present in the specified issuer directory, or 0 if there are none.
+func nextIssuerKeyCounter(path string) (int, error) {
+	counters, err := issuerKeyCounters(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(counters) == 0 {
+		return 0, nil
+	}
+	return counters[len(counters)-1] + 1, nil
+}
+
+// newIssuerKeyFiles returns the paths of the private and public key files with the specified
+// counter in the issuer directory. For safety we enforce that we never overwrite a file,
+// so an error is returned if either of them already exists.
+func newIssuerKeyFiles(path string, counter int) (skfile, pkfile string, err error) {
+	skfile = filepath.Join(path, "PrivateKeys", strconv.Itoa(counter)+".xml")
+	pkfile = filepath.Join(path, "PublicKeys", strconv.Itoa(counter)+".xml")
+	if err = fs.AssertPathNotExists(skfile); err != nil {
+		return "", "", errors.Errorf("File %s already exists, not overwriting", skfile)
+	}
+	if err = fs.AssertPathNotExists(pkfile); err != nil {
+		return "", "", errors.Errorf("File %s already exists, not overwriting", pkfile)
+	}
+	return skfile, pkfile, nil
+}
+
+// issuerPath checks that the specified path is an issuer directory and returns its absolute path.
+func issuerPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if err = fs.AssertPathExists(filepath.Join(path, "description.xml")); err != nil {
+		return "", errors.Errorf("%s is not an issuer directory: description.xml not found", path)
+	}
+	return path, nil
+}
+
+// issuerKeyCounters returns the sorted counters of the public and private keys
+// present in the specified issuer directory.
+func issuerKeyCounters(path string) ([]int, error) {
+	found := map[int]struct{}{}
+	for _, dir := range []string{"PublicKeys", "PrivateKeys"} {
+		files, err := filepath.Glob(filepath.Join(path, dir, "*.xml"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			i, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".xml"))
+			if err != nil {
+				continue
+			}
+			found[i] = struct{}{}
+		}
+	}
+
+	counters := make([]int, 0, len(found))
+	for i := range found {
+		counters = append(counters, i)
+	}
+	sort.Ints(counters)
+	return counters, nil
+}
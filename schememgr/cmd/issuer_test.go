@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIssuer creates an issuer directory containing the specified files, which are empty.
+func newTestIssuer(t *testing.T, files ...string) string {
+	path, err := ioutil.TempDir("", "issuer")
+	require.NoError(t, err)
+	for _, file := range append(files, "description.xml") {
+		file = filepath.Join(path, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0700))
+		require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	}
+	return path
+}
+
+func TestIssuerKeyCounters(t *testing.T) {
+	path := newTestIssuer(t)
+	defer os.RemoveAll(path)
+	counter, err := nextIssuerKeyCounter(path)
+	require.NoError(t, err)
+	require.Equal(t, 0, counter)
+
+	// Counters of public and private keys are both taken into account, other files are ignored
+	path = newTestIssuer(t, "PublicKeys/0.xml", "PublicKeys/1.xml", "PrivateKeys/1.xml",
+		"PrivateKeys/10.xml", "PublicKeys/foo.xml", "PublicKeys/2.txt")
+	defer os.RemoveAll(path)
+	counters, err := issuerKeyCounters(path)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 10}, counters)
+	counter, err = nextIssuerKeyCounter(path)
+	require.NoError(t, err)
+	require.Equal(t, 11, counter)
+}
+
+func TestIssuerKeyFilesNotOverwritten(t *testing.T) {
+	path := newTestIssuer(t, "PublicKeys/0.xml", "PrivateKeys/1.xml")
+	defer os.RemoveAll(path)
+
+	_, _, err := newIssuerKeyFiles(path, 0)
+	require.Error(t, err)
+	_, _, err = newIssuerKeyFiles(path, 1)
+	require.Error(t, err)
+	skfile, pkfile, err := newIssuerKeyFiles(path, 2)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(path, "PrivateKeys", "2.xml"), skfile)
+	require.Equal(t, filepath.Join(path, "PublicKeys", "2.xml"), pkfile)
+
+	require.Error(t, generateIssuerKeypair(path, 1000, 6, time.Now().AddDate(1, 0, 0)))
+	_, err = issuerPath(filepath.Join(path, "PublicKeys"))
+	require.Error(t, err)
+}
@@ -1,17 +1,18 @@
 package cmd
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
-	"os"
 
 	"io/ioutil"
 
 	"fmt"
 
+	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/go-errors/errors"
 	"github.com/spf13/cobra"
@@ -20,8 +21,8 @@ import (
 // keygenCmd represents the keygen command
 var keygenCmd = &cobra.Command{
 	Use:   "keygen",
-	Short: "Generate ECDSA private/public keypair",
-	Long:  `Generate an ECDSA private/public keypair suitable for signing IRMA scheme managers.`,
+	Short: "Generate private/public keypair for signing scheme managers",
+	Long:  `Generate an ECDSA (P-256 or P-384) or Ed25519 private/public keypair suitable for signing IRMA scheme managers.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		skfile, err := cmd.Flags().GetString("privatekey")
 		if err != nil {
@@ -31,49 +32,82 @@ var keygenCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-
-		// For safety we enforce that we never overwrite a file
-		if err := fs.AssertPathNotExists(skfile); err != nil {
-			return errors.Errorf("File %s already exists, not overwriting", skfile)
-		}
-		if err := fs.AssertPathNotExists(pkfile); err != nil {
-			return errors.Errorf("File %s already exists, not overwriting", pkfile)
-		}
-
-		// Generate keys
-		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		algorithm, err := cmd.Flags().GetString("algorithm")
 		if err != nil {
 			return err
 		}
 
-		// Marshal keys
-		bts, err := x509.MarshalECPrivateKey(key)
+		return generateSchemeKeypair(skfile, pkfile, irma.SignatureAlgorithm(algorithm))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(keygenCmd)
+	keygenCmd.Flags().StringP("privatekey", "s", "sk.pem", "filename for private key")
+	keygenCmd.Flags().StringP("publickey", "p", "pk.pem", "filename for public key")
+	keygenCmd.Flags().StringP("algorithm", "a", string(irma.SignatureAlgorithmECDSAP256),
+		fmt.Sprintf("signature algorithm (%s, %s or %s)", irma.SignatureAlgorithmECDSAP256, irma.SignatureAlgorithmECDSAP384, irma.SignatureAlgorithmEd25519))
+}
+
+// generateSchemeKeypair generates a keypair for signing scheme managers with the specified algorithm,
+// and writes it to the specified files, which must not yet exist.
+func generateSchemeKeypair(skfile, pkfile string, algorithm irma.SignatureAlgorithm) error {
+	// For safety we enforce that we never overwrite a file
+	if err := fs.AssertPathNotExists(skfile); err != nil {
+		return errors.Errorf("File %s already exists, not overwriting", skfile)
+	}
+	if err := fs.AssertPathNotExists(pkfile); err != nil {
+		return errors.Errorf("File %s already exists, not overwriting", pkfile)
+	}
+
+	// Generate and marshal keys
+	var key crypto.Signer
+	var pemEncoded []byte
+	switch algorithm {
+	case irma.SignatureAlgorithmECDSAP256, irma.SignatureAlgorithmECDSAP384:
+		curve := elliptic.P256()
+		if algorithm == irma.SignatureAlgorithmECDSAP384 {
+			curve = elliptic.P384()
+		}
+		eckey, err := ecdsa.GenerateKey(curve, rand.Reader)
 		if err != nil {
 			return err
 		}
-		pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bts})
-		bts, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+		bts, err := x509.MarshalECPrivateKey(eckey)
 		if err != nil {
-			os.Exit(1)
+			return err
 		}
-		pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
-
-		// Save keys
-		if err = ioutil.WriteFile(skfile, pemEncoded, 0600); err != nil {
+		key = eckey
+		pemEncoded = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bts})
+	case irma.SignatureAlgorithmEd25519:
+		edkey, err := generateEd25519Key()
+		if err != nil {
 			return err
 		}
-		fmt.Println("Private key written at", skfile)
-		if err = ioutil.WriteFile(pkfile, pemEncodedPub, 0644); err != nil {
+		bts, err := x509.MarshalPKCS8PrivateKey(edkey)
+		if err != nil {
 			return err
 		}
-		fmt.Println("Public key written at", pkfile)
+		key = edkey
+		pemEncoded = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bts})
+	default:
+		return errors.Errorf("Unsupported algorithm %s", algorithm)
+	}
+	bts, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
 
-		return nil
-	},
-}
+	// Save keys
+	if err = ioutil.WriteFile(skfile, pemEncoded, 0600); err != nil {
+		return err
+	}
+	fmt.Println("Private key written at", skfile)
+	if err = ioutil.WriteFile(pkfile, pemEncodedPub, 0644); err != nil {
+		return err
+	}
+	fmt.Println("Public key written at", pkfile)
 
-func init() {
-	RootCmd.AddCommand(keygenCmd)
-	keygenCmd.Flags().StringP("privatekey", "s", "sk.pem", "filename for private key")
-	keygenCmd.Flags().StringP("publickey", "p", "pk.pem", "filename for public key")
+	return nil
 }
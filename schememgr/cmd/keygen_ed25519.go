@@ -0,0 +1,15 @@
+//go:build go1.13
+// +build go1.13
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+)
+
+func generateEd25519Key() (crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
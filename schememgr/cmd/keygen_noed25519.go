@@ -0,0 +1,14 @@
+//go:build !go1.13
+// +build !go1.13
+
+package cmd
+
+import (
+	"crypto"
+
+	"github.com/go-errors/errors"
+)
+
+func generateEd25519Key() (crypto.Signer, error) {
+	return nil, errors.New("Ed25519 keys require schememgr to be built with Go 1.13 or later")
+}
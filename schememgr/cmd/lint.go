@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/mhe/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint path",
+	Short: "Check scheme manager contents for consistency",
+	Long: `The lint command checks the descriptions and public keys of the scheme manager at the specified path (or of all scheme managers, if the path is an irma_configuration folder) for consistency, reporting all problems that it finds.
+
+Unlike verify, lint does not check the signature of the scheme manager, so it can be used before signing. The command exits with a nonzero status if any errors were found.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOutput, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		problems, err := RunLint(args[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			bts, err := json.MarshalIndent(problems, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(bts))
+		} else {
+			for _, problem := range problems {
+				fmt.Println(problem.String())
+			}
+		}
+
+		if problems.ErrorCount() > 0 {
+			cmd.SilenceUsage = true
+			return errors.Errorf("%d errors, %d warnings", problems.ErrorCount(), len(problems)-problems.ErrorCount())
+		}
+		if !jsonOutput {
+			fmt.Printf("No errors, %d warnings\n", len(problems))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lintCmd)
+	lintCmd.Flags().Bool("json", false, "output problems as JSON")
+}
+
+// LintSeverity indicates whether a LintProblem is an error or a warning.
+type LintSeverity string
+
+const (
+	LintError   = LintSeverity("error")
+	LintWarning = LintSeverity("warning")
+)
+
+// LintProblem is a problem found by RunLint in a file of a scheme manager.
+type LintProblem struct {
+	Severity LintSeverity `json:"severity"`
+	Path     string       `json:"path"`
+	Message  string       `json:"message"`
+}
+
+// LintProblems is a list of problems found by RunLint.
+type LintProblems []LintProblem
+
+func (p LintProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Severity, p.Path, p.Message)
+}
+
+// ErrorCount returns the number of problems that are errors.
+func (problems LintProblems) ErrorCount() int {
+	count := 0
+	for _, problem := range problems {
+		if problem.Severity == LintError {
+			count++
+		}
+	}
+	return count
+}
+
+// linter accumulates the problems found in a scheme manager.
+type linter struct {
+	problems LintProblems
+}
+
+func (l *linter) errorf(path, format string, args ...interface{}) {
+	l.problems = append(l.problems, LintProblem{LintError, path, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(path, format string, args ...interface{}) {
+	l.problems = append(l.problems, LintProblem{LintWarning, path, fmt.Sprintf(format, args...)})
+}
+
+// RunLint checks the scheme manager at the specified path, or all scheme managers within it
+// if it is an irma_configuration folder, and returns the problems found. The returned error
+// is only non-nil if the path itself could not be read.
+func RunLint(path string) (LintProblems, error) {
+	if err := fs.AssertPathExists(path); err != nil {
+		return nil, err
+	}
+	l := &linter{problems: LintProblems{}}
+
+	if fs.AssertPathExists(filepath.Join(path, "description.xml")) == nil {
+		l.lintSchemeManager(path)
+		return l.problems, nil
+	}
+	dirs, err := subdirectories(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		l.errorf(path, "no scheme managers found")
+	}
+	for _, dir := range dirs {
+		l.lintSchemeManager(dir)
+	}
+	return l.problems, nil
+}
+
+// readDescription parses the description.xml in the specified directory into dest,
+// returning false (after reporting the problem) if it is absent or does not parse.
+func (l *linter) readDescription(dir string, dest interface{}) bool {
+	path := filepath.Join(dir, "description.xml")
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.errorf(path, "description not found")
+		return false
+	}
+	if err = xml.Unmarshal(bts, dest); err != nil {
+		l.errorf(path, "failed to parse description: %s", err)
+		return false
+	}
+	return true
+}
+
+func (l *linter) checkTranslatedString(path, field string, str irma.TranslatedString) {
+	if len(str) == 0 {
+		l.errorf(path, "%s is empty", field)
+		return
+	}
+	for _, lang := range []string{"en", "nl"} {
+		if str[lang] == "" {
+			l.warnf(path, "%s has no %s translation", field, lang)
+		}
+	}
+}
+
+func (l *linter) lintSchemeManager(dir string) {
+	path := filepath.Join(dir, "description.xml")
+	manager := &irma.SchemeManager{}
+	if !l.readDescription(dir, manager) {
+		return
+	}
+
+	if manager.XMLVersion < 7 {
+		l.errorf(path, "unsupported description version %d", manager.XMLVersion)
+	}
+	if manager.ID != filepath.Base(dir) {
+		l.errorf(path, "Id %s does not match directory name %s", manager.ID, filepath.Base(dir))
+	}
+	if manager.URL == "" {
+		l.errorf(path, "Url is empty")
+	} else if !strings.HasPrefix(manager.URL, "https://") {
+		l.warnf(path, "Url %s does not use https", manager.URL)
+	}
+	l.checkTranslatedString(path, "Name", manager.Name)
+	l.checkTranslatedString(path, "Description", manager.Description)
+	if manager.KeyshareServer != "" && manager.KeyshareAttribute == "" {
+		l.errorf(path, "KeyshareServer specified without KeyshareAttribute")
+	}
+	if bts, err := ioutil.ReadFile(filepath.Join(dir, "pk.pem")); err != nil {
+		l.warnf(dir, "scheme manager public key pk.pem not found")
+	} else if _, err = irma.ParseSchemeManagerPublicKeys(bts); err != nil {
+		l.errorf(filepath.Join(dir, "pk.pem"), "invalid public keys: %s", err)
+	}
+
+	issuerdirs, err := subdirectories(dir)
+	if err != nil {
+		l.errorf(dir, "failed to list issuers: %s", err)
+		return
+	}
+	credtypes := map[irma.CredentialTypeIdentifier]*irma.CredentialType{}
+	for _, issuerdir := range issuerdirs {
+		l.lintIssuer(issuerdir, manager.ID, credtypes)
+	}
+
+	if manager.KeyshareAttribute != "" {
+		attr := irma.NewAttributeTypeIdentifier(manager.KeyshareAttribute)
+		credtype := credtypes[attr.CredentialTypeIdentifier()]
+		if credtype == nil || !credtype.ContainsAttribute(attr) {
+			l.errorf(path, "KeyshareAttribute %s does not exist", manager.KeyshareAttribute)
+		}
+	}
+}
+
+func (l *linter) lintIssuer(dir, managerID string, credtypes map[irma.CredentialTypeIdentifier]*irma.CredentialType) {
+	path := filepath.Join(dir, "description.xml")
+	issuer := &irma.Issuer{}
+	if !l.readDescription(dir, issuer) {
+		return
+	}
+
+	if issuer.XMLVersion < 4 {
+		l.errorf(path, "unsupported description version %d", issuer.XMLVersion)
+	}
+	if issuer.ID != filepath.Base(dir) {
+		l.errorf(path, "ID %s does not match directory name %s", issuer.ID, filepath.Base(dir))
+	}
+	if issuer.SchemeManagerID != managerID {
+		l.errorf(path, "SchemeManager %s does not match scheme manager %s", issuer.SchemeManagerID, managerID)
+	}
+	l.checkTranslatedString(path, "Name", issuer.Name)
+	l.checkTranslatedString(path, "ShortName", issuer.ShortName)
+	if fs.AssertPathExists(filepath.Join(dir, "logo.png")) != nil {
+		l.errorf(dir, "logo.png not found")
+	}
+
+	keys := l.lintPublicKeys(dir)
+
+	credtypedirs, err := subdirectories(filepath.Join(dir, "Issues"))
+	if err != nil {
+		l.errorf(dir, "failed to list credential types: %s", err)
+		return
+	}
+	if len(credtypedirs) == 0 {
+		l.warnf(dir, "issuer has no credential types")
+	}
+	for _, credtypedir := range credtypedirs {
+		credtype := l.lintCredentialType(credtypedir, managerID, filepath.Base(dir), keys)
+		if credtype != nil {
+			credtypes[credtype.Identifier()] = credtype
+		}
+	}
+}
+
+// lintPublicKeys checks and returns the public keys in the PublicKeys folder of the issuer.
+func (l *linter) lintPublicKeys(dir string) map[string]*gabi.PublicKey {
+	keys := map[string]*gabi.PublicKey{}
+	files, err := filepath.Glob(filepath.Join(dir, "PublicKeys", "*.xml"))
+	if err != nil {
+		l.errorf(dir, "failed to list public keys: %s", err)
+		return keys
+	}
+	if len(files) == 0 {
+		l.errorf(dir, "issuer has no public keys")
+		return keys
+	}
+
+	var valid bool
+	for _, file := range files {
+		counter, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".xml"))
+		if err != nil {
+			l.errorf(file, "filename is not a key counter")
+			continue
+		}
+		pk, err := gabi.NewPublicKeyFromFile(file)
+		if err != nil || pk == nil {
+			l.errorf(file, "failed to parse public key: %v", err)
+			continue
+		}
+		if pk.Counter != uint(counter) {
+			l.warnf(file, "Counter %d does not match filename", pk.Counter)
+		}
+		if time.Unix(pk.ExpiryDate, 0).After(time.Now()) {
+			valid = true
+		}
+		keys[file] = pk
+	}
+	if len(keys) > 0 && !valid {
+		l.warnf(dir, "all public keys have expired")
+	}
+	return keys
+}
+
+func (l *linter) lintCredentialType(dir, managerID, issuerID string, keys map[string]*gabi.PublicKey) *irma.CredentialType {
+	path := filepath.Join(dir, "description.xml")
+	credtype := &irma.CredentialType{}
+	if !l.readDescription(dir, credtype) {
+		return nil
+	}
+
+	if credtype.XMLVersion < 4 {
+		l.errorf(path, "unsupported description version %d", credtype.XMLVersion)
+	}
+	if credtype.ID != filepath.Base(dir) {
+		l.errorf(path, "CredentialID %s does not match directory name %s", credtype.ID, filepath.Base(dir))
+	}
+	if credtype.IssuerID != issuerID {
+		l.errorf(path, "IssuerID %s does not match issuer %s", credtype.IssuerID, issuerID)
+	}
+	if credtype.SchemeManagerID != managerID {
+		l.errorf(path, "SchemeManager %s does not match scheme manager %s", credtype.SchemeManagerID, managerID)
+	}
+	l.checkTranslatedString(path, "Name", credtype.Name)
+	l.checkTranslatedString(path, "ShortName", credtype.ShortName)
+	if fs.AssertPathExists(filepath.Join(dir, "logo.png")) != nil {
+		l.warnf(dir, "logo.png not found")
+	}
+
+	if len(credtype.Attributes) == 0 {
+		l.errorf(path, "credential type has no attributes")
+	}
+	ids := map[string]bool{}
+	for i, attr := range credtype.Attributes {
+		if attr.ID == "" {
+			l.errorf(path, "attribute %d has no id", i)
+			continue
+		}
+		if ids[attr.ID] {
+			l.errorf(path, "duplicate attribute id %s", attr.ID)
+		}
+		ids[attr.ID] = true
+		l.checkTranslatedString(path, "Name of attribute "+attr.ID, attr.Name)
+	}
+
+	// Besides the attributes, a credential contains the secret key and the metadata attribute
+	needed := len(credtype.Attributes) + 2
+	for file, pk := range keys {
+		if len(pk.R) >= needed {
+			continue
+		}
+		if time.Unix(pk.ExpiryDate, 0).After(time.Now()) {
+			l.errorf(path, "public key %s has %d attribute bases, but %d are needed", file, len(pk.R), needed)
+		} else {
+			l.warnf(path, "expired public key %s has %d attribute bases, but %d are needed", file, len(pk.R), needed)
+		}
+	}
+
+	return credtype
+}
+
+// subdirectories returns the subdirectories of the specified path, skipping .git
+// and the PublicKeys, PrivateKeys and Issues folders of issuers.
+func subdirectories(path string) ([]string, error) {
+	if fs.AssertPathExists(path) != nil {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, file := range files {
+		switch file.Name() {
+		case ".git", "PublicKeys", "PrivateKeys", "Issues":
+			continue
+		}
+		if file.IsDir() {
+			dirs = append(dirs, filepath.Join(path, file.Name()))
+		}
+	}
+	return dirs, nil
+}
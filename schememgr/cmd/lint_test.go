@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/stretchr/testify/require"
+)
+
+// requireProblem checks that problems contains a problem of the specified severity about the
+// specified file (relative to dir) whose message contains the specified text.
+func requireProblem(t *testing.T, problems LintProblems, severity LintSeverity, dir, file, text string) {
+	for _, problem := range problems {
+		if problem.Severity == severity && problem.Path == filepath.Join(dir, file) && strings.Contains(problem.Message, text) {
+			return
+		}
+	}
+	t.Fatalf("No %s about %s containing '%s' in %v", severity, file, text, problems)
+}
+
+func TestLint(t *testing.T) {
+	problems, err := RunLint("../../testdata/irma_configuration")
+	require.NoError(t, err)
+	require.Zero(t, problems.ErrorCount(), "%v", problems)
+
+	_, err = RunLint("../../testdata/nonexisting")
+	require.Error(t, err)
+}
+
+func TestLintProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "irma-demo")
+	require.NoError(t, fs.CopyDirectory("../../testdata/irma_configuration/irma-demo", dir))
+
+	// Introduce a number of problems in the scheme manager
+	credtypefile := filepath.Join(dir, "RU", "Issues", "studentCard", "description.xml")
+	bts, err := ioutil.ReadFile(credtypefile)
+	require.NoError(t, err)
+	description := strings.Replace(string(bts), "<IssuerID>RU</IssuerID>", "<IssuerID>UU</IssuerID>", 1)
+	description = strings.Replace(description, `<Attribute id="university">`, `<Attribute id="studentID">`, 1)
+	description = strings.Replace(description, "<nl>Studentenkaart</nl>", "", 1)
+	require.NoError(t, ioutil.WriteFile(credtypefile, []byte(description), 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "RU", "logo.png")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "MijnOverheid", "PublicKeys")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pk.pem"), []byte("foo"), 0600))
+
+	problems, err := RunLint(dir)
+	require.NoError(t, err)
+	requireProblem(t, problems, LintError, dir, "RU/Issues/studentCard/description.xml", "IssuerID UU does not match issuer RU")
+	requireProblem(t, problems, LintError, dir, "RU/Issues/studentCard/description.xml", "duplicate attribute id studentID")
+	requireProblem(t, problems, LintWarning, dir, "RU/Issues/studentCard/description.xml", "Name has no nl translation")
+	requireProblem(t, problems, LintError, dir, "RU", "logo.png not found")
+	requireProblem(t, problems, LintError, dir, "MijnOverheid", "issuer has no public keys")
+	requireProblem(t, problems, LintError, dir, "pk.pem", "invalid public keys")
+	require.Equal(t, 5, problems.ErrorCount())
+}
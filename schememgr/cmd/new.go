@@ -0,0 +1,483 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// newCmd groups the scaffolding commands
+var newCmd = &cobra.Command{
+	Use:   "new",
+	Short: "Create a new scheme manager, issuer or credential type",
+	Long: `The new command groups subcommands that create the folders and description.xml files of new scheme managers, issuers and credential types.
+
+Required values that are not specified using flags are asked for interactively. Dutch translations default to the English ones.`,
+}
+
+var newSchemeCmd = &cobra.Command{
+	Use:   "scheme path",
+	Short: "Create a new scheme manager",
+	Long: `The scheme command creates a new scheme manager folder at the specified path, whose name is used as the scheme manager ID.
+
+With --keygen, an ECDSA keypair is generated in the folder (sk.pem and pk.pem), with which the scheme manager is then signed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		if err = fs.AssertPathNotExists(path); err != nil {
+			return errors.Errorf("%s already exists, not overwriting", path)
+		}
+
+		f := newFlagReader(cmd)
+		manager := &schemeDescription{ID: filepath.Base(path)}
+		manager.Name = f.translated("name", "Name", true)
+		manager.Description = f.translated("description", "Description", true)
+		manager.URL = f.ask("url", "URL at which the scheme manager will be hosted", true)
+		manager.Contact = f.string("contact")
+		manager.KeyshareServer = f.string("keyshare-server")
+		manager.KeyshareWebsite = f.string("keyshare-website")
+		manager.KeyshareAttribute = f.string("keyshare-attribute")
+		keygen := f.bool("keygen")
+		if f.err != nil {
+			return f.err
+		}
+		if !validID(manager.ID) {
+			return errors.Errorf("Invalid scheme manager ID %s", manager.ID)
+		}
+
+		if err = fs.EnsureDirectoryExists(path); err != nil {
+			return err
+		}
+		if err = writeDescription(path, schemeTemplate, manager); err != nil {
+			return err
+		}
+		if !keygen {
+			return nil
+		}
+		skfile := filepath.Join(path, "sk.pem")
+		if err = generateSchemeKeypair(skfile, filepath.Join(path, "pk.pem"), irma.SignatureAlgorithmECDSAP256); err != nil {
+			return err
+		}
+		signManager(skfile, path, false)
+		fmt.Println("Scheme manager signed")
+		return nil
+	},
+}
+
+var newIssuerCmd = &cobra.Command{
+	Use:   "issuer path_to_scheme id",
+	Short: "Create a new issuer",
+	Long: `The issuer command creates a new issuer with the specified ID in the specified scheme manager folder, along with a placeholder logo.
+
+With --keygen, an issuer keypair is generated using the defaults of the issuer keygen command. With --sign, the scheme manager is signed afterwards using the specified private key.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, schemepath, err := readSchemeDescription(args[0])
+		if err != nil {
+			return err
+		}
+		if !validID(args[1]) {
+			return errors.Errorf("Invalid issuer ID %s", args[1])
+		}
+		path := filepath.Join(schemepath, args[1])
+		if err = fs.AssertPathNotExists(path); err != nil {
+			return errors.Errorf("%s already exists, not overwriting", path)
+		}
+
+		f := newFlagReader(cmd)
+		issuer := &issuerDescription{ID: args[1], SchemeManagerID: manager.ID}
+		issuer.Name = f.translated("name", "Name", true)
+		issuer.ShortName = f.translated("shortname", "Short name", false)
+		issuer.ContactEMail = f.ask("email", "Contact e-mail address", true)
+		issuer.ContactAddress = f.string("address")
+		issuer.URL = f.string("url")
+		keygen := f.bool("keygen")
+		sign := f.string("sign")
+		if f.err != nil {
+			return f.err
+		}
+		if len(issuer.ShortName) == 0 {
+			issuer.ShortName = issuer.Name
+		}
+
+		if err = fs.EnsureDirectoryExists(path); err != nil {
+			return err
+		}
+		if err = fs.EnsureDirectoryExists(filepath.Join(path, "Issues")); err != nil {
+			return err
+		}
+		if err = writeDescription(path, issuerTemplate, issuer); err != nil {
+			return err
+		}
+		if err = writePlaceholderLogo(path, manager.ID+"."+issuer.ID); err != nil {
+			return err
+		}
+		if keygen {
+			if err = generateIssuerKeypair(path, 2048, 6, time.Now().AddDate(1, 0, 0)); err != nil {
+				return err
+			}
+		}
+		if sign != "" {
+			signManager(sign, schemepath, false)
+			fmt.Println("Scheme manager signed")
+		}
+		return nil
+	},
+}
+
+var newCredentialCmd = &cobra.Command{
+	Use:   "credential path_to_issuer id",
+	Short: "Create a new credential type",
+	Long: `The credential command creates a new credential type with the specified ID under the specified issuer folder, along with a placeholder logo.
+
+Attributes are specified with --attributes as a comma-separated list of IDs; their names can be edited afterwards in the created description.xml. With --sign, the scheme manager is signed afterwards using the specified private key.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		issuerpath, err := issuerPath(args[0])
+		if err != nil {
+			return err
+		}
+		issuer := &irma.Issuer{}
+		if err = readXML(filepath.Join(issuerpath, "description.xml"), issuer); err != nil {
+			return err
+		}
+		if !validID(args[1]) {
+			return errors.Errorf("Invalid credential type ID %s", args[1])
+		}
+		path := filepath.Join(issuerpath, "Issues", args[1])
+		if err = fs.AssertPathNotExists(path); err != nil {
+			return errors.Errorf("%s already exists, not overwriting", path)
+		}
+
+		f := newFlagReader(cmd)
+		credtype := &credentialDescription{ID: args[1], IssuerID: issuer.ID, SchemeManagerID: issuer.SchemeManagerID}
+		credtype.Name = f.translated("name", "Name", true)
+		credtype.ShortName = f.translated("shortname", "Short name", false)
+		credtype.Description = f.translated("description", "Description", true)
+		credtype.IsSingleton = f.bool("singleton")
+		attributes := f.ask("attributes", "Attribute IDs (comma-separated)", true)
+		sign := f.string("sign")
+		if f.err != nil {
+			return f.err
+		}
+		if len(credtype.ShortName) == 0 {
+			credtype.ShortName = credtype.Name
+		}
+		seen := map[string]bool{}
+		for _, id := range strings.Split(attributes, ",") {
+			id = strings.TrimSpace(id)
+			if !validID(id) || seen[id] {
+				return errors.Errorf("Invalid or duplicate attribute ID %s", id)
+			}
+			seen[id] = true
+			credtype.Attributes = append(credtype.Attributes, irma.AttributeDescription{
+				ID:          id,
+				Name:        irma.TranslatedString{"en": id, "nl": id},
+				Description: irma.TranslatedString{"en": id, "nl": id},
+			})
+		}
+
+		if err = fs.EnsureDirectoryExists(filepath.Join(issuerpath, "Issues")); err != nil {
+			return err
+		}
+		if err = fs.EnsureDirectoryExists(path); err != nil {
+			return err
+		}
+		if err = writeDescription(path, credentialTemplate, credtype); err != nil {
+			return err
+		}
+		if err = writePlaceholderLogo(path, issuer.SchemeManagerID+"."+issuer.ID+"."+credtype.ID); err != nil {
+			return err
+		}
+		if sign != "" {
+			signManager(sign, filepath.Dir(issuerpath), false)
+			fmt.Println("Scheme manager signed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(newCmd)
+	newCmd.AddCommand(newSchemeCmd)
+	newCmd.AddCommand(newIssuerCmd)
+	newCmd.AddCommand(newCredentialCmd)
+
+	addTranslatedFlag(newSchemeCmd, "name", "name of the scheme manager")
+	addTranslatedFlag(newSchemeCmd, "description", "description of the scheme manager")
+	newSchemeCmd.Flags().String("url", "", "URL at which the scheme manager will be hosted")
+	newSchemeCmd.Flags().String("contact", "", "contact URL")
+	newSchemeCmd.Flags().String("keyshare-server", "", "URL of the keyshare server")
+	newSchemeCmd.Flags().String("keyshare-website", "", "URL of the keyshare website")
+	newSchemeCmd.Flags().String("keyshare-attribute", "", "identifier of the keyshare attribute")
+	newSchemeCmd.Flags().Bool("keygen", false, "generate a scheme manager keypair and sign")
+
+	addTranslatedFlag(newIssuerCmd, "name", "name of the issuer")
+	addTranslatedFlag(newIssuerCmd, "shortname", "short name of the issuer")
+	newIssuerCmd.Flags().String("email", "", "contact e-mail address")
+	newIssuerCmd.Flags().String("address", "", "contact address")
+	newIssuerCmd.Flags().String("url", "", "base URL")
+	newIssuerCmd.Flags().Bool("keygen", false, "generate an issuer keypair")
+	newIssuerCmd.Flags().String("sign", "", "sign the scheme manager afterwards using this private key")
+
+	addTranslatedFlag(newCredentialCmd, "name", "name of the credential type")
+	addTranslatedFlag(newCredentialCmd, "shortname", "short name of the credential type")
+	addTranslatedFlag(newCredentialCmd, "description", "description of the credential type")
+	newCredentialCmd.Flags().String("attributes", "", "comma-separated attribute IDs")
+	newCredentialCmd.Flags().Bool("singleton", false, "users may have at most one instance of the credential type")
+	newCredentialCmd.Flags().String("sign", "", "sign the scheme manager afterwards using this private key")
+}
+
+func addTranslatedFlag(cmd *cobra.Command, name, usage string) {
+	cmd.Flags().String(name, "", usage+" in English")
+	cmd.Flags().String(name+"-nl", "", usage+" in Dutch (default the English one)")
+}
+
+var idRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// validID checks that the specified ID may be used as (part of) an IRMA identifier.
+func validID(id string) bool {
+	return idRegexp.MatchString(id)
+}
+
+// flagReader reads the values of flags, asking for missing ones on stdin.
+// Any error is kept and returned by the err field, so that a series of values
+// can be read before checking for errors.
+type flagReader struct {
+	cmd *cobra.Command
+	in  *bufio.Reader
+	err error
+}
+
+func newFlagReader(cmd *cobra.Command) *flagReader {
+	return &flagReader{cmd: cmd, in: bufio.NewReader(os.Stdin)}
+}
+
+func (f *flagReader) string(name string) string {
+	if f.err != nil {
+		return ""
+	}
+	val, err := f.cmd.Flags().GetString(name)
+	f.err = err
+	return val
+}
+
+func (f *flagReader) bool(name string) bool {
+	if f.err != nil {
+		return false
+	}
+	val, err := f.cmd.Flags().GetBool(name)
+	f.err = err
+	return val
+}
+
+// ask returns the value of the specified flag, asking for it on stdin if it is required
+// but was not specified.
+func (f *flagReader) ask(name, question string, required bool) string {
+	val := f.string(name)
+	if val != "" || f.err != nil || !required {
+		return val
+	}
+
+	fmt.Printf("%s: ", question)
+	line, _ := f.in.ReadString('\n')
+	if val = strings.TrimSpace(line); val == "" {
+		f.err = errors.Errorf("%s is required (--%s)", question, name)
+	}
+	return val
+}
+
+// translated returns the English and Dutch values of the specified translated flag.
+func (f *flagReader) translated(name, question string, required bool) irma.TranslatedString {
+	en := f.ask(name, question, required)
+	if en == "" {
+		return irma.TranslatedString{}
+	}
+	nl := f.string(name + "-nl")
+	if nl == "" {
+		nl = en
+	}
+	return irma.TranslatedString{"en": en, "nl": nl}
+}
+
+func readSchemeDescription(path string) (*irma.SchemeManager, string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	manager := &irma.SchemeManager{}
+	if err = readXML(filepath.Join(path, "description.xml"), manager); err != nil {
+		return nil, "", errors.Errorf("%s is not a scheme manager folder: %s", path, err)
+	}
+	return manager, path, nil
+}
+
+// The description types below contain the fields of the corresponding irma types
+// that we write into description.xml files.
+
+type schemeDescription struct {
+	ID, URL, Contact                                   string
+	Name, Description                                  irma.TranslatedString
+	KeyshareServer, KeyshareWebsite, KeyshareAttribute string
+}
+
+type issuerDescription struct {
+	ID, SchemeManagerID, ContactEMail, ContactAddress, URL string
+	Name, ShortName                                        irma.TranslatedString
+}
+
+type credentialDescription struct {
+	ID, IssuerID, SchemeManagerID string
+	Name, ShortName, Description  irma.TranslatedString
+	IsSingleton                   bool
+	Attributes                    []irma.AttributeDescription
+}
+
+var descriptionFuncs = template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var b bytes.Buffer
+		err := xml.EscapeText(&b, []byte(s))
+		return b.String(), err
+	},
+	// translations renders a TranslatedString as indented <lang> elements, English and Dutch first
+	"translations": func(ts irma.TranslatedString, indent int) (string, error) {
+		langs := make([]string, 0, len(ts))
+		for lang := range ts {
+			if lang != "en" && lang != "nl" {
+				langs = append(langs, lang)
+			}
+		}
+		sort.Strings(langs)
+		langs = append([]string{"en", "nl"}, langs...)
+
+		var b bytes.Buffer
+		for _, lang := range langs {
+			text, ok := ts[lang]
+			if !ok {
+				continue
+			}
+			b.WriteString(strings.Repeat("\t", indent) + "<" + lang + ">")
+			if err := xml.EscapeText(&b, []byte(text)); err != nil {
+				return "", err
+			}
+			b.WriteString("</" + lang + ">\n")
+		}
+		return b.String(), nil
+	},
+}
+
+var schemeTemplate = template.Must(template.New("scheme").Funcs(descriptionFuncs).Parse(
+	`<SchemeManager version="7">
+	<Id>{{xml .ID}}</Id>
+	<Url>{{xml .URL}}</Url>
+	<Name>
+{{translations .Name 2}}	</Name>
+	<Description>
+{{translations .Description 2}}	</Description>
+{{- if .KeyshareServer}}
+	<KeyshareServer>{{xml .KeyshareServer}}</KeyshareServer>
+	<KeyshareWebsite>{{xml .KeyshareWebsite}}</KeyshareWebsite>
+	<KeyshareAttribute>{{xml .KeyshareAttribute}}</KeyshareAttribute>
+{{- end}}
+	<Contact>{{xml .Contact}}</Contact>
+</SchemeManager>
+`))
+
+var issuerTemplate = template.Must(template.New("issuer").Funcs(descriptionFuncs).Parse(
+	`<Issuer version="4">
+	<ID>{{xml .ID}}</ID>
+	<Name>
+{{translations .Name 2}}	</Name>
+	<ShortName>
+{{translations .ShortName 2}}	</ShortName>
+	<SchemeManager>{{xml .SchemeManagerID}}</SchemeManager>
+	<ContactAddress>{{xml .ContactAddress}}</ContactAddress>
+	<ContactEMail>{{xml .ContactEMail}}</ContactEMail>
+	<baseURL>{{xml .URL}}</baseURL>
+</Issuer>
+`))
+
+var credentialTemplate = template.Must(template.New("credential").Funcs(descriptionFuncs).Parse(
+	`<IssueSpecification version="4">
+	<Name>
+{{translations .Name 2}}	</Name>
+	<ShortName>
+{{translations .ShortName 2}}	</ShortName>
+	<SchemeManager>{{xml .SchemeManagerID}}</SchemeManager>
+	<IssuerID>{{xml .IssuerID}}</IssuerID>
+	<CredentialID>{{xml .ID}}</CredentialID>
+	<Description>
+{{translations .Description 2}}	</Description>
+	<ShouldBeSingleton>{{.IsSingleton}}</ShouldBeSingleton>
+
+	<Attributes>
+{{- range .Attributes}}
+		<Attribute id="{{xml .ID}}">
+			<Name>
+{{translations .Name 4}}			</Name>
+			<Description>
+{{translations .Description 4}}			</Description>
+		</Attribute>
+{{- end}}
+	</Attributes>
+</IssueSpecification>
+`))
+
+func writeDescription(dir string, tmpl *template.Template, description interface{}) error {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, description); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "description.xml")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Description written at", path)
+	return nil
+}
+
+// writePlaceholderLogo writes a logo.png to the specified directory consisting of a single color,
+// derived from the specified identifier so that different issuers and credential types can be
+// told apart until real logos are added.
+func writePlaceholderLogo(dir, id string) error {
+	hash := sha256.Sum256([]byte(id))
+	c := color.RGBA{R: hash[0], G: hash[1], B: hash[2], A: 255}
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "logo.png")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Placeholder logo written at", path)
+	return nil
+}
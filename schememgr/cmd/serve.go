@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve path [path...]",
+	Short: "Serve scheme manager folders over HTTP",
+	Long: `The serve command serves the specified scheme manager folders over HTTP, in the layout that IRMA clients expect when installing or updating a scheme manager. A scheme manager with ID foo is served at http://address/foo. Private keys are not served.
+
+With --qr, a scheme manager session QR is printed for each scheme manager, with which it can be installed in an IRMA app.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		address, err := cmd.Flags().GetString("address")
+		if err != nil {
+			return err
+		}
+		url, err := cmd.Flags().GetString("url")
+		if err != nil {
+			return err
+		}
+		printQr, err := cmd.Flags().GetBool("qr")
+		if err != nil {
+			return err
+		}
+		if url == "" {
+			url = "http://" + address
+		}
+
+		server, err := irma.NewSchemeManagerServer(args...)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, 0, len(server.Managers))
+		for id := range server.Managers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			managerURL := server.URL(url, irma.NewSchemeManagerIdentifier(id))
+			fmt.Printf("Serving %s from %s at %s\n", id, server.Managers[id], managerURL)
+			if printQr {
+				qr := &irma.Qr{Type: irma.ActionSchemeManager, URL: managerURL}
+				json, err := qr.JSON()
+				if err != nil {
+					return err
+				}
+				link, err := qr.DeepLink()
+				if err != nil {
+					return err
+				}
+				fmt.Println("  QR       :", json)
+				fmt.Println("  Deep link:", link)
+			}
+		}
+
+		return http.ListenAndServe(address, server)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringP("address", "a", "localhost:8000", "address to listen on")
+	serveCmd.Flags().StringP("url", "u", "", "external URL of the server, used in the printed URLs and QRs (default http://address)")
+	serveCmd.Flags().Bool("qr", false, "print a scheme manager session QR for each scheme manager")
+}
@@ -1,20 +1,17 @@
 package cmd
 
 import (
-	"fmt"
-	"os"
-
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
-	"crypto/rand"
+	"crypto/elliptic"
 	"crypto/sha256"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/pem"
 	"io/ioutil"
-	"math/big"
 	"path/filepath"
-	"strings"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/spf13/cobra"
@@ -24,111 +21,201 @@ import (
 var signCmd = &cobra.Command{
 	Use:   "sign path_to_private_key path_to_irma_configuration",
 	Short: "Sign a scheme manager directory",
-	Long:  "Sign a scheme manager directory, using the specified ECDSA key. Outputs an index file, signature over the index file, and the public key in the specified directory.",
-	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		signManager(args)
+	Long: `Sign a scheme manager directory, using the specified ECDSA or Ed25519 key. Outputs an index file, signature over the index file, and the public key in the specified directory.
+
+All files are signed except the index, its signature, the scheme manager keys, issuer private keys and .git directories, and files excluded by a .schemeignore file in the scheme manager directory. This file contains one pattern per line, in a syntax similar to that of .gitignore files.
+
+If the scheme manager has a single P-256 key, index.sig is written in the legacy format that all IRMA clients understand. Otherwise, and with --cosign, a format is used that only clients supporting multiple keys and other algorithms understand.
+
+If pk.pem already contains multiple public keys (see combine-keys), it is left alone, and the signing key must be one of them. Use --cosign to add a signature to index.sig instead of replacing it, so that the scheme manager can be signed by several of its keys; the index must then be unchanged since the previous signature.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cosign, err := cmd.Flags().GetBool("cosign")
+		if err != nil {
+			return err
+		}
+		return signManager(args[0], args[1], cosign)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(signCmd)
+	signCmd.Flags().Bool("cosign", false, "add a signature to the existing index.sig instead of replacing it")
 }
 
-func signManager(args []string) {
+func signManager(keypath, path string, cosign bool) error {
 	// Validate arguments
-	privatekey, err := readPrivateKey(args[0])
+	privatekey, err := readPrivateKey(keypath)
 	if err != nil {
-		die("Failed to read private key:", err)
+		return errors.WrapPrefix(err, "Failed to read private key", 0)
 	}
-	confpath, err := filepath.Abs(args[1])
+	confpath, err := filepath.Abs(path)
 	if err != nil {
-		die("Invalid path", err)
+		return errors.WrapPrefix(err, "Invalid path", 0)
 	}
 	if err = fs.AssertPathExists(confpath); err != nil {
-		die("Specified path does not exist", nil)
+		return errors.New("Specified path does not exist")
+	}
+
+	// Before writing anything, check that the key may sign this scheme manager: if pk.pem
+	// consists of multiple keys, or when cosigning, the key must be one of them
+	pks, contains, err := readPublicKeys(confpath+"/pk.pem", privatekey.Public())
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read existing public keys", 0)
+	}
+	if !contains && (cosign || (pks != nil && len(pks.Keys) > 1)) {
+		return errors.New("Signing key is not one of the keys in pk.pem")
 	}
 
 	// Traverse dir and add file hashes to index
 	var index irma.SchemeManagerIndex = make(map[string]irma.ConfigurationFileHash)
-	err = filepath.Walk(confpath, func(path string, info os.FileInfo, err error) error {
-		return calculateFileHash(path, info, err, confpath, index)
-
+	err = irma.WalkSchemeManagerFiles(confpath, func(relative string) error {
+		return calculateFileHash(confpath, relative, index)
 	})
 	if err != nil {
-		die("Failed to calculate file index:", err)
+		return errors.WrapPrefix(err, "Failed to calculate file index", 0)
 	}
 
-	// Write index.xml
+	// Create the signature, and when cosigning, check that the index is unchanged
+	// and combine the signature with the existing ones
 	bts := []byte(index.String())
-	if err = ioutil.WriteFile(confpath+"/index", bts, 0644); err != nil {
-		die("Failed to write index.xml", err)
+	var sig []byte
+	if cosign {
+		existing, err := ioutil.ReadFile(confpath + "/index")
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read existing index", 0)
+		}
+		if !bytes.Equal(existing, bts) {
+			return errors.New("Scheme manager contents changed since the index was signed; sign without --cosign first")
+		}
+		sigs, err := ioutil.ReadFile(confpath + "/index.sig")
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read existing signatures", 0)
+		}
+		if sigs, err = removeSignature(sigs, privatekey.Public()); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse existing signatures", 0)
+		}
+		if sig, err = irma.SignSchemeManagerIndex(bts, privatekey); err != nil {
+			return errors.WrapPrefix(err, "Failed to sign index", 0)
+		}
+		sig = append(sigs, sig...)
+	} else if sig, err = signIndex(bts, privatekey, pks); err != nil {
+		return errors.WrapPrefix(err, "Failed to sign index", 0)
 	}
 
-	// Create and write signature
-	indexHash := sha256.Sum256(bts)
-	r, s, err := ecdsa.Sign(rand.Reader, privatekey, indexHash[:])
-	if err != nil {
-		die("Failed to sign index:", err)
+	// Write index, signature and public key, unless pk.pem already contains it
+	if !cosign {
+		if err = ioutil.WriteFile(confpath+"/index", bts, 0644); err != nil {
+			return errors.WrapPrefix(err, "Failed to write index", 0)
+		}
 	}
-	sigbytes, err := asn1.Marshal([]*big.Int{r, s})
-	if err != nil {
-		die("Failed to serialize signature:", err)
+	if err = ioutil.WriteFile(confpath+"/index.sig", sig, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write index.sig", 0)
 	}
-	if err = ioutil.WriteFile(confpath+"/index.sig", sigbytes, 0644); err != nil {
-		die("Failed to write index.xml.sig", err)
+	if contains {
+		return nil
 	}
-
-	// Write public key
-	bts, err = x509.MarshalPKIXPublicKey(&privatekey.PublicKey)
+	pemEncodedPub, err := irma.MarshalSchemeManagerPublicKeys(&irma.SchemeManagerPublicKeys{
+		Keys: []crypto.PublicKey{privatekey.Public()},
+	})
 	if err != nil {
-		die("Failed to serialize public key", err)
+		return errors.WrapPrefix(err, "Failed to serialize public key", 0)
+	}
+	return ioutil.WriteFile(confpath+"/pk.pem", pemEncodedPub, 0644)
+}
+
+// signIndex signs the index with the key, in the legacy format if the key is a P-256 key
+// that will be the only key of the scheme manager, so that all clients can verify it.
+func signIndex(index []byte, key crypto.Signer, pks *irma.SchemeManagerPublicKeys) ([]byte, error) {
+	eckey, ok := key.(*ecdsa.PrivateKey)
+	if ok && eckey.Curve == elliptic.P256() && (pks == nil || len(pks.Keys) == 1) {
+		return irma.SignSchemeManagerIndexLegacy(index, eckey)
 	}
-	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
-	ioutil.WriteFile(confpath+"/pk.pem", pemEncodedPub, 0644)
+	return irma.SignSchemeManagerIndex(index, key)
 }
 
-func readPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+// readPublicKeys reads the pk.pem file at the specified path if it exists,
+// and reports whether it contains the specified key.
+func readPublicKeys(path string, pk crypto.PublicKey) (*irma.SchemeManagerPublicKeys, bool, error) {
+	exists, err := fs.PathExists(path)
+	if err != nil || !exists {
+		return nil, false, err
+	}
 	bts, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	block, _ := pem.Decode(bts)
-	return x509.ParseECPrivateKey(block.Bytes)
+	pks, err := irma.ParseSchemeManagerPublicKeys(bts)
+	if err != nil {
+		return nil, false, err
+	}
+	id, err := irma.PublicKeyID(pk)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, key := range pks.Keys {
+		if keyid, err := irma.PublicKeyID(key); err == nil && keyid == id {
+			return pks, true, nil
+		}
+	}
+	return pks, false, nil
 }
 
-func calculateFileHash(path string, info os.FileInfo, err error, confpath string, index irma.SchemeManagerIndex) error {
+// removeSignature removes any signature made by the specified key from the index.sig contents.
+func removeSignature(sigs []byte, pk crypto.PublicKey) ([]byte, error) {
+	id, err := irma.PublicKeyID(pk)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if info.IsDir() || // Can only sign files
-		strings.HasSuffix(path, "index") || // Skip the index file itself
-		strings.Contains(path, "/.git/") || // No need to traverse .git dirs
-		strings.Contains(path, "/PrivateKeys/") || // Don't sign private keys
-		(!strings.HasSuffix(path, ".xml") && !strings.HasSuffix(path, ".png")) {
-		return nil
+	var out []byte
+	for {
+		var block *pem.Block
+		block, sigs = pem.Decode(sigs)
+		if block == nil {
+			break
+		}
+		if block.Type == irma.SchemeManagerSignaturePEMType && block.Headers["Key-Id"] == id {
+			continue
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
 	}
+	if len(out) == 0 && len(bytes.TrimSpace(sigs)) > 0 {
+		return nil, errors.New("index.sig contains a legacy signature, which cannot be cosigned")
+	}
+	return out, nil
+}
 
+func readPrivateKey(path string) (crypto.Signer, error) {
 	bts, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
 	}
-	relativePath, err := filepath.Rel(confpath, path)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	relativePath = filepath.Join(filepath.Base(confpath), relativePath)
-
-	hash := sha256.Sum256(bts)
-	index[relativePath] = hash[:]
-	return nil
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key type")
+	}
+	return signer, nil
 }
 
-func die(message string, err error) {
+// calculateFileHash adds the hash of the file at the specified path relative to the
+// scheme manager folder to the index.
+func calculateFileHash(confpath, relative string, index irma.SchemeManagerIndex) error {
+	bts, err := ioutil.ReadFile(filepath.Join(confpath, filepath.FromSlash(relative)))
 	if err != nil {
-		fmt.Println(message, err)
-	} else {
-		fmt.Println(message)
+		return err
 	}
-	os.Exit(1)
+	hash := sha256.Sum256(bts)
+	index[filepath.Base(confpath)+"/"+relative] = hash[:]
+	return nil
 }
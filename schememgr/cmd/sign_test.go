@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestKey generates a P-256 key and writes it to a file in dir, returning the key and the path.
+func writeTestKey(t *testing.T, dir, name string) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bts, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bts}), 0600))
+	return key, path
+}
+
+func TestSignManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sign")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	manager := filepath.Join(dir, "irma-demo")
+	require.NoError(t, fs.CopyDirectory("../../testdata/irma_configuration/irma-demo", manager))
+	key, keypath := writeTestKey(t, dir, "sk.pem")
+
+	// A single P-256 key results in a legacy signature, verifiable using the written pk.pem
+	require.NoError(t, signManager(keypath, manager, false))
+	index, err := ioutil.ReadFile(filepath.Join(manager, "index"))
+	require.NoError(t, err)
+	sig, err := ioutil.ReadFile(filepath.Join(manager, "index.sig"))
+	require.NoError(t, err)
+	_, rest := pem.Decode(sig)
+	require.Equal(t, sig, rest, "Expected legacy signature")
+	bts, err := ioutil.ReadFile(filepath.Join(manager, "pk.pem"))
+	require.NoError(t, err)
+	pks, err := irma.ParseSchemeManagerPublicKeys(bts)
+	require.NoError(t, err)
+	require.Len(t, pks.Keys, 1)
+	valid, err := irma.VerifySchemeManagerSignatures(index, sig, pks)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// A key not in a pk.pem consisting of multiple keys is refused without modifying anything
+	other, _ := writeTestKey(t, dir, "other.pem")
+	bts, err = irma.MarshalSchemeManagerPublicKeys(&irma.SchemeManagerPublicKeys{
+		Keys: []crypto.PublicKey{key.Public(), other.Public()},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(manager, "pk.pem"), bts, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(manager, "description.xml"), []byte("changed"), 0644))
+	_, stranger := writeTestKey(t, dir, "stranger.pem")
+	require.Error(t, signManager(stranger, manager, false))
+	bts, err = ioutil.ReadFile(filepath.Join(manager, "index"))
+	require.NoError(t, err)
+	require.Equal(t, index, bts)
+	bts, err = ioutil.ReadFile(filepath.Join(manager, "index.sig"))
+	require.NoError(t, err)
+	require.Equal(t, sig, bts)
+
+	// With multiple keys, a member key signs in the new format
+	require.NoError(t, signManager(keypath, manager, false))
+	sig, err = ioutil.ReadFile(filepath.Join(manager, "index.sig"))
+	require.NoError(t, err)
+	block, _ := pem.Decode(sig)
+	require.NotNil(t, block)
+	require.Equal(t, irma.SchemeManagerSignaturePEMType, block.Type)
+}
@@ -46,6 +46,9 @@ func RunVerify(path string) error {
 		if err := conf.VerifySchemeManager(manager); err != nil {
 			return err
 		}
+		for _, file := range manager.UnsignedFiles {
+			fmt.Println("Warning: file not signed:", file)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,103 @@
+package irma
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// SchemeManagerServer is an http.Handler that serves one or more scheme manager folders
+// in the layout that Configuration.InstallSchemeManager and Configuration.UpdateSchemeManager
+// expect: a scheme manager with ID foo is served at /foo/, so that after installing it from
+// (server URL)/foo, its description.xml, pk.pem, index, index.sig and all files in its index
+// can be downloaded. Private keys are never served.
+//
+// For use in tests it can be combined with net/http/httptest:
+//
+//	handler, err := irma.NewSchemeManagerServer("testdata/irma_configuration/irma-demo")
+//	server := httptest.NewServer(handler)
+//	manager, err := irma.DownloadSchemeManager(server.URL + "/irma-demo")
+type SchemeManagerServer struct {
+	// Maps scheme manager IDs to (absolute) paths of their folders
+	Managers map[string]string
+}
+
+// NewSchemeManagerServer returns a SchemeManagerServer for the specified scheme manager folders.
+func NewSchemeManagerServer(paths ...string) (*SchemeManagerServer, error) {
+	server := &SchemeManagerServer{Managers: map[string]string{}}
+	for _, p := range paths {
+		if err := server.Add(p); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// Add adds the scheme manager folder at the specified path to the server.
+func (s *SchemeManagerServer) Add(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "description.xml"))
+	if err != nil {
+		return errors.Errorf("%s is not a scheme manager folder: %s", dir, err)
+	}
+	manager := &SchemeManager{}
+	if err = xml.Unmarshal(bts, manager); err != nil {
+		return err
+	}
+	if manager.ID == "" {
+		return errors.Errorf("Scheme manager in %s has no ID", dir)
+	}
+	if _, exists := s.Managers[manager.ID]; exists {
+		return errors.Errorf("Scheme manager %s specified twice", manager.ID)
+	}
+	s.Managers[manager.ID] = dir
+	return nil
+}
+
+// URL returns the URL at which the specified scheme manager is served, given the URL of the server.
+func (s *SchemeManagerServer) URL(serverURL string, id SchemeManagerIdentifier) string {
+	return strings.TrimSuffix(serverURL, "/") + "/" + id.String()
+}
+
+// isServable returns whether the file at the specified path relative to a scheme manager folder
+// may be served: we never serve private keys, or version control or hidden files.
+func isServable(relative string) bool {
+	parts := strings.Split(relative, "/")
+	for _, part := range parts {
+		if part == "PrivateKeys" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return parts[len(parts)-1] != "sk.pem"
+}
+
+func (s *SchemeManagerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The cleaned path has the form /managerID/relative/path/to/file
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/", 2)
+	dir, ok := s.Managers[parts[0]]
+	if !ok || len(parts) < 2 || !isServable(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(parts[1]))
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, file)
+}
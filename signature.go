@@ -0,0 +1,284 @@
+package irma
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the signing and verification of scheme manager index files.
+//
+// The pk.pem file of a scheme manager contains one or more PEM-encoded PKIX public keys,
+// each of which may be an ECDSA (P-256 or P-384) or Ed25519 key. The first key may carry a
+// "Threshold" PEM header specifying how many of the keys must have signed the index;
+// by default all of them must.
+//
+// The index.sig file contains one PEM block of type SchemeManagerSignaturePEMType per signature,
+// whose headers specify the signature algorithm and the ID of the key that made it.
+// For backwards compatibility, an index.sig consisting of a bare ASN.1-encoded ECDSA signature
+// is also accepted if pk.pem contains a single ECDSA key. As earlier versions only understand
+// that format, SignSchemeManagerIndexLegacy should be used for scheme managers having a
+// single P-256 key.
+//
+// Ed25519 keys are only supported when built with Go 1.13 or later (see signature_ed25519.go).
+
+// SignatureAlgorithm identifies an algorithm with which scheme manager indices can be signed.
+type SignatureAlgorithm string
+
+const (
+	SignatureAlgorithmECDSAP256 = SignatureAlgorithm("ecdsa-p256-sha256")
+	SignatureAlgorithmECDSAP384 = SignatureAlgorithm("ecdsa-p384-sha384")
+	SignatureAlgorithmEd25519   = SignatureAlgorithm("ed25519")
+)
+
+const (
+	// SchemeManagerSignaturePEMType is the PEM block type of signatures in index.sig files.
+	SchemeManagerSignaturePEMType = "IRMA SCHEME MANAGER SIGNATURE"
+
+	pemHeaderAlgorithm = "Algorithm"
+	pemHeaderKeyID     = "Key-Id"
+	pemHeaderThreshold = "Threshold"
+)
+
+// SchemeManagerPublicKeys contains the public keys of a scheme manager, and the number of
+// them that must have signed its index for it to be valid.
+type SchemeManagerPublicKeys struct {
+	Keys      []crypto.PublicKey
+	Threshold int
+}
+
+// SignatureAlgorithmOf returns the algorithm with which the specified public key signs.
+func SignatureAlgorithmOf(pk crypto.PublicKey) (SignatureAlgorithm, error) {
+	switch key := pk.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return SignatureAlgorithmECDSAP256, nil
+		case elliptic.P384():
+			return SignatureAlgorithmECDSAP384, nil
+		}
+		return "", errors.Errorf("Unsupported ECDSA curve %s", key.Curve.Params().Name)
+	default:
+		if isEd25519PublicKey(pk) {
+			return SignatureAlgorithmEd25519, nil
+		}
+		return "", errors.Errorf("Unsupported public key type %T", pk)
+	}
+}
+
+// PublicKeyID returns an identifier of the specified public key, consisting of
+// the hex-encoded first 8 bytes of the SHA256 hash of its PKIX encoding.
+func PublicKeyID(pk crypto.PublicKey) (string, error) {
+	bts, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bts)
+	return hex.EncodeToString(hash[:8]), nil
+}
+
+// ParseSchemeManagerPublicKeys parses the contents of a pk.pem file.
+func ParseSchemeManagerPublicKeys(bts []byte) (*SchemeManagerPublicKeys, error) {
+	pks := &SchemeManagerPublicKeys{}
+	for {
+		var block *pem.Block
+		block, bts = pem.Decode(bts)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = SignatureAlgorithmOf(pk); err != nil {
+			return nil, err
+		}
+		if threshold, ok := block.Headers[pemHeaderThreshold]; ok && len(pks.Keys) == 0 {
+			if pks.Threshold, err = strconv.Atoi(threshold); err != nil {
+				return nil, errors.Errorf("Invalid threshold %s", threshold)
+			}
+		}
+		pks.Keys = append(pks.Keys, pk)
+	}
+
+	if len(pks.Keys) == 0 {
+		return nil, errors.New("No scheme manager public keys found")
+	}
+	if pks.Threshold == 0 {
+		pks.Threshold = len(pks.Keys)
+	}
+	if pks.Threshold < 1 || pks.Threshold > len(pks.Keys) {
+		return nil, errors.Errorf("Invalid threshold %d for %d keys", pks.Threshold, len(pks.Keys))
+	}
+	return pks, nil
+}
+
+// MarshalSchemeManagerPublicKeys encodes the specified keys and threshold into the contents of a pk.pem file.
+func MarshalSchemeManagerPublicKeys(pks *SchemeManagerPublicKeys) ([]byte, error) {
+	var out []byte
+	for i, pk := range pks.Keys {
+		bts, err := x509.MarshalPKIXPublicKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		block := &pem.Block{Type: "PUBLIC KEY", Bytes: bts}
+		if i == 0 && pks.Threshold != 0 && pks.Threshold != len(pks.Keys) {
+			block.Headers = map[string]string{pemHeaderThreshold: strconv.Itoa(pks.Threshold)}
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+	return out, nil
+}
+
+// SignSchemeManagerIndex signs the specified index file contents with the specified key,
+// which must be an *ecdsa.PrivateKey or ed25519.PrivateKey, returning the signature
+// as a PEM block suitable for inclusion in an index.sig file.
+// Only this version of irmago understands this format; see also SignSchemeManagerIndexLegacy.
+func SignSchemeManagerIndex(index []byte, key crypto.Signer) ([]byte, error) {
+	algorithm, err := SignatureAlgorithmOf(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := PublicKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	switch algorithm {
+	case SignatureAlgorithmECDSAP256:
+		hash := sha256.Sum256(index)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	case SignatureAlgorithmECDSAP384:
+		hash := sha512.Sum384(index)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA384)
+	case SignatureAlgorithmEd25519:
+		sig, err = key.Sign(rand.Reader, index, crypto.Hash(0))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    SchemeManagerSignaturePEMType,
+		Headers: map[string]string{pemHeaderAlgorithm: string(algorithm), pemHeaderKeyID: keyID},
+		Bytes:   sig,
+	}), nil
+}
+
+// SignSchemeManagerIndexLegacy signs the specified index file contents with the specified
+// P-256 key, returning a bare ASN.1-encoded ECDSA signature, which is the index.sig format
+// understood by all versions of irmago.
+func SignSchemeManagerIndexLegacy(index []byte, key *ecdsa.PrivateKey) ([]byte, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("Legacy index signatures require a P-256 key")
+	}
+	hash := sha256.Sum256(index)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal([]*big.Int{r, s})
+}
+
+// verifyECDSA verifies the ASN.1-encoded ECDSA signature over the specified hash.
+func verifyECDSA(pk *ecdsa.PublicKey, hash, sig []byte) bool {
+	ints := make([]*big.Int, 0, 2)
+	if rest, err := asn1.Unmarshal(sig, &ints); err != nil || len(rest) > 0 || len(ints) != 2 {
+		return false
+	}
+	return ecdsa.Verify(pk, hash, ints[0], ints[1])
+}
+
+// verifyIndexSignature verifies a single signature over the index using the specified algorithm.
+func verifyIndexSignature(algorithm SignatureAlgorithm, pk crypto.PublicKey, index, sig []byte) bool {
+	switch algorithm {
+	case SignatureAlgorithmECDSAP256:
+		hash := sha256.Sum256(index)
+		return verifyECDSA(pk.(*ecdsa.PublicKey), hash[:], sig)
+	case SignatureAlgorithmECDSAP384:
+		hash := sha512.Sum384(index)
+		return verifyECDSA(pk.(*ecdsa.PublicKey), hash[:], sig)
+	case SignatureAlgorithmEd25519:
+		return verifyEd25519(pk, index, sig)
+	default:
+		return false
+	}
+}
+
+// VerifySchemeManagerSignatures checks that the signatures in the specified index.sig contents
+// were made over the index by at least the threshold number of distinct keys from pk.pem.
+// Signatures from unknown keys, or that do not verify, are ignored.
+func VerifySchemeManagerSignatures(index, sigs []byte, pks *SchemeManagerPublicKeys) (bool, error) {
+	keys := map[string]crypto.PublicKey{}
+	for _, pk := range pks.Keys {
+		id, err := PublicKeyID(pk)
+		if err != nil {
+			return false, err
+		}
+		keys[id] = pk
+	}
+
+	block, _ := pem.Decode(sigs)
+	if block == nil {
+		return verifyLegacySignature(index, sigs, pks)
+	}
+
+	valid := map[string]bool{}
+	for rest := sigs; ; {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != SchemeManagerSignaturePEMType {
+			continue
+		}
+		id := block.Headers[pemHeaderKeyID]
+		pk, ok := keys[id]
+		if !ok {
+			continue
+		}
+		// The algorithm is determined by the key; the header only needs to agree with it
+		algorithm, err := SignatureAlgorithmOf(pk)
+		if err != nil || string(algorithm) != block.Headers[pemHeaderAlgorithm] {
+			continue
+		}
+		if verifyIndexSignature(algorithm, pk, index, block.Bytes) {
+			valid[id] = true
+		}
+	}
+
+	return len(valid) >= pks.Threshold, nil
+}
+
+// verifyLegacySignature verifies a bare ASN.1-encoded ECDSA signature over the SHA256 hash
+// of the index, as written by earlier versions of schememgr, which only used P-256 keys.
+func verifyLegacySignature(index, sig []byte, pks *SchemeManagerPublicKeys) (bool, error) {
+	if len(pks.Keys) != 1 {
+		return false, errors.New("Scheme manager has multiple public keys but index.sig contains a single legacy signature")
+	}
+	pk, ok := pks.Keys[0].(*ecdsa.PublicKey)
+	if !ok || pk.Curve != elliptic.P256() {
+		return false, errors.New("Legacy index signature requires a P-256 public key")
+	}
+	ints := make([]*big.Int, 0, 2)
+	if _, err := asn1.Unmarshal(sig, &ints); err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(index)
+	return verifyECDSA(pk, hash[:], sig), nil
+}
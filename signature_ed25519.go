@@ -0,0 +1,22 @@
+//go:build go1.13
+// +build go1.13
+
+package irma
+
+import (
+	"crypto"
+	"crypto/ed25519"
+)
+
+// Ed25519 keys can only be used in pk.pem files as of Go 1.13, whose crypto/x509
+// supports parsing and marshaling them.
+
+func isEd25519PublicKey(pk crypto.PublicKey) bool {
+	_, ok := pk.(ed25519.PublicKey)
+	return ok
+}
+
+func verifyEd25519(pk crypto.PublicKey, message, sig []byte) bool {
+	key, ok := pk.(ed25519.PublicKey)
+	return ok && ed25519.Verify(key, message, sig)
+}
@@ -0,0 +1,44 @@
+//go:build go1.13
+// +build go1.13
+
+package irma
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemeManagerEd25519Signatures(t *testing.T) {
+	index := []byte("0123 irma-demo/description.xml\n")
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	bts, err := MarshalSchemeManagerPublicKeys(&SchemeManagerPublicKeys{Keys: []crypto.PublicKey{ed.Public()}})
+	require.NoError(t, err)
+	pks, err := ParseSchemeManagerPublicKeys(bts)
+	require.NoError(t, err)
+	sig, err := SignSchemeManagerIndex(index, ed)
+	require.NoError(t, err)
+	valid, err := VerifySchemeManagerSignatures(index, sig, pks)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = VerifySchemeManagerSignatures(append(index, ' '), sig, pks)
+	require.NoError(t, err)
+	require.False(t, valid, "Signature over modified index accepted")
+
+	// Mixed with an ECDSA key
+	pks = &SchemeManagerPublicKeys{Keys: []crypto.PublicKey{ed.Public(), p256.Public()}, Threshold: 2}
+	sig2, err := SignSchemeManagerIndex(index, p256)
+	require.NoError(t, err)
+	valid, err = VerifySchemeManagerSignatures(index, append(sig, sig2...), pks)
+	require.NoError(t, err)
+	require.True(t, valid)
+}
@@ -0,0 +1,16 @@
+//go:build !go1.13
+// +build !go1.13
+
+package irma
+
+import "crypto"
+
+// Before Go 1.13, Ed25519 keys are not supported (see signature_ed25519.go).
+
+func isEd25519PublicKey(pk crypto.PublicKey) bool {
+	return false
+}
+
+func verifyEd25519(pk crypto.PublicKey, message, sig []byte) bool {
+	return false
+}